@@ -2,168 +2,6118 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
+	pb "github.com/hyperledger/fabric/protos/peer"
 )
 
+// chaincodeFunction is the signature shared by every invoke and query handler
+type chaincodeFunction func(stub shim.ChaincodeStubInterface, args []string) ([]byte, error)
+
 // SimpleChaincode example simple Chaincode implementation
 type SimpleChaincode struct {
+	functionsOnce   sync.Once
+	invokeFunctions map[string]chaincodeFunction
+	queryFunctions  map[string]chaincodeFunction
+}
+
+// logger is the chaincode logger. Its level follows the chaincode logging spec of the peer
+// (CORE_CHAINCODE_LOGGING_LEVEL), debug output is silenced at the default INFO level.
+var logger = shim.NewLogger("ars")
+
+func main() {
+	err := shim.Start(new(SimpleChaincode))
+	if err != nil {
+		logger.Errorf("Error starting Simple chaincode: %s", err)
+	}
+}
+
+// version information reported by the info query,
+// the build timestamp is meant to be set at build time with -ldflags "-X main.buildTimestamp=..."
+var (
+	chaincodeVersion = "1.0.0"
+	buildTimestamp   = "unknown"
+)
+
+// authorizedCreatorMSPs lists the MSP IDs of the organizations allowed to create and change entries
+var authorizedCreatorMSPs = []string{"Org1MSP"}
+
+// authorizedAdminMSPs lists the MSP IDs of the organizations allowed to run admin functions
+var authorizedAdminMSPs = []string{"Org1MSP"}
+
+// resetConfirmation is the argument resetAll requires to wipe the state
+const resetConfirmation = "CONFIRM"
+
+// textQueryFunctions are the queries whose result is text rather than a single JSON value,
+// it is always embedded in the response envelope as a JSON string
+var textQueryFunctions = map[string]bool{
+	"exportCSV":    true,
+	"exportNDJSON": true,
+}
+
+// adHocQueryFields are the top level fields a client supplied rich query may have
+var adHocQueryFields = map[string]bool{
+	"selector":  true,
+	"fields":    true,
+	"sort":      true,
+	"limit":     true,
+	"skip":      true,
+	"use_index": true,
+}
+
+// requireAdHocQueryLimit makes adHocQuery reject queries without a limit
+var requireAdHocQueryLimit = false
+
+// maxDevicesPerQuery caps the number of devices queryByDevices accepts
+const maxDevicesPerQuery = 100
+
+// maxEntriesPerRead caps the number of entries readEntries reads in one call
+const maxEntriesPerRead = 100
+
+// maxRecentEntries caps the number of entries the recent query may return
+const maxRecentEntries = 1000
+
+// maxQueryResults caps the number of records a non paginated rich query may return
+const maxQueryResults = 10000
+
+// compositeKeyNamespace is the prefix of every key created with CreateCompositeKey
+const compositeKeyNamespace = "\x00"
+
+// deviceIndexName is the object type of the composite keys listing the devices that have entries
+const deviceIndexName = "device"
+
+// deviceAttributeIndexName is the object type of the composite keys listing the attributes of each device
+const deviceAttributeIndexName = "device~attr"
+
+// entry key schemes, entryKeyScheme selects how the state key of an entry is built
+const (
+	keySchemeTimestamp = "timestamp" // the timestamp alone, all devices share one keyspace
+	keySchemeDevice    = "device"    // deviceName_timestamp, each device has its own keyspace
+)
+
+// timestampLayout is the format of normalized timestamps, RFC3339 with all nine digits of
+// fractional seconds. Unlike RFC3339Nano it keeps trailing zeros, every key therefore has the
+// same width and keys sort chronologically.
+const timestampLayout = "2006-01-02T15:04:05.000000000Z07:00"
+
+// entryKeySeparator separates the device name from the timestamp in device scheme keys,
+// RFC3339 timestamps never contain it so a key splits unambiguously at the last one. Device
+// names may contain it under keySchemeTimestamp only: with keySchemeDevice the keys of a device
+// named "a_2020-01" would fall within the key range of device "a".
+const entryKeySeparator = "_"
+
+// entryKeyScheme is the key scheme of the entries. With keySchemeTimestamp two devices
+// reporting at the same instant collide on one key. keySchemeDevice avoids that, but the keys
+// no longer sort by time across devices so byTimeRange and purgeExpired are unavailable.
+// Entries stored under another scheme are moved by Init with "migrate". Functions taking the
+// timestamp of a single entry, such as update and delete, take its entry key.
+var entryKeyScheme = keySchemeTimestamp
+
+// indexKeyParts is the number of key parts of each entry index: device~attr~time and
+// device~bucket~time end with the timestamp of the entry, device and device~attr list names
+var indexKeyParts = map[string]int{
+	deviceAttrIndexName:      3, // deviceName, attribute, timestamp
+	deviceIndexName:          1, // deviceName
+	deviceAttributeIndexName: 2, // deviceName, attribute
+	deviceBucketIndexName:    3, // deviceName, bucket, timestamp
+}
+
+// deviceBucketIndexName is the object type of the composite keys indexing entries by device
+// and time bucket, the bucket being the start of the timeBucketSize window holding the entry
+const deviceBucketIndexName = "device~bucket~time"
+
+// timeBucketSize is the granularity of the device~bucket~time index. A time window query
+// scans one bucket per timeBucketSize of the window, at most maxBucketsPerQuery of them.
+const (
+	timeBucketSize     = time.Hour
+	maxBucketsPerQuery = 7 * 24
+)
+
+// compositeIndexNames are the entry indexes that queryCompositeIndex may page through
+var compositeIndexNames = map[string]bool{
+	deviceAttrIndexName:      true,
+	deviceIndexName:          true,
+	deviceAttributeIndexName: true,
+	deviceBucketIndexName:    true,
+}
+
+// deviceRateName is the object type of the composite keys holding the rate window of a device
+const deviceRateName = "device~rate"
+
+// deviceRegistryName is the object type of the composite keys holding the registration of a device
+const deviceRegistryName = "device~registry"
+
+// deviceMetaName is the object type of the composite keys holding the display metadata of a device
+const deviceMetaName = "device~meta"
+
+// deviceLogName is the object type of the composite keys holding the append-only log of a device
+const deviceLogName = "device~log"
+
+// privateValueTransientKey is the transient map field carrying the attribute value of a private entry
+const privateValueTransientKey = "attributeValue"
+
+// configName is the object type of the composite keys holding chaincode settings stored in state
+const configName = "config"
+
+// strictModeSetting is the setting under configName that enables the optional validations
+const strictModeSetting = "strictMode"
+
+// idempotencyKeyName is the object type of the composite keys holding the outcome of an
+// invocation made through invokeIdempotent
+const idempotencyKeyName = "idempotency~key"
+
+// deviceAttrIndexName is the object type of the composite keys indexing entries by device and attribute
+const deviceAttrIndexName = "device~attr~time"
+
+// reservedKeyPrefixes are the key prefixes used for internal bookkeeping, the timestamps of
+// entries must not start with any of them, see checkReservedKey. "_" is reserved by CouchDB
+// for its own documents. With keySchemeDevice the key starts with the device name, a device
+// name starting with "_" is rejected there as it holds entryKeySeparator.
+var reservedKeyPrefixes = []string{compositeKeyNamespace, "_", deviceAttrIndexName, deviceRegistryName, deviceRateName, deviceMetaName, deviceLogName, idempotencyKeyName, configName}
+
+type Entry struct {
+	Timestamp      string          `json:"timestamp"` // used as ID, gateways should send fractional seconds so that readings within a second do not collide
+	DeviceName     string          `json:"deviceName"`
+	Attribute      string          `json:"attribute"`
+	AttributeValue json.RawMessage `json:"attributeValue"`         // a JSON string, or any JSON value for the json value type
+	ValueType      string          `json:"valueType"`              // one of string, number, bool or json
+	NumericValue   *float64        `json:"numericValue,omitempty"` // set for number values, enables range comparisons in rich queries
+	CreatedBy      *Identity       `json:"createdBy,omitempty"`    // client that submitted the entry
+	TxTimestamp    string          `json:"txTimestamp,omitempty"`  // time of the transaction that created the entry, assigned by the ledger
+	Deleted        bool            `json:"deleted"`                // soft-deleted entries are hidden from queries by default
+	DeletedAt      string          `json:"deletedAt,omitempty"`    // time of the transaction that soft-deleted the entry
+	Version        int             `json:"version"`                // incremented on every write, updates must name the version they change
+	Tags           []string        `json:"tags,omitempty"`         // labels such as "calibration" or "anomaly", sorted and unique
+	LastTxID       string          `json:"lastTxId,omitempty"`     // ID of the transaction that last wrote the entry
+	Hash           string          `json:"hash,omitempty"`         // SHA-256 of the canonical JSON of the entry without its hash, set on every write
+}
+
+// Identity identifies the client that submitted a transaction
+type Identity struct {
+	MSPID      string `json:"mspId"`
+	CommonName string `json:"commonName"`
+}
+
+// size limits of entry fields, they bound the size of a single entry in state. The limits of
+// deviceName, attribute and attributeValue only apply in strict mode since those fields were
+// unbounded before, see validateEntry. Tags, device metadata and idempotency keys were
+// limited from the start and are checked in every mode.
+const (
+	maxNameLength  = 128       // deviceName, attribute and tags, in bytes
+	maxValueLength = 64 * 1024 // attributeValue, in bytes
+	maxTags        = 32        // tags of one entry
+)
+
+// maxDeletionsPerCall caps the number of entries a bulk deletion removes in one transaction
+var maxDeletionsPerCall = 1000
+
+// maxUpdateBatchSize caps the number of entries a batch update changes in one transaction
+var maxUpdateBatchSize = 500
+
+// maxDeviceLogLength caps the number of readings kept in the log of a device, the oldest
+// readings are dropped first
+var maxDeviceLogLength = 1000
+
+// entryArgFields are the entry fields a client sets when creating an entry from a JSON object
+var entryArgFields = map[string]bool{
+	"timestamp":      true,
+	"deviceName":     true,
+	"attribute":      true,
+	"attributeValue": true,
+	"valueType":      true,
+}
+
+// patchableFields are the entry fields patchEntry may overwrite
+var patchableFields = map[string]bool{
+	"deviceName":     true,
+	"attribute":      true,
+	"attributeValue": true,
+	"valueType":      true,
+}
+
+// valuelessAttributes are the event style attributes whose entries may have an empty
+// attributeValue, the presence of the reading is the signal. Their values are stored as "".
+// Example: var valuelessAttributes = map[string]bool{"motion": true, "heartbeat": true}
+var valuelessAttributes = map[string]bool{}
+
+// rate limit of entry creation per device, at most rateLimitEntries entries may be created
+// for a device within any rateLimitWindow. A limit of 0 disables rate limiting.
+var (
+	rateLimitEntries = 0
+	rateLimitWindow  = time.Minute
+)
+
+// maxFutureSkew is how far ahead of the transaction time an entry timestamp may be,
+// it absorbs clock differences between gateways and peers
+var maxFutureSkew = 5 * time.Minute
+
+// deviceNamePattern is the format device names must match
+var deviceNamePattern = regexp.MustCompile("^[A-Za-z0-9_-]+$")
+
+// tagPattern is the format entry tags must match
+var tagPattern = regexp.MustCompile("^[A-Za-z0-9_-]+$")
+
+// supported value types of an entry's attributeValue
+const (
+	valueTypeString = "string"
+	valueTypeNumber = "number"
+	valueTypeBool   = "bool"
+	valueTypeJSON   = "json" // structured values such as a GPS point, stored as nested JSON
+)
+
+// Stable error codes carried by the structured errors returned to clients
+const (
+	errCodeBadArgs         = "BAD_ARGS"
+	errCodeNotFound        = "NOT_FOUND"
+	errCodeDuplicateKey    = "DUPLICATE_KEY"
+	errCodeInternal        = "INTERNAL"
+	errCodeForbidden       = "FORBIDDEN"
+	errCodeResultLimit     = "RESULT_LIMIT_EXCEEDED"
+	errCodeVersionConflict = "VERSION_CONFLICT"
+	errCodeRateLimit       = "RATE_LIMIT_EXCEEDED"
+	errCodeUnsupported     = "UNSUPPORTED"
+	errCodeUnknownFunction = "UNKNOWN_FUNCTION"
+)
+
+// HTTP-style statuses of the query response envelope
+const (
+	statusOK              = 200
+	statusBadRequest      = 400
+	statusForbidden       = 403
+	statusNotFound        = 404
+	statusConflict        = 409
+	statusPayloadTooLarge = 413
+	statusTooManyRequests = 429
+	statusInternalError   = 500
+	statusNotImplemented  = 501
+)
+
+// errorStatuses maps the error codes onto the statuses of the query response envelope
+var errorStatuses = map[string]int{
+	errCodeBadArgs:         statusBadRequest,
+	errCodeNotFound:        statusNotFound,
+	errCodeDuplicateKey:    statusConflict,
+	errCodeInternal:        statusInternalError,
+	errCodeForbidden:       statusForbidden,
+	errCodeResultLimit:     statusPayloadTooLarge,
+	errCodeVersionConflict: statusConflict,
+	errCodeRateLimit:       statusTooManyRequests,
+	errCodeUnsupported:     statusNotImplemented,
+	errCodeUnknownFunction: statusBadRequest,
+}
+
+// QueryResponse is the envelope of every query result, {"status":200,"payload":...} on
+// success and {"status":404,"message":"...","code":"NOT_FOUND"} on failure
+type QueryResponse struct {
+	Status  int             `json:"status"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+	Message string          `json:"message,omitempty"`
+	Code    string          `json:"code,omitempty"`
+}
+
+// chaincodeError is an error serialized as {"error":"...","code":"..."} so that clients
+// can switch on the code rather than matching on the message
+type chaincodeError struct {
+	Message string `json:"error"`
+	Code    string `json:"code"`
+	cause   error  // the underlying error or typed error, if any, reachable with errors.As
+}
+
+func (e *chaincodeError) Error() string {
+	errorAsBytes, _ := json.Marshal(e)
+	return string(errorAsBytes)
+}
+
+// Unwrap returns the underlying error, nil when the error was raised by the chaincode itself
+func (e *chaincodeError) Unwrap() error {
+	return e.cause
+}
+
+// newChaincodeError builds a structured error with the given code and message
+func newChaincodeError(code string, message string) error {
+	return &chaincodeError{Message: message, Code: code}
+}
+
+// DuplicateKeyError is the typed cause of DUPLICATE_KEY errors, Key is the state key
+// that is already taken
+type DuplicateKeyError struct {
+	Key string
+}
+
+func (e *DuplicateKeyError) Error() string {
+	return "key already exists: " + e.Key
+}
+
+// NotFoundError is the typed cause of NOT_FOUND errors, Key is the key or device name
+// that was looked up
+type NotFoundError struct {
+	Key string
+}
+
+func (e *NotFoundError) Error() string {
+	return "not found: " + e.Key
+}
+
+// ValidationError is the typed cause of BAD_ARGS errors raised by entry validation,
+// Field is the JSON name of the offending entry field
+type ValidationError struct {
+	Field  string
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Field + ": " + e.Reason
+}
+
+// newDuplicateKeyError builds a DUPLICATE_KEY error caused by a DuplicateKeyError
+func newDuplicateKeyError(key string, message string) error {
+	return &chaincodeError{Message: message, Code: errCodeDuplicateKey, cause: &DuplicateKeyError{key}}
+}
+
+// newNotFoundError builds a NOT_FOUND error caused by a NotFoundError
+func newNotFoundError(key string, message string) error {
+	return &chaincodeError{Message: message, Code: errCodeNotFound, cause: &NotFoundError{key}}
+}
+
+// newValidationError builds a BAD_ARGS error caused by a ValidationError, the message
+// is the field name followed by the reason
+func newValidationError(field string, reason string) error {
+	return &chaincodeError{Message: field + " " + reason, Code: errCodeBadArgs, cause: &ValidationError{field, reason}}
+}
+
+// =========================================================================================
+// richQueryError explains the failure of a rich query on a state database without rich
+// query support: LevelDB peers reject them with a low-level "not supported for leveldb",
+// which is replaced by a hint that CouchDB is required. Other errors are returned as is.
+// =========================================================================================
+func richQueryError(err error) error {
+	if !strings.Contains(strings.ToLower(err.Error()), "not supported for leveldb") {
+		return err
+	}
+	logger.Warning("Rich query on a peer without CouchDB: " + err.Error())
+	return &chaincodeError{
+		Message: "rich queries require CouchDB as the state database of the peer, use the key based queries on LevelDB (" + err.Error() + ")",
+		Code:    errCodeUnsupported,
+		cause:   err,
+	}
+}
+
+// QueryRecord is a single element of a query result, the state key and its value
+type QueryRecord struct {
+	Key    string
+	Record json.RawMessage
+}
+
+// Aggregate holds statistics over the numeric values of an attribute,
+// Min, Max and Avg are null when no numeric value was found
+type Aggregate struct {
+	Count   int      `json:"count"`
+	Min     *float64 `json:"min"`
+	Max     *float64 `json:"max"`
+	Sum     float64  `json:"sum"`
+	Avg     *float64 `json:"avg"`
+	Skipped int      `json:"skipped"` // entries whose value is not numeric
+}
+
+// Delta is the change of a numeric attribute since the previous numeric reading. Gap
+// marks that readings with non-numeric or missing values were skipped in between.
+type Delta struct {
+	Timestamp string  `json:"timestamp"`
+	Delta     float64 `json:"delta"`
+	Gap       bool    `json:"gap,omitempty"`
+}
+
+// DeltaSeries is the series of changes of a numeric attribute in reading order
+type DeltaSeries struct {
+	Deltas  []Delta `json:"deltas"`
+	Skipped int     `json:"skipped"` // entries whose value is not numeric
+}
+
+// Sample is the representative reading of a downsampling bucket. Bucket is the start of
+// the bucket, Timestamp the time of its last reading, Count the readings it holds.
+type Sample struct {
+	Bucket    string   `json:"bucket"`
+	Timestamp string   `json:"timestamp"`
+	Value     *float64 `json:"value"` // null when no reading of the bucket is numeric
+	Count     int      `json:"count"`
+}
+
+// downsampling modes of downsample, the last numeric reading or the average of the bucket
+const (
+	downsampleLast    = "last"
+	downsampleAverage = "avg"
+)
+
+// Gap is a period in which a device attribute had no reading for longer than expected
+type Gap struct {
+	Start           string  `json:"start"`
+	End             string  `json:"end"`
+	DurationSeconds float64 `json:"durationSeconds"`
+}
+
+// decodedIndexKey is an entry index key decoded into its typed parts,
+// the parts the index does not hold are empty
+type decodedIndexKey struct {
+	ObjectType string
+	DeviceName string
+	Attribute  string
+	Bucket     string
+	Timestamp  string
+}
+
+// CompositeIndexKey is an index key decoded into its object type and key parts
+type CompositeIndexKey struct {
+	Key        string   `json:"key"`
+	ObjectType string   `json:"objectType"`
+	Attributes []string `json:"attributes"`
+}
+
+// IntegrityResult compares the hash stored with an entry to the one recomputed from its fields
+type IntegrityResult struct {
+	StoredHash   string `json:"storedHash"`
+	ComputedHash string `json:"computedHash"`
+	Valid        bool   `json:"valid"`
+}
+
+// RateWindow holds the transaction times of the recent creates of a device
+type RateWindow struct {
+	Created []string `json:"created"`
+}
+
+// DeviceRegistration lists the attributes permitted for the entries of a device
+type DeviceRegistration struct {
+	Attributes []string `json:"attributes"`
+}
+
+// DeviceMeta is the display metadata of a device, kept apart from its entries
+type DeviceMeta struct {
+	DisplayName string `json:"displayName"`
+	Location    string `json:"location,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// DeletionResult reports the number of entries removed by a bulk deletion, Bookmark is
+// set when entries remain and the deletion has to be continued
+type DeletionResult struct {
+	Deleted  int    `json:"deleted"`
+	Bookmark string `json:"bookmark"`
+}
+
+// IdempotencyRecord is the outcome of an invocation made under an idempotency key, it is
+// returned again when the invocation is retried
+type IdempotencyRecord struct {
+	Function    string `json:"function"`
+	ArgsHash    string `json:"argsHash"` // SHA-256 of the function and its arguments, retries must match it
+	Result      []byte `json:"result"`
+	TxID        string `json:"txId"`
+	TxTimestamp string `json:"txTimestamp"`
+}
+
+// SyncResult reports the number of entries of a device replaced by syncDevice
+type SyncResult struct {
+	Deleted int `json:"deleted"`
+	Created int `json:"created"`
+}
+
+// EntryWithMeta is an entry together with metadata about its key,
+// HistoryCount is only set when it was requested
+type EntryWithMeta struct {
+	Entry        json.RawMessage `json:"entry"`
+	HistoryCount *int            `json:"historyCount,omitempty"` // number of modifications of the key
+}
+
+// EntryProvenance is an entry together with the record of who wrote it and when.
+// TxTimestamp is the time of the creating transaction, LastTxID the last writing one.
+type EntryProvenance struct {
+	Key         string          `json:"key"`
+	CreatedBy   *Identity       `json:"createdBy"`
+	TxTimestamp string          `json:"txTimestamp"`
+	LastTxID    string          `json:"lastTxId"`
+	Version     int             `json:"version"`
+	Entry       json.RawMessage `json:"entry"`
+}
+
+// ValidationResult is returned by the dry run of createEntry when the entry is valid
+type ValidationResult struct {
+	Valid bool `json:"valid"`
+}
+
+// ExistsResult tells whether an entry is stored under a key
+type ExistsResult struct {
+	Exists bool `json:"exists"`
+}
+
+// MigrationResult summarizes a schema migration
+type MigrationResult struct {
+	Scanned  int `json:"scanned"`
+	Migrated int `json:"migrated"`
+}
+
+// ChaincodeInfo describes the deployed chaincode
+type ChaincodeInfo struct {
+	Version         string   `json:"version"`
+	BuildTimestamp  string   `json:"buildTimestamp"`
+	InvokeFunctions []string `json:"invokeFunctions"`
+	QueryFunctions  []string `json:"queryFunctions"`
+}
+
+// SchemaField describes a field of a stored type, Fields lists the fields of nested structs
+type SchemaField struct {
+	Name      string        `json:"name"`
+	JSONName  string        `json:"jsonName"`
+	OmitEmpty bool          `json:"omitEmpty"`
+	Type      string        `json:"type"`
+	Fields    []SchemaField `json:"fields,omitempty"`
+}
+
+// EntrySchema describes the shape of the stored entries
+type EntrySchema struct {
+	Type   string        `json:"type"`
+	Fields []SchemaField `json:"fields"`
+}
+
+// DeviceCount holds the number of entries stored for a device
+type DeviceCount struct {
+	DeviceName string `json:"deviceName"`
+	Count      int    `json:"count"`
+}
+
+// EntryResponse is returned by the functions writing an entry, it pairs the stored entry
+// with the ID of the transaction that wrote it. Unchanged is set when the write would not
+// have changed the entry and was skipped, the entry is then the stored one.
+type EntryResponse struct {
+	TxID      string          `json:"txId"`
+	Entry     json.RawMessage `json:"entry"`
+	Unchanged bool            `json:"unchanged,omitempty"`
+}
+
+// PrivateEntryResponse is returned by createPrivateEntry, it locates the stored entry
+// without repeating its confidential value
+type PrivateEntryResponse struct {
+	TxID       string `json:"txId"`
+	Collection string `json:"collection"`
+	Key        string `json:"key"`
+}
+
+// UpsertResult tells whether an upsert inserted a new entry or updated an existing one
+type UpsertResult struct {
+	Operation string          `json:"operation"` // insert or update
+	Entry     json.RawMessage `json:"entry"`
+}
+
+// operations reported by an upsert
+const (
+	upsertInsert = "insert"
+	upsertUpdate = "update"
+)
+
+// BatchResult summarizes the outcome of a batch creation
+type BatchResult struct {
+	Succeeded int            `json:"succeeded"`
+	Failed    []BatchFailure `json:"failed"`
+}
+
+// BatchUpdateResult summarizes the outcome of a batch update by entry key
+type BatchUpdateResult struct {
+	Updated   []string       `json:"updated"`
+	Unchanged []string       `json:"unchanged"`
+	Failed    []BatchFailure `json:"failed"`
+}
+
+// BatchFailure describes a single entry of a batch that could not be created or updated
+type BatchFailure struct {
+	Timestamp string `json:"timestamp"`
+	Error     string `json:"error"`
+	Code      string `json:"code"`
+}
+
+// ============================================================================================================================
+// Init - reset all the things
+// Init is called during chaincode instantiation to initialize any data.
+// Chaincode upgrade also calls this function to reset or to migrate data.
+// ============================================================================================================================
+func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
+	// the function name of the proposal is not used, instantiation and upgrade always run Init
+	_, args := stub.GetFunctionAndParameters()
+	return peerResponse(t.initialize(stub, args))
+}
+
+// =========================================================================================
+// initialize seeds or migrates the ledger on instantiation and upgrade, see Init
+// =========================================================================================
+func (t *SimpleChaincode) initialize(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//   0 (optional)
+	// "migrate" or "[{entry}, {entry}, ...]"
+	if err := checkArgCount(args, 0, 1); err != nil {
+		return nil, err
+	}
+	if err := initStrictMode(stub); err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return nil, nil
+	}
+	// existing entries are only touched when a migration is explicitly requested
+	if args[0] == "migrate" {
+		return t.migrateEntries(stub)
+	}
+	entries, err := decodeSeed(args[0])
+	if err != nil {
+		return nil, err
+	}
+	return t.seedEntries(stub, entries)
+}
+
+// =========================================================================================
+// initStrictMode turns strict mode on when the chaincode is first instantiated, that is
+// when neither the setting nor any entry is stored yet. An upgrade keeps the setting, and
+// a ledger upgraded from before strict mode existed keeps accepting what it accepted
+// until an admin calls setStrictMode.
+// =========================================================================================
+func initStrictMode(stub shim.ChaincodeStubInterface) error {
+	settingKey, err := stub.CreateCompositeKey(configName, []string{strictModeSetting})
+	if err != nil {
+		return err
+	}
+	settingAsBytes, err := stub.GetState(settingKey)
+	if err != nil {
+		return newChaincodeError(errCodeInternal, "Failed to get the strict mode setting: "+err.Error())
+	}
+	if settingAsBytes != nil {
+		return nil
+	}
+
+	resultsIterator, err := stub.GetStateByRange("", "")
+	if err != nil {
+		return err
+	}
+	defer resultsIterator.Close()
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+		// a range over simple keys may list composite keys on some peers
+		if !isCompositeKey(queryResponse.Key) {
+			return nil
+		}
+	}
+
+	logger.Info("- first instantiation, strict mode enabled")
+	return stub.PutState(settingKey, []byte(strconv.FormatBool(true)))
+}
+
+// ============================================================================================================================
+// invokeInit - Init reached through Invoke, used as reset
+// Init itself only runs on instantiation and upgrade, which the lifecycle policy controls, but
+// any client may invoke. Seeding through Invoke therefore needs the permission to create
+// entries and is rate limited like a batch, migrating the whole ledger needs the admin
+// permission.
+// ============================================================================================================================
+func (t *SimpleChaincode) invokeInit(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//   0 (optional)
+	// "migrate" or "[{entry}, {entry}, ...]"
+	if err := checkArgCount(args, 0, 1); err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return nil, nil
+	}
+	if args[0] == "migrate" {
+		if err := authorizeAdmin(stub); err != nil {
+			return nil, err
+		}
+		return t.migrateEntries(stub)
+	}
+
+	err := authorizeCreator(stub)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := decodeSeed(args[0])
+	if err != nil {
+		return nil, err
+	}
+	err = enforceBatchRateLimit(stub, entries)
+	if err != nil {
+		return nil, err
+	}
+	return t.seedEntries(stub, entries)
+}
+
+// =========================================================================================
+// decodeSeed decodes the JSON array of entries Init seeds the ledger with
+// =========================================================================================
+func decodeSeed(seed string) ([]Entry, error) {
+	var entries []Entry
+	err := json.Unmarshal([]byte(seed), &entries)
+	if err != nil {
+		return nil, newChaincodeError(errCodeBadArgs, "Init argument must be \"migrate\" or a JSON array of entries: "+err.Error())
+	}
+	return entries, nil
+}
+
+// ============================================================================================================================
+// seedEntries creates the given entries, used to bootstrap demo and test networks.
+// The entries are validated like created ones, an invalid entry fails Init before anything
+// is written. Who may instantiate the chaincode is up to the lifecycle policy, the creating
+// organization is therefore not checked here, see invokeInit for the Invoke route.
+// ============================================================================================================================
+func (t *SimpleChaincode) seedEntries(stub shim.ChaincodeStubInterface, entries []Entry) ([]byte, error) {
+	logger.Debug("- start entry seeding")
+
+	var err error
+	seen := make(map[string]bool)
+	for i := range entries {
+		entry := &entries[i]
+		err = validateNewEntry(stub, entry)
+		if err != nil {
+			return nil, err
+		}
+		key := entryKey(entry.DeviceName, entry.Timestamp)
+		if seen[key] {
+			return nil, newDuplicateKeyError(key, "This entry already exists in the seed: "+key)
+		}
+		seen[key] = true
+		err = setProvenance(stub, entry)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for i := range entries {
+		_, err = saveNewEntry(stub, &entries[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	logger.Infof("- end entry seeding: %d entries", len(entries))
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Migrate Entries - rewrite all stored entries in the current schema
+// Fields added to Entry since an entry was written get their defaults, derived fields are
+// recomputed and the indexes are rebuilt. Entries stored under another entry key scheme or
+// under a timestamp that is not normalized to timestampLayout are moved to their entry key. Entries already in the current schema are left untouched.
+// ============================================================================================================================
+func (t *SimpleChaincode) migrateEntries(stub shim.ChaincodeStubInterface) ([]byte, error) {
+	logger.Debug("- start entry migration")
+
+	resultsIterator, err := stub.GetStateByRange("", "")
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	result := MigrationResult{}
+	// writes are not visible to reads within the same transaction, so the keys entries are moved to are tracked here
+	movedTo := make(map[string]bool)
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		if isCompositeKey(queryResponse.Key) {
+			continue
+		}
+		result.Scanned++
+
+		entry := Entry{}
+		err = json.Unmarshal(queryResponse.Value, &entry)
+		if err != nil {
+			return nil, newChaincodeError(errCodeInternal, "Failed to decode entry "+queryResponse.Key+": "+err.Error())
+		}
+		err = applyValueType(&entry)
+		if err != nil {
+			// a stored value not matching its type is left as a plain string
+			entry.ValueType = valueTypeString
+			entry.NumericValue = nil
+		}
+		// timestamps written before keys had a fixed width are normalized, the indexes of the
+		// entry under its former timestamp are dropped
+		if timestamp, err := time.Parse(time.RFC3339Nano, entry.Timestamp); err == nil && normalizeTimestamp(timestamp) != entry.Timestamp {
+			err = removeLegacyEntryIndexes(stub, &entry, timestamp)
+			if err != nil {
+				return nil, err
+			}
+			entry.Timestamp = normalizeTimestamp(timestamp)
+		}
+		// entries written before hashing was introduced get their hash
+		err = sealEntry(&entry)
+		if err != nil {
+			return nil, err
+		}
+
+		// entries written under another key scheme or timestamp format are moved to their entry key
+		// device names containing the separator would let the keys of devices overlap
+		if entryKeyScheme == keySchemeDevice && strings.Contains(entry.DeviceName, entryKeySeparator) {
+			return nil, newChaincodeError(errCodeUnsupported, "Entry "+queryResponse.Key+" cannot be keyed by device, its device name contains "+strconv.Quote(entryKeySeparator)+": "+entry.DeviceName)
+		}
+		key := entryKey(entry.DeviceName, entry.Timestamp)
+		if key != queryResponse.Key {
+			existingAsBytes, err := stub.GetState(key)
+			if err != nil {
+				return nil, newChaincodeError(errCodeInternal, "Failed to get entry: "+err.Error())
+			}
+			if existingAsBytes != nil || movedTo[key] {
+				return nil, newDuplicateKeyError(key, "Cannot move entry "+queryResponse.Key+", this entry already exists: "+key)
+			}
+			err = stub.DelState(queryResponse.Key)
+			if err != nil {
+				return nil, newChaincodeError(errCodeInternal, "Failed to delete entry: "+err.Error())
+			}
+			_, err = putEntry(stub, &entry)
+			if err != nil {
+				return nil, err
+			}
+			movedTo[key] = true
+			result.Migrated++
+			continue
+		}
+
+		entryJSONasBytes, err := marshalEntry(&entry)
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Equal(entryJSONasBytes, queryResponse.Value) {
+			// unchanged entries still get the indexes introduced since they were written
+			err = addEntryIndexes(stub, &entry)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		_, err = putEntry(stub, &entry)
+		if err != nil {
+			return nil, err
+		}
+		result.Migrated++
+	}
+
+	resultJSONasBytes, err := json.Marshal(result)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info("- end entry migration: " + string(resultJSONasBytes))
+	return resultJSONasBytes, nil
+}
+
+// ============================================================================================================================
+// registerFunctions - build the dispatch tables
+// The tables are populated once, on the first Invoke, and are read-only afterwards.
+// ============================================================================================================================
+func (t *SimpleChaincode) registerFunctions() {
+	t.functionsOnce.Do(func() {
+		t.invokeFunctions = map[string]chaincodeFunction{
+			"create":               t.createEntry,
+			"update":               t.updateEntry,
+			"delete":               t.deleteEntry,
+			"createBatch":          t.createEntriesBatch,
+			"upsert":               t.upsertEntry,
+			"softDelete":           t.softDeleteEntry,
+			"deleteByDevice":       t.deleteEntriesByDevice,
+			"registerDevice":       t.registerDevice,
+			"purgeExpired":         t.purgeExpired,
+			"patch":                t.patchEntry,
+			"syncDevice":           t.syncDevice,
+			"addTag":               t.addTag,
+			"removeTag":            t.removeTag,
+			"setDeviceMeta":        t.setDeviceMeta,
+			"resetAll":             t.resetAll,
+			"appendDeviceLog":      t.appendDeviceLog,
+			"createPrivate":        t.createPrivateEntry,
+			"setStrictMode":        t.setStrictMode,
+			"idempotent":           t.invokeIdempotent,
+			"pruneIdempotencyKeys": t.pruneIdempotencyKeys,
+			"updateBatch":          t.updateEntriesBatch,
+		}
+		t.queryFunctions = map[string]chaincodeFunction{
+			"adHocQuery":                  t.adHocQuery,                       //find entries based on an ad hoc rich query
+			"adHocQueryWithPagination":    t.adHocQueryWithPagination,         //find a page of entries based on an ad hoc rich query
+			"history":                     t.getHistoryForEntry,               //find all modifications of an entry
+			"queryByDevice":               t.queryByDevice,                    //find entries for a device name
+			"countByDevice":               t.countEntriesByDevice,             //count entries for a device name
+			"latest":                      t.getLatestEntryForDeviceAttribute, //find the most recent entry of a device attribute
+			"byTimeRange":                 t.getEntriesByTimeRange,            //find entries within a time window
+			"byDeviceAttribute":           t.getTimestampsByDeviceAttribute,   //find entry timestamps for a device and attribute
+			"getAll":                      t.getAllEntries,                    //dump all entries, admin tooling only
+			"queryByAttribute":            t.queryByAttribute,                 //find entries of all devices for an attribute
+			"queryByDeviceAttributeRange": t.queryByDeviceAttributeRange,      //find entries of a device attribute within a time window
+			"info":                        t.getInfo,                          //chaincode version and supported functions
+			"aggregate":                   t.aggregateAttribute,               //min, max and average of a numeric attribute
+			"exists":                      t.existsEntry,                      //whether an entry is stored under a timestamp
+			"getAllPaged":                 t.getAllEntriesPaged,               //all entries one page at a time
+			"listDevices":                 t.listDevices,                      //names of all devices having entries
+			"listAttributes":              t.listAttributesForDevice,          //names of the attributes a device has entries for
+			"exportCSV":                   t.exportCSV,                        //entries of a device within a time window as CSV
+			"getWithMeta":                 t.getEntryWithMeta,                 //an entry, optionally with the length of its history
+			"recent":                      t.recentEntries,                    //newest entries across all devices
+			"validate":                    t.validateEntryArgs,                //dry run of create
+			"queryByDevices":              t.queryByDevices,                   //entries of any of several devices
+			"snapshot":                    t.deviceSnapshot,                   //latest entry of every attribute of a device
+			"queryCompositeIndex":         t.queryCompositeIndex,              //a page of the keys of an entry index
+			"verify":                      t.verifyIntegrity,                  //whether a stored entry matches its hash
+			"queryByTxID":                 t.queryByTxID,                      //entries last written by a transaction
+			"deviceByTimeRange":           t.getDeviceEntriesByTimeRange,      //entries of a device within a time window, device key scheme only
+			"readMany":                    t.readEntries,                      //entries stored under several timestamps
+			"queryByTag":                  t.queryByTag,                       //entries labelled with a tag
+			"getDeviceMeta":               t.getDeviceMeta,                    //display metadata of a device
+			"deviceCounts":                t.deviceCounts,                     //number of entries of every device
+			"byTimeBucket":                t.getDeviceEntriesByTimeBucket,     //entries of a device within a time window, read by time bucket
+			"deltas":                      t.deltaSeries,                      //changes between consecutive numeric readings of an attribute
+			"queryByPattern":              t.queryByValuePattern,              //entries of an attribute whose value matches a regular expression
+			"deviceLog":                   t.getDeviceLog,                     //readings appended to the log of a device
+			"first":                       t.firstEntryForDevice,              //find the oldest entry of a device
+			"readPrivate":                 t.readPrivateEntry,                 //an entry stored in a private data collection
+			"provenance":                  t.getEntryProvenance,               //an entry with who wrote it and when
+			"gaps":                        t.reportingGaps,                    //periods in which a device attribute went without readings
+			"downsample":                  t.downsample,                       //one reading per time bucket of a numeric attribute
+			"exportNDJSON":                t.exportNDJSON,                     //entries of a device within a time window as NDJSON
+			"schema":                      t.describeSchema,                   //field names and types of the stored entries
+			"threshold":                   t.checkThreshold,                   //entries of a device attribute breaching a threshold
+		}
+	})
+}
+
+// ============================================================================================================================
+// Invoke - Entry point for Invocations and Queries
+// Invoke is called per transaction on the chaincode, queries are invocations as well since
+// the peer has no separate entry point for them. Query functions are answered with their
+// QueryResponse envelope, any other function with its payload or an error response whose
+// message is the JSON error.
+// ============================================================================================================================
+func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	function, args := stub.GetFunctionAndParameters()
+
+	t.registerFunctions()
+	if _, ok := t.queryFunctions[function]; ok {
+		return shim.Success(t.query(stub, function, args))
+	}
+	return peerResponse(t.invoke(stub, function, args))
+}
+
+// =========================================================================================
+// peerResponse turns the result of a function into the response sent to the peer
+// =========================================================================================
+func peerResponse(payload []byte, err error) pb.Response {
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(payload)
+}
+
+// =========================================================================================
+// invoke dispatches an invocation to its function, see Invoke
+// =========================================================================================
+func (t *SimpleChaincode) invoke(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+	logger.Debug("invoke is running " + function)
+
+	// every invoke writes, in strict mode nothing that is not valid UTF-8 reaches the state
+	if err := checkStrictArgs(stub, args); err != nil {
+		return nil, err
+	}
+
+	// Handle different functions
+	if function == "init" { //initialize the chaincode state, used as reset
+		return t.invokeInit(stub, args)
+	}
+	t.registerFunctions()
+	if fn, ok := t.invokeFunctions[function]; ok {
+		return fn(stub, args)
+	}
+	logger.Warning("invoke did not find func: " + function)
+
+	return nil, newChaincodeError(errCodeUnknownFunction, "Received unknown function invocation: "+function)
+}
+
+// =========================================================================================
+// query dispatches a query to its function, see Invoke. Every query answers with a
+// QueryResponse envelope, failures included, so clients parse a single shape whatever the
+// function.
+// =========================================================================================
+func (t *SimpleChaincode) query(stub shim.ChaincodeStubInterface, function string, args []string) []byte {
+	logger.Debug("query is running " + function)
+
+	// Handle different functions
+	t.registerFunctions()
+	if fn, ok := t.queryFunctions[function]; ok {
+		payload, err := fn(stub, args)
+		if err != nil {
+			return errorResponse(err)
+		}
+		return successResponse(payload, textQueryFunctions[function])
+	}
+	logger.Warning("query did not find func: " + function)
+
+	return errorResponse(newChaincodeError(errCodeUnknownFunction, "Received unknown function query: "+function))
+}
+
+// =========================================================================================
+// successResponse wraps the result of a query into a response envelope. Text results, such
+// as CSV and NDJSON exports, and results that are not JSON are embedded as a JSON string.
+// =========================================================================================
+func successResponse(payload []byte, text bool) []byte {
+	response := QueryResponse{Status: statusOK, Payload: json.RawMessage("null")}
+	if len(payload) > 0 || text {
+		if json.Valid(payload) && !text {
+			response.Payload = payload
+		} else {
+			response.Payload, _ = json.Marshal(string(payload)) // marshalling a string cannot fail
+		}
+	}
+	responseAsBytes, _ := json.Marshal(response) // the payload is valid JSON
+	return responseAsBytes
+}
+
+// =========================================================================================
+// errorResponse turns the error of a query into a response envelope, the status is derived
+// from the error code. Errors without a code are internal errors.
+// =========================================================================================
+func errorResponse(err error) []byte {
+	response := QueryResponse{Status: statusInternalError, Message: err.Error(), Code: errCodeInternal}
+	var ccErr *chaincodeError
+	if errors.As(err, &ccErr) {
+		response.Message = ccErr.Message
+		response.Code = ccErr.Code
+		if status, ok := errorStatuses[ccErr.Code]; ok {
+			response.Status = status
+		}
+	}
+	responseAsBytes, _ := json.Marshal(response) // marshalling strings cannot fail
+	return responseAsBytes
+}
+
+// ============================================================================================================================
+// Create Entry - create a new entry, store into chaincode state
+// The entry is given either as the positional arguments of entryFromArgs or as a single JSON
+// object of entry fields, see entryFromJSON.
+// ============================================================================================================================
+func (t *SimpleChaincode) createEntry(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debug("- start entry creation")
+
+	err := authorizeCreator(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	// ==== Create Entry object, validate it and save it ====
+	entry, err := entryFromCreateArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	err = validateNewEntry(stub, entry)
+	if err != nil {
+		return nil, err
+	}
+	err = enforceRateLimit(stub, entry.DeviceName, 1)
+	if err != nil {
+		return nil, err
+	}
+	err = setProvenance(stub, entry)
+	if err != nil {
+		return nil, err
+	}
+
+	entryJSONasBytes, err := saveNewEntry(stub, entry)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info("- end entry creation")
+	return json.Marshal(EntryResponse{TxID: stub.GetTxID(), Entry: entryJSONasBytes})
+}
+
+// ============================================================================================================================
+// Create Private Entry - create a new entry in a private data collection
+// The attribute value is read from the transient map under "attributeValue", transient data
+// is not part of the transaction, so the value only reaches the peers of the organizations
+// that are members of the collection. The channel state keeps just a hash of the entry.
+// The timestamp, device name and attribute are ordinary arguments and are visible to all.
+// Private entries are neither indexed nor returned by the queries on channel state.
+// ============================================================================================================================
+func (t *SimpleChaincode) createPrivateEntry(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//   0             1            2             3            4 (optional)
+	// "collection", "timestamp", "deviceName", "attribute", "valueType"
+	if err := checkArgCount(args, 4, 5); err != nil {
+		return nil, err
+	}
+	logger.Debug("- start private entry creation")
+
+	err := authorizeCreator(stub)
+	if err != nil {
+		return nil, err
+	}
+	if len(args[0]) <= 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "1st argument must be a non-empty string")
+	}
+	collection := args[0]
+
+	transient, err := stub.GetTransient()
+	if err != nil {
+		return nil, newChaincodeError(errCodeInternal, "Failed to get the transient data: "+err.Error())
+	}
+	attributeValue, ok := transient[privateValueTransientKey]
+	if !ok {
+		return nil, newChaincodeError(errCodeBadArgs, "the attribute value must be passed in the transient map under "+strconv.Quote(privateValueTransientKey))
+	}
+	// the value bypasses the arguments, Invoke cannot check it like the other arguments
+	strict, err := isStrictMode(stub)
+	if err != nil {
+		return nil, err
+	}
+	if strict && !utf8.Valid(attributeValue) {
+		return nil, newValidationError("attributeValue", "is not valid UTF-8")
+	}
+
+	// ==== Create Entry object, validate it and save it ====
+	entryArgs := append([]string{args[1], args[2], args[3], string(attributeValue)}, args[4:]...)
+	entry, err := entryFromArgs(entryArgs)
+	if err != nil {
+		return nil, err
+	}
+	err = validateNewEntry(stub, entry)
+	if err != nil {
+		return nil, err
+	}
+	err = setProvenance(stub, entry)
+	if err != nil {
+		return nil, err
+	}
+
+	key := entryKey(entry.DeviceName, entry.Timestamp)
+	entryAsBytes, err := stub.GetPrivateData(collection, key)
+	if err != nil {
+		return nil, newChaincodeError(errCodeInternal, "Failed to get private entry: "+err.Error())
+	} else if entryAsBytes != nil {
+		return nil, newDuplicateKeyError(key, "This private entry already exists: "+key)
+	}
+
+	entry.LastTxID = stub.GetTxID()
+	err = sealEntry(entry)
+	if err != nil {
+		return nil, err
+	}
+	entryJSONasBytes, err := marshalEntry(entry)
+	if err != nil {
+		return nil, err
+	}
+	err = stub.PutPrivateData(collection, key, entryJSONasBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info("- end private entry creation")
+	return json.Marshal(PrivateEntryResponse{stub.GetTxID(), collection, key})
+}
+
+// ============================================================================================================================
+// Validate Entry - dry run of createEntry
+// Runs every check createEntry performs, on the same arguments, without writing anything.
+// Returns {"valid":true} or the error createEntry would fail with.
+// ============================================================================================================================
+func (t *SimpleChaincode) validateEntryArgs(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	err := authorizeCreator(stub)
+	if err != nil {
+		return nil, err
+	}
+	// Invoke checks the arguments of create before they reach it, queries do not
+	err = checkStrictArgs(stub, args)
+	if err != nil {
+		return nil, err
+	}
+
+	entry, err := entryFromCreateArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	err = validateNewEntry(stub, entry)
+	if err != nil {
+		return nil, err
+	}
+
+	//check if entry already exists
+	key := entryKey(entry.DeviceName, entry.Timestamp)
+	entryAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, newChaincodeError(errCodeInternal, "Failed to get entry: "+err.Error())
+	} else if entryAsBytes != nil {
+		return nil, newDuplicateKeyError(key, "This entry already exists: "+key)
+	}
+
+	return json.Marshal(ValidationResult{true})
+}
+
+// ============================================================================================================================
+// Upsert Entry - create an entry or overwrite it if it already exists
+// Takes the same arguments as createEntry, retrying an upsert is therefore idempotent.
+// ============================================================================================================================
+func (t *SimpleChaincode) upsertEntry(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debug("- start entry upsert")
+
+	err := authorizeCreator(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	entry, err := entryFromCreateArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	err = validateNewEntry(stub, entry)
+	if err != nil {
+		return nil, err
+	}
+	err = enforceRateLimit(stub, entry.DeviceName, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	//check if entry already exists
+	entryAsBytes, err := stub.GetState(entryKey(entry.DeviceName, entry.Timestamp))
+	if err != nil {
+		return nil, newChaincodeError(errCodeInternal, "Failed to get entry: "+err.Error())
+	}
+	operation := upsertInsert
+	entry.Version = 1
+	if entryAsBytes != nil {
+		operation = upsertUpdate
+		// the overwritten entry may have been indexed under a different device or attribute
+		existing := Entry{}
+		err = json.Unmarshal(entryAsBytes, &existing)
+		if err != nil {
+			return nil, err
+		}
+		entry.Version = existing.Version + 1
+		err = removeEntryIndexes(stub, &existing, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = setProvenance(stub, entry)
+	if err != nil {
+		return nil, err
+	}
+
+	entryJSONasBytes, err := putEntry(stub, entry)
+	if err != nil {
+		return nil, err
+	}
+
+	resultJSONasBytes, err := json.Marshal(UpsertResult{operation, entryJSONasBytes})
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info("- end entry upsert: " + operation)
+	return resultJSONasBytes, nil
+}
+
+// ============================================================================================================================
+// Register Device - set the attributes that entries of a device may have
+// Once a device is registered, entries with any other attribute are rejected. Registering
+// a device again replaces its permitted attributes.
+// ============================================================================================================================
+func (t *SimpleChaincode) registerDevice(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//   0             1
+	// "deviceName", "[\"attribute\", \"attribute\", ...]"
+	if err := checkArgCount(args, 2, 2); err != nil {
+		return nil, err
+	}
+
+	//input sanitation
+	logger.Debug("- start device registration")
+	if len(args[0]) <= 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "1st argument must be a non-empty string")
+	}
+	if len(args[1]) <= 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "2nd argument must be a non-empty string")
+	}
+	deviceName := args[0]
+	if !deviceNamePattern.MatchString(deviceName) {
+		return nil, newChaincodeError(errCodeBadArgs, "deviceName may only contain letters, digits, dashes and underscores: "+strconv.Quote(deviceName))
+	}
+	if len(deviceName) > maxNameLength {
+		return nil, newChaincodeError(errCodeBadArgs, fmt.Sprintf("deviceName must be at most %d bytes long", maxNameLength))
+	}
+
+	err := authorizeCreator(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	registration := DeviceRegistration{}
+	err = json.Unmarshal([]byte(args[1]), &registration.Attributes)
+	if err != nil {
+		return nil, newChaincodeError(errCodeBadArgs, "2nd argument must be a JSON array of attribute names: "+err.Error())
+	}
+	if len(registration.Attributes) == 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "at least one attribute must be registered")
+	}
+	for _, attribute := range registration.Attributes {
+		if len(attribute) <= 0 {
+			return nil, newChaincodeError(errCodeBadArgs, "attribute must be a non-empty string")
+		}
+		if len(attribute) > maxNameLength {
+			return nil, newChaincodeError(errCodeBadArgs, fmt.Sprintf("attribute must be at most %d bytes long", maxNameLength))
+		}
+	}
+
+	registrationJSONasBytes, err := json.Marshal(registration)
+	if err != nil {
+		return nil, err
+	}
+	registryKey, err := stub.CreateCompositeKey(deviceRegistryName, []string{deviceName})
+	if err != nil {
+		return nil, err
+	}
+	err = stub.PutState(registryKey, registrationJSONasBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info("- end device registration: " + deviceName)
+	return registrationJSONasBytes, nil
+}
+
+// ============================================================================================================================
+// Append Device Log - append a reading to the log of its device
+// The log is a single JSON array per device, in the order the readings were appended,
+// for clients that want one growing document rather than keyed entries. Every append
+// rewrites the whole log, and concurrent appends for a device conflict, so the log is
+// capped at maxDeviceLogLength readings. Readings are validated like entries but are
+// not indexed and do not take an entry key.
+// ============================================================================================================================
+func (t *SimpleChaincode) appendDeviceLog(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debug("- start device log append")
+
+	err := authorizeCreator(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	//   0       	1       		2    		 3                 4 (optional)
+	// "timestamp", "deviceName", "attribute", "attributeValue", "valueType"
+	entry, err := entryFromArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	strict, err := isStrictMode(stub)
+	if err != nil {
+		return nil, err
+	}
+	err = validateEntry(entry, strict)
+	if err != nil {
+		return nil, err
+	}
+	err = enforceRateLimit(stub, entry.DeviceName, 1)
+	if err != nil {
+		return nil, err
+	}
+	err = setProvenance(stub, entry)
+	if err != nil {
+		return nil, err
+	}
+
+	logKey, err := stub.CreateCompositeKey(deviceLogName, []string{entry.DeviceName})
+	if err != nil {
+		return nil, err
+	}
+	deviceLog, err := readDeviceLog(stub, logKey)
+	if err != nil {
+		return nil, err
+	}
+	deviceLog = append(deviceLog, *entry)
+	if len(deviceLog) > maxDeviceLogLength {
+		deviceLog = deviceLog[len(deviceLog)-maxDeviceLogLength:]
+	}
+
+	logJSONasBytes, err := json.Marshal(deviceLog)
+	if err != nil {
+		return nil, err
+	}
+	err = stub.PutState(logKey, logJSONasBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info("- end device log append: " + entry.DeviceName)
+	return json.Marshal(entry)
+}
+
+// =========================================================================================
+// readDeviceLog returns the readings stored in the log under a key, an empty log when
+// nothing was appended yet
+// =========================================================================================
+func readDeviceLog(stub shim.ChaincodeStubInterface, logKey string) ([]Entry, error) {
+	logAsBytes, err := stub.GetState(logKey)
+	if err != nil {
+		return nil, newChaincodeError(errCodeInternal, "Failed to get device log: "+err.Error())
+	}
+	deviceLog := []Entry{}
+	if logAsBytes == nil {
+		return deviceLog, nil
+	}
+	err = json.Unmarshal(logAsBytes, &deviceLog)
+	if err != nil {
+		return nil, newChaincodeError(errCodeInternal, "Failed to decode device log: "+err.Error())
+	}
+	return deviceLog, nil
+}
+
+// ============================================================================================================================
+// Set Device Meta - store the display name, location and description of a device
+// The metadata is stored apart from the entries, which stay lean. Setting it again replaces it.
+// ============================================================================================================================
+func (t *SimpleChaincode) setDeviceMeta(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//   0             1
+	// "deviceName", "{\"displayName\": ..., \"location\": ..., \"description\": ...}"
+	if err := checkArgCount(args, 2, 2); err != nil {
+		return nil, err
+	}
+
+	//input sanitation
+	logger.Debug("- start device meta update")
+	if len(args[0]) <= 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "1st argument must be a non-empty string")
+	}
+	deviceName := args[0]
+	if !deviceNamePattern.MatchString(deviceName) {
+		return nil, newChaincodeError(errCodeBadArgs, "deviceName may only contain letters, digits, dashes and underscores: "+strconv.Quote(deviceName))
+	}
+	if len(deviceName) > maxNameLength {
+		return nil, newChaincodeError(errCodeBadArgs, fmt.Sprintf("deviceName must be at most %d bytes long", maxNameLength))
+	}
+
+	err := authorizeCreator(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := DeviceMeta{}
+	err = json.Unmarshal([]byte(args[1]), &meta)
+	if err != nil {
+		return nil, newChaincodeError(errCodeBadArgs, "2nd argument must be a JSON object of device metadata: "+err.Error())
+	}
+	if len(meta.DisplayName) <= 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "displayName must be a non-empty string")
+	}
+	if len(meta.DisplayName) > maxNameLength || len(meta.Location) > maxNameLength {
+		return nil, newChaincodeError(errCodeBadArgs, fmt.Sprintf("displayName and location must be at most %d bytes long", maxNameLength))
+	}
+	if len(meta.Description) > maxValueLength {
+		return nil, newChaincodeError(errCodeBadArgs, fmt.Sprintf("description must be at most %d bytes long", maxValueLength))
+	}
+
+	metaJSONasBytes, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	metaKey, err := stub.CreateCompositeKey(deviceMetaName, []string{deviceName})
+	if err != nil {
+		return nil, err
+	}
+	err = stub.PutState(metaKey, metaJSONasBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info("- end device meta update: " + deviceName)
+	return metaJSONasBytes, nil
+}
+
+// =========================================================================================
+// authorizeCreator checks that the invoking client belongs to an organization that is
+// allowed to create entries. Every function writing entries checks it, changing or deleting
+// an entry needs the same permission as creating it.
+// =========================================================================================
+func authorizeCreator(stub shim.ChaincodeStubInterface) error {
+	mspID, err := cid.GetMSPID(stub)
+	if err != nil {
+		return newChaincodeError(errCodeInternal, "Failed to get the identity of the client: "+err.Error())
+	}
+	for _, authorizedMSPID := range authorizedCreatorMSPs {
+		if mspID == authorizedMSPID {
+			return nil
+		}
+	}
+	logger.Warning("Client is not allowed to write entries: " + mspID)
+	return newChaincodeError(errCodeForbidden, "Organization is not allowed to write entries: "+mspID)
+}
+
+// =========================================================================================
+// authorizeAdmin checks that the invoking client belongs to an organization that is
+// allowed to run admin functions
+// =========================================================================================
+func authorizeAdmin(stub shim.ChaincodeStubInterface) error {
+	mspID, err := cid.GetMSPID(stub)
+	if err != nil {
+		return newChaincodeError(errCodeInternal, "Failed to get the identity of the client: "+err.Error())
+	}
+	for _, authorizedMSPID := range authorizedAdminMSPs {
+		if mspID == authorizedMSPID {
+			return nil
+		}
+	}
+	logger.Warning("Client is not allowed to run admin functions: " + mspID)
+	return newChaincodeError(errCodeForbidden, "Organization is not allowed to run admin functions: "+mspID)
+}
+
+// =========================================================================================
+// setProvenance records on an entry who submitted it and the time of the transaction.
+// Both values come from the transaction proposal and cannot be chosen by the client.
+// =========================================================================================
+func setProvenance(stub shim.ChaincodeStubInterface, entry *Entry) error {
+	createdBy, err := getCreatorIdentity(stub)
+	if err != nil {
+		return err
+	}
+	txTimestamp, err := getTxTimestampString(stub)
+	if err != nil {
+		return err
+	}
+	entry.CreatedBy = createdBy
+	entry.TxTimestamp = txTimestamp
+	return nil
+}
+
+// =========================================================================================
+// getTxTimestampString returns the timestamp of the transaction as RFC3339 in UTC
+// =========================================================================================
+func getTxTimestampString(stub shim.ChaincodeStubInterface) (string, error) {
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return "", newChaincodeError(errCodeInternal, "Failed to get the transaction timestamp: "+err.Error())
+	}
+	return normalizeTimestamp(time.Unix(txTimestamp.Seconds, int64(txTimestamp.Nanos))), nil
+}
+
+// =========================================================================================
+// getCreatorIdentity decodes the serialized identity of the invoking client into its
+// MSP ID and the common name of its certificate subject
+// =========================================================================================
+func getCreatorIdentity(stub shim.ChaincodeStubInterface) (*Identity, error) {
+	mspID, err := cid.GetMSPID(stub)
+	if err != nil {
+		return nil, newChaincodeError(errCodeInternal, "Failed to get the identity of the client: "+err.Error())
+	}
+	cert, err := cid.GetX509Certificate(stub)
+	if err != nil {
+		return nil, newChaincodeError(errCodeInternal, "Failed to get the certificate of the client: "+err.Error())
+	}
+	return &Identity{mspID, cert.Subject.CommonName}, nil
+}
+
+// =========================================================================================
+// entryFromArgs builds an entry from the positional arguments of createEntry and upsertEntry
+// =========================================================================================
+func entryFromArgs(args []string) (*Entry, error) {
+
+	//   0       	1       		2    		 3                 4 (optional)
+	// "timestamp", "deviceName", "attribute", "attributeValue", "valueType"
+	if err := checkArgCount(args, 4, 5); err != nil {
+		return nil, err
+	}
+
+	//input sanitation
+	if len(args[0]) <= 0 {
+		return nil, newValidationError("timestamp", "must be a non-empty string")
+	}
+	if len(args[1]) <= 0 {
+		return nil, newValidationError("deviceName", "must be a non-empty string")
+	}
+	if len(args[2]) <= 0 {
+		return nil, newValidationError("attribute", "must be a non-empty string")
+	}
+	if len(args[3]) <= 0 && !valuelessAttributes[args[2]] {
+		return nil, newValidationError("attributeValue", "must be a non-empty string")
+	}
+	timestamp := args[0]
+	deviceName := args[1]
+	attribute := args[2]
+	attributeValue := args[3]
+	valueType := valueTypeString
+	if len(args) == 5 {
+		valueType = args[4]
+	}
+
+	return &Entry{Timestamp: timestamp, DeviceName: deviceName, Attribute: attribute, AttributeValue: encodeAttributeValue(attributeValue, valueType), ValueType: valueType}, nil
+}
+
+// =========================================================================================
+// entryFromCreateArgs builds an entry from the arguments of createEntry, validateEntryArgs
+// and upsertEntry, either a single JSON object of entry fields or the positional arguments
+// =========================================================================================
+func entryFromCreateArgs(args []string) (*Entry, error) {
+	if isJSONObjectArg(args) {
+		return entryFromJSON(args[0])
+	}
+	return entryFromArgs(args)
+}
+
+// =========================================================================================
+// isJSONObjectArg tells whether the arguments are a single JSON object rather than
+// positional arguments
+// =========================================================================================
+func isJSONObjectArg(args []string) bool {
+	if len(args) != 1 {
+		return false
+	}
+	var object map[string]json.RawMessage
+	return json.Unmarshal([]byte(args[0]), &object) == nil && object != nil
+}
+
+// =========================================================================================
+// entryFromJSON builds an entry from a JSON object of the fields the positional arguments
+// of createEntry carry, e.g. {"timestamp": "...", "deviceName": "...", "attribute": "...",
+// "attributeValue": "...", "valueType": "number"}. The attribute value is taken as stored,
+// a JSON string unless the value type is json. The other fields are maintained by the
+// chaincode and are rejected.
+// =========================================================================================
+func entryFromJSON(arg string) (*Entry, error) {
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal([]byte(arg), &fields)
+	if err != nil || fields == nil {
+		return nil, newChaincodeError(errCodeBadArgs, "1st argument must be a JSON object of entry fields")
+	}
+	for field := range fields {
+		if !entryArgFields[field] {
+			return nil, newValidationError(field, "cannot be set on creation")
+		}
+	}
+
+	entry := &Entry{}
+	err = json.Unmarshal([]byte(arg), entry)
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		return nil, newValidationError(typeErr.Field, "must be of type "+typeErr.Type.String()+", not a JSON "+typeErr.Value)
+	} else if err != nil {
+		return nil, newChaincodeError(errCodeBadArgs, "1st argument holds a field of the wrong type: "+err.Error())
+	}
+	return entry, nil
+}
+
+// =========================================================================================
+// encodeAttributeValue turns an attribute value argument into its stored JSON form.
+// Values of the json value type are taken as JSON as they are, to be validated with the
+// entry, any other value is a plain string.
+// =========================================================================================
+func encodeAttributeValue(attributeValue string, valueType string) json.RawMessage {
+	if valueType == valueTypeJSON {
+		return json.RawMessage(attributeValue)
+	}
+	attributeValueAsBytes, _ := json.Marshal(attributeValue) // marshalling a string cannot fail
+	return attributeValueAsBytes
+}
+
+// =========================================================================================
+// stringValue returns the attribute value of an entry as a string, ok is false when the
+// value is not a JSON string
+// =========================================================================================
+func stringValue(entry *Entry) (string, bool) {
+	var value string
+	if json.Unmarshal(entry.AttributeValue, &value) != nil {
+		return "", false
+	}
+	return value, true
+}
+
+// ============================================================================================================================
+// Create Entries Batch - create many entries in a single invocation
+// The first argument is a JSON array of entries. Every entry is validated and saved on its own,
+// entries that fail are skipped and reported back, all other entries are still created.
+// In strict mode the batch is all-or-nothing instead: the first invalid or duplicate entry
+// fails the invocation, which aborts the transaction, and no entry is written.
+// ============================================================================================================================
+func (t *SimpleChaincode) createEntriesBatch(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var err error
+
+	//   0                          1 (optional)
+	// "[{entry}, {entry}, ...]", "strict"
+	if err := checkArgCount(args, 1, 2); err != nil {
+		return nil, err
+	}
+
+	//input sanitation
+	logger.Debug("- start batch entry creation")
+	if len(args[0]) <= 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "1st argument must be a non-empty string")
+	}
+	strict := false
+	if len(args) == 2 {
+		strict, err = strconv.ParseBool(args[1])
+		if err != nil {
+			return nil, newChaincodeError(errCodeBadArgs, "strict must be true or false: "+args[1])
+		}
+	}
+
+	err = authorizeCreator(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []Entry
+	err = json.Unmarshal([]byte(args[0]), &entries)
+	if err != nil {
+		return nil, newChaincodeError(errCodeBadArgs, "1st argument must be a JSON array of entries: "+err.Error())
+	}
+	err = enforceBatchRateLimit(stub, entries)
+	if err != nil {
+		return nil, err
+	}
+	if strict {
+		return createEntriesStrict(stub, entries)
+	}
+
+	result := BatchResult{Failed: []BatchFailure{}}
+	// writes are not visible to reads within the same transaction, so duplicates inside the batch are tracked here
+	seen := make(map[string]bool)
+	for i := range entries {
+		entry := &entries[i]
+		err = validateNewEntry(stub, entry)
+		key := entryKey(entry.DeviceName, entry.Timestamp)
+		if err == nil && seen[key] {
+			err = newDuplicateKeyError(key, "This entry already exists in the batch: "+key)
+		}
+		if err == nil {
+			err = setProvenance(stub, entry)
+		}
+		if err == nil {
+			_, err = saveNewEntry(stub, entry)
+		}
+		if err != nil {
+			logger.Warning("- batch entry failed: " + err.Error())
+			failure := BatchFailure{entry.Timestamp, err.Error(), errCodeInternal}
+			var ccErr *chaincodeError
+			if errors.As(err, &ccErr) {
+				failure.Error = ccErr.Message
+				failure.Code = ccErr.Code
+			}
+			result.Failed = append(result.Failed, failure)
+			continue
+		}
+		seen[key] = true
+		result.Succeeded++
+	}
+
+	resultJSONasBytes, err := json.Marshal(result)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info("- end batch entry creation")
+	return resultJSONasBytes, nil
+}
+
+// =========================================================================================
+// createEntriesStrict creates the entries of a strict batch. Every entry is checked before
+// the first one is written, so an invalid batch fails without writing anything.
+// =========================================================================================
+func createEntriesStrict(stub shim.ChaincodeStubInterface, entries []Entry) ([]byte, error) {
+	// writes are not visible to reads within the same transaction, so duplicates inside the batch are tracked here
+	seen := make(map[string]bool)
+	for i := range entries {
+		entry := &entries[i]
+		err := validateNewEntry(stub, entry)
+		key := entryKey(entry.DeviceName, entry.Timestamp)
+		if err == nil && seen[key] {
+			err = newDuplicateKeyError(key, "This entry already exists in the batch: "+key)
+		}
+		if err == nil {
+			var entryAsBytes []byte
+			entryAsBytes, err = stub.GetState(key)
+			if err != nil {
+				err = newChaincodeError(errCodeInternal, "Failed to get entry: "+err.Error())
+			} else if entryAsBytes != nil {
+				err = newDuplicateKeyError(key, "This entry already exists: "+key)
+			}
+		}
+		if err == nil {
+			err = setProvenance(stub, entry)
+		}
+		if err != nil {
+			logger.Warningf("- strict batch failed at entry %d: %s", i, err.Error())
+			var ccErr *chaincodeError
+			if errors.As(err, &ccErr) {
+				return nil, &chaincodeError{Message: fmt.Sprintf("batch entry %d: %s", i, ccErr.Message), Code: ccErr.Code, cause: ccErr.cause}
+			}
+			return nil, err
+		}
+		seen[key] = true
+	}
+
+	for i := range entries {
+		_, err := saveNewEntry(stub, &entries[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	resultJSONasBytes, err := json.Marshal(BatchResult{Succeeded: len(entries), Failed: []BatchFailure{}})
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info("- end strict batch entry creation")
+	return resultJSONasBytes, nil
+}
+
+// =========================================================================================
+// validateEntry checks the fields of an entry before it is written to state,
+// the timestamp is normalized to UTC. The device name pattern and the length limits are
+// only checked in strict mode, entryKeySeparator is rejected in device names with
+// keySchemeDevice in every mode.
+// =========================================================================================
+func validateEntry(entry *Entry, strict bool) error {
+	if len(entry.Timestamp) <= 0 {
+		return newValidationError("timestamp", "must be a non-empty string")
+	}
+	if len(entry.DeviceName) <= 0 {
+		return newValidationError("deviceName", "must be a non-empty string")
+	}
+	if len(entry.Attribute) <= 0 {
+		return newValidationError("attribute", "must be a non-empty string")
+	}
+	if len(entry.AttributeValue) <= 0 {
+		if !valuelessAttributes[entry.Attribute] {
+			return newValidationError("attributeValue", "must not be empty")
+		}
+		entry.AttributeValue = encodeAttributeValue("", valueTypeString)
+	}
+	// the null character delimits the parts of composite keys, a device name containing it
+	// would let one device's index entries collide with another's
+	if strings.Contains(entry.DeviceName, compositeKeyNamespace) {
+		return newValidationError("deviceName", "must not contain the null character")
+	}
+	if entryKeyScheme == keySchemeDevice && strings.Contains(entry.DeviceName, entryKeySeparator) {
+		return newValidationError("deviceName", "must not contain "+strconv.Quote(entryKeySeparator)+" with the device key scheme")
+	}
+	if strict {
+		if !deviceNamePattern.MatchString(entry.DeviceName) {
+			return newValidationError("deviceName", "may only contain letters, digits, dashes and underscores: "+strconv.Quote(entry.DeviceName))
+		}
+		if len(entry.DeviceName) > maxNameLength {
+			return newValidationError("deviceName", fmt.Sprintf("must be at most %d bytes long", maxNameLength))
+		}
+		if len(entry.Attribute) > maxNameLength {
+			return newValidationError("attribute", fmt.Sprintf("must be at most %d bytes long", maxNameLength))
+		}
+		if len(entry.AttributeValue) > maxValueLength {
+			return newValidationError("attributeValue", fmt.Sprintf("must be at most %d bytes long", maxValueLength))
+		}
+	}
+	err := checkReservedKey(entry.Timestamp)
+	if err != nil {
+		return err
+	}
+	// timestamp is used as the key, it has to be a valid RFC3339 time in every mode: the key
+	// orders the entries and time window queries compare it, a key that is not a time would
+	// silently fall out of every window. Keys are normalized to
+	// the fixed width timestampLayout, so that they sort chronologically. Fractional seconds are
+	// kept in the key, several readings of a device within a second therefore get distinct keys
+	// as long as the gateway sends sub-second precision.
+	timestamp, err := time.Parse(time.RFC3339Nano, entry.Timestamp)
+	if err != nil {
+		return newValidationError("timestamp", "must be a RFC3339Nano timestamp: "+err.Error())
+	}
+	entry.Timestamp = normalizeTimestamp(timestamp)
+	return applyValueType(entry)
+}
+
+// =========================================================================================
+// normalizeTimestamp formats a time as the canonical key of an entry, timestampLayout in
+// UTC. Equivalent instants written with different offsets, such as 12:00:00+02:00 and
+// 10:00:00Z, therefore map to the same key.
+// =========================================================================================
+func normalizeTimestamp(timestamp time.Time) string {
+	return timestamp.UTC().Format(timestampLayout)
+}
+
+// =========================================================================================
+// entryKeyArg turns the entry key argument of a function reading or writing a single entry
+// into the stored key, the timestamp is normalized so that any RFC3339 form of it, such as
+// 2017-06-01T10:00:00Z, finds the entry. Arguments without a valid timestamp are returned
+// as they are.
+// =========================================================================================
+func entryKeyArg(key string) string {
+	prefix, timestamp := "", key
+	if entryKeyScheme == keySchemeDevice {
+		if i := strings.LastIndex(key, entryKeySeparator); i >= 0 {
+			prefix, timestamp = key[:i+len(entryKeySeparator)], key[i+len(entryKeySeparator):]
+		}
+	}
+	parsed, err := time.Parse(time.RFC3339Nano, timestamp)
+	if err != nil {
+		return key
+	}
+	return prefix + normalizeTimestamp(parsed)
+}
+
+// =========================================================================================
+// entryKey returns the state key of the entry of a device at a timestamp under entryKeyScheme
+// =========================================================================================
+func entryKey(deviceName string, timestamp string) string {
+	if entryKeyScheme == keySchemeDevice {
+		return deviceName + entryKeySeparator + timestamp
+	}
+	return timestamp
+}
+
+// =========================================================================================
+// checkKeyScheme fails when the entries are not keyed by the given scheme,
+// operation names the function depending on it
+// =========================================================================================
+func checkKeyScheme(scheme string, operation string) error {
+	if entryKeyScheme != scheme {
+		return newChaincodeError(errCodeUnsupported, operation+" needs "+scheme+" keys, entries are keyed by "+entryKeyScheme)
+	}
+	return nil
+}
+
+// =========================================================================================
+// checkReservedKey rejects timestamps in the namespaces reserved for indexes and metadata.
+// With keySchemeDevice the key starts with the device name instead, the prefixes apply to the
+// timestamp part of the key only: internal keys are composite keys, so a device name cannot
+// collide with them unless it holds the null character, which validateEntry rejects.
+// =========================================================================================
+func checkReservedKey(timestamp string) error {
+	for _, prefix := range reservedKeyPrefixes {
+		if strings.HasPrefix(timestamp, prefix) {
+			return newValidationError("timestamp", "must not start with the reserved prefix "+strconv.Quote(prefix))
+		}
+	}
+	return nil
+}
+
+// =========================================================================================
+// enforceRateLimit records that count entries of a device are created by the transaction
+// and rejects them when the device would exceed rateLimitEntries entries within the sliding
+// rateLimitWindow. Times are transaction timestamps, so every endorser decides alike.
+// Every create of a device writes its rate window key, concurrent creates for the same
+// device in one block therefore conflict and only the first one commits.
+// =========================================================================================
+func enforceRateLimit(stub shim.ChaincodeStubInterface, deviceName string, count int) error {
+	if rateLimitEntries <= 0 {
+		return nil
+	}
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return newChaincodeError(errCodeInternal, "Failed to get the transaction timestamp: "+err.Error())
+	}
+	txTime := time.Unix(txTimestamp.Seconds, int64(txTimestamp.Nanos)).UTC()
+
+	rateKey, err := stub.CreateCompositeKey(deviceRateName, []string{deviceName})
+	if err != nil {
+		return err
+	}
+	windowAsBytes, err := stub.GetState(rateKey)
+	if err != nil {
+		return newChaincodeError(errCodeInternal, "Failed to get the rate window: "+err.Error())
+	}
+	window := RateWindow{}
+	if windowAsBytes != nil {
+		err = json.Unmarshal(windowAsBytes, &window)
+		if err != nil {
+			return newChaincodeError(errCodeInternal, "Failed to decode the rate window: "+err.Error())
+		}
+	}
+
+	// only the creates within the window count, older ones are dropped
+	recent := []string{}
+	for _, created := range window.Created {
+		createdTime, err := time.Parse(time.RFC3339Nano, created)
+		if err == nil && txTime.Sub(createdTime) < rateLimitWindow {
+			recent = append(recent, created)
+		}
+	}
+	if len(recent)+count > rateLimitEntries {
+		logger.Warning("Rate limit exceeded by device: " + deviceName)
+		return newChaincodeError(errCodeRateLimit, fmt.Sprintf("rate limit exceeded, device %s may create at most %d entries per %s", deviceName, rateLimitEntries, rateLimitWindow))
+	}
+	for i := 0; i < count; i++ {
+		recent = append(recent, normalizeTimestamp(txTime))
+	}
+
+	windowAsBytes, err = json.Marshal(RateWindow{recent})
+	if err != nil {
+		return err
+	}
+	return stub.PutState(rateKey, windowAsBytes)
+}
+
+// =========================================================================================
+// enforceBatchRateLimit applies the rate limit to every device of a batch at once, writes
+// are not visible to reads in the same transaction so a device is only checked once
+// =========================================================================================
+func enforceBatchRateLimit(stub shim.ChaincodeStubInterface, entries []Entry) error {
+	counts := make(map[string]int)
+	for i := range entries {
+		counts[entries[i].DeviceName]++
+	}
+	// devices are checked in a fixed order so that every endorser fails on the same device
+	deviceNames := make([]string, 0, len(counts))
+	for deviceName := range counts {
+		deviceNames = append(deviceNames, deviceName)
+	}
+	sort.Strings(deviceNames)
+	for _, deviceName := range deviceNames {
+		err := enforceRateLimit(stub, deviceName, counts[deviceName])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// =========================================================================================
+// validateNewEntry checks an entry about to be created, on top of its fields the checks
+// against the ledger are made: the time of the transaction and the device registry
+// =========================================================================================
+func validateNewEntry(stub shim.ChaincodeStubInterface, entry *Entry) error {
+	strict, err := isStrictMode(stub)
+	if err != nil {
+		return err
+	}
+	err = validateEntry(entry, strict)
+	if err != nil {
+		return err
+	}
+	if strict {
+		err = checkFutureSkew(stub, entry)
+		if err != nil {
+			return err
+		}
+	}
+	return checkRegisteredAttribute(stub, entry)
+}
+
+// =========================================================================================
+// isStrictMode tells whether the optional validations are enabled: UTF-8 arguments, the
+// device name pattern, field length limits and the future skew of timestamps. Init turns
+// strict mode on when the chaincode is first instantiated, admins switch it with
+// setStrictMode. Ledgers without the setting predate strict mode and are not strict.
+// =========================================================================================
+func isStrictMode(stub shim.ChaincodeStubInterface) (bool, error) {
+	settingKey, err := stub.CreateCompositeKey(configName, []string{strictModeSetting})
+	if err != nil {
+		return false, err
+	}
+	settingAsBytes, err := stub.GetState(settingKey)
+	if err != nil {
+		return false, newChaincodeError(errCodeInternal, "Failed to get the strict mode setting: "+err.Error())
+	}
+	if settingAsBytes == nil {
+		return false, nil
+	}
+	strict, err := strconv.ParseBool(string(settingAsBytes))
+	if err != nil {
+		return false, newChaincodeError(errCodeInternal, "Failed to decode the strict mode setting: "+err.Error())
+	}
+	return strict, nil
+}
+
+// =========================================================================================
+// checkRegisteredAttribute rejects entries whose attribute is not among the permitted
+// attributes of their device. Devices without a registration accept any attribute.
+// =========================================================================================
+func checkRegisteredAttribute(stub shim.ChaincodeStubInterface, entry *Entry) error {
+	registration, err := getDeviceRegistration(stub, entry.DeviceName)
+	if err != nil {
+		return err
+	}
+	if registration == nil {
+		return nil
+	}
+	for _, attribute := range registration.Attributes {
+		if attribute == entry.Attribute {
+			return nil
+		}
+	}
+	return newValidationError("attribute", strconv.Quote(entry.Attribute)+" is not registered for device "+entry.DeviceName+
+		", permitted attributes are "+strings.Join(registration.Attributes, ", "))
+}
+
+// =========================================================================================
+// getDeviceRegistration loads the registration of a device, nil when it has none
+// =========================================================================================
+func getDeviceRegistration(stub shim.ChaincodeStubInterface, deviceName string) (*DeviceRegistration, error) {
+	registryKey, err := stub.CreateCompositeKey(deviceRegistryName, []string{deviceName})
+	if err != nil {
+		return nil, err
+	}
+	registrationAsBytes, err := stub.GetState(registryKey)
+	if err != nil {
+		return nil, newChaincodeError(errCodeInternal, "Failed to get device registration: "+err.Error())
+	}
+	if registrationAsBytes == nil {
+		return nil, nil
+	}
+	registration := DeviceRegistration{}
+	err = json.Unmarshal(registrationAsBytes, &registration)
+	if err != nil {
+		return nil, newChaincodeError(errCodeInternal, "Failed to decode device registration: "+err.Error())
+	}
+	return &registration, nil
+}
+
+// =========================================================================================
+// checkFutureSkew rejects entries dated further in the future than maxFutureSkew,
+// relative to the timestamp of the transaction. The entry must have been validated.
+// =========================================================================================
+func checkFutureSkew(stub shim.ChaincodeStubInterface, entry *Entry) error {
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return newChaincodeError(errCodeInternal, "Failed to get the transaction timestamp: "+err.Error())
+	}
+	timestamp, err := time.Parse(time.RFC3339Nano, entry.Timestamp)
+	if err != nil {
+		return newValidationError("timestamp", "must be a RFC3339Nano timestamp: "+err.Error())
+	}
+	txTime := time.Unix(txTimestamp.Seconds, int64(txTimestamp.Nanos))
+	if timestamp.Sub(txTime) > maxFutureSkew {
+		return newValidationError("timestamp", fmt.Sprintf("%s is more than %s ahead of the transaction time %s",
+			entry.Timestamp, maxFutureSkew, txTime.UTC().Format(time.RFC3339)))
+	}
+	return nil
+}
+
+// =========================================================================================
+// applyValueType checks that the attribute value matches the value type of the entry and
+// fills in the typed representation of the value. Entries without a type are strings.
+// Except for the json value type, the value must be a non-empty JSON string.
+// =========================================================================================
+func applyValueType(entry *Entry) error {
+	entry.NumericValue = nil
+	if entry.ValueType == "" {
+		entry.ValueType = valueTypeString
+	}
+	switch entry.ValueType {
+	case valueTypeString, valueTypeNumber, valueTypeBool:
+	case valueTypeJSON:
+		if !json.Valid(entry.AttributeValue) {
+			return newValidationError("attributeValue", "must be valid JSON: "+string(entry.AttributeValue))
+		}
+		return nil
+	default:
+		return newValidationError("valueType", "must be one of string, number, bool or json: "+entry.ValueType)
+	}
+
+	value, ok := stringValue(entry)
+	if !ok {
+		return newValidationError("attributeValue", "must be a string unless valueType is json: "+string(entry.AttributeValue))
+	}
+	if len(value) <= 0 {
+		if entry.ValueType == valueTypeString && valuelessAttributes[entry.Attribute] {
+			return nil
+		}
+		return newValidationError("attributeValue", "must be a non-empty string")
+	}
+	switch entry.ValueType {
+	case valueTypeNumber:
+		numericValue, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return newValidationError("attributeValue", "must be a number: "+value)
+		}
+		entry.NumericValue = &numericValue
+	case valueTypeBool:
+		_, err := strconv.ParseBool(value)
+		if err != nil {
+			return newValidationError("attributeValue", "must be a bool: "+value)
+		}
+	}
+	return nil
+}
+
+// =========================================================================================
+// saveNewEntry stores a validated entry under its timestamp together with its index,
+// failing if an entry with the same timestamp already exists.
+// The stored entry is returned as JSON.
+// =========================================================================================
+func saveNewEntry(stub shim.ChaincodeStubInterface, entry *Entry) ([]byte, error) {
+	//check if entry already exists
+	key := entryKey(entry.DeviceName, entry.Timestamp)
+	entryAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, newChaincodeError(errCodeInternal, "Failed to get entry: "+err.Error())
+	} else if entryAsBytes != nil {
+		logger.Info("This entry already exists: " + key)
+		return nil, newDuplicateKeyError(key, "This entry already exists: "+key)
+	}
+
+	entry.Version = 1
+	return putEntry(stub, entry)
+}
+
+// =========================================================================================
+// putEntry writes an entry to state under its entry key and indexes it.
+// The stored entry is returned as JSON.
+// =========================================================================================
+func putEntry(stub shim.ChaincodeStubInterface, entry *Entry) ([]byte, error) {
+	entry.LastTxID = stub.GetTxID()
+	err := sealEntry(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	// ==== Marshal entry to JSON ====
+	entryJSONasBytes, err := marshalEntry(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	// Save entry to state
+	err = stub.PutState(entryKey(entry.DeviceName, entry.Timestamp), entryJSONasBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	err = addEntryIndexes(stub, entry)
+	if err != nil {
+		return nil, err
+	}
+
+	return entryJSONasBytes, nil
+}
+
+// =========================================================================================
+// marshalEntry returns the stored form of an entry, canonical JSON with the object keys
+// sorted at every level. The stored bytes therefore do not depend on the declaration order
+// of the Entry fields, which keeps hashes of stored entries stable across versions.
+// =========================================================================================
+func marshalEntry(entry *Entry) ([]byte, error) {
+	entryJSONasBytes, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+	// decoding into generic values turns objects into maps, which are encoded with sorted keys
+	var canonical interface{}
+	decoder := json.NewDecoder(bytes.NewReader(entryJSONasBytes))
+	decoder.UseNumber() // numbers keep their exact representation
+	err = decoder.Decode(&canonical)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(canonical)
+}
+
+// =========================================================================================
+// entryHash returns the hex encoded SHA-256 of the canonical JSON of an entry, computed
+// with the Hash field left empty
+// =========================================================================================
+func entryHash(entry *Entry) (string, error) {
+	unhashed := *entry
+	unhashed.Hash = ""
+	entryJSONasBytes, err := marshalEntry(&unhashed)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(entryJSONasBytes)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// =========================================================================================
+// sealEntry sets the Hash of an entry about to be written, after all other fields are final
+// =========================================================================================
+func sealEntry(entry *Entry) error {
+	hash, err := entryHash(entry)
+	if err != nil {
+		return err
+	}
+	entry.Hash = hash
+	return nil
+}
+
+// =========================================================================================
+// addEntryIndexes saves the index entries of an entry
+// =========================================================================================
+func addEntryIndexes(stub shim.ChaincodeStubInterface, entry *Entry) error {
+	//  ==== Index the entry to enable device and attribute based range queries ====
+	//  An 'index' is a normal key/value entry in state.
+	//  The key is a composite key, with the elements that you want to range query on listed first.
+	//  In our case, the composite key is based on device~attr~time.
+	//  This will enable very efficient state range queries based on composite keys matching device~attr~*
+	deviceAttrIndexKey, err := stub.CreateCompositeKey(deviceAttrIndexName, []string{entry.DeviceName, entry.Attribute, entry.Timestamp})
+	if err != nil {
+		return err
+	}
+	//  Save index entry to state. Only the key name is needed, no need to store a duplicate copy of the entry.
+	//  Note - passing a 'nil' value will effectively delete the key from state, therefore we pass null character as value
+	value := []byte{0x00}
+	err = stub.PutState(deviceAttrIndexKey, value)
+	if err != nil {
+		return err
+	}
+
+	//  ==== Add the device to the device set, it lists every device having entries ====
+	deviceIndexKey, err := stub.CreateCompositeKey(deviceIndexName, []string{entry.DeviceName})
+	if err != nil {
+		return err
+	}
+	err = stub.PutState(deviceIndexKey, value)
+	if err != nil {
+		return err
+	}
+
+	//  ==== Add the entry to its time bucket, for time window reads without a full range scan ====
+	if bucket, ok := timeBucket(entry.Timestamp); ok {
+		deviceBucketIndexKey, err := stub.CreateCompositeKey(deviceBucketIndexName, []string{entry.DeviceName, bucket, entry.Timestamp})
+		if err != nil {
+			return err
+		}
+		err = stub.PutState(deviceBucketIndexKey, value)
+		if err != nil {
+			return err
+		}
+	}
+
+	//  ==== Add the attribute to the attributes of the device ====
+	deviceAttributeIndexKey, err := stub.CreateCompositeKey(deviceAttributeIndexName, []string{entry.DeviceName, entry.Attribute})
+	if err != nil {
+		return err
+	}
+	return stub.PutState(deviceAttributeIndexKey, value)
+}
+
+// =========================================================================================
+// timeBucket returns the time bucket of a timestamp, the normalized start of the
+// timeBucketSize window holding it. ok is false for timestamps that do not parse, entries
+// written before timestamps were validated are left out of the bucket index.
+// =========================================================================================
+func timeBucket(timestamp string) (string, bool) {
+	t, err := time.Parse(time.RFC3339Nano, timestamp)
+	if err != nil {
+		return "", false
+	}
+	return normalizeTimestamp(t.Truncate(timeBucketSize)), true
+}
+
+// =========================================================================================
+// removeEntryIndexes deletes the index entries of an entry. Functions removing several
+// entries in one transaction pass the same removedIndexKeys to every call, it collects the
+// device~attr~time keys deleted so far; nil is fine when a single entry is removed.
+// =========================================================================================
+func removeEntryIndexes(stub shim.ChaincodeStubInterface, entry *Entry, removedIndexKeys map[string]bool) error {
+	deviceAttrIndexKey, err := stub.CreateCompositeKey(deviceAttrIndexName, []string{entry.DeviceName, entry.Attribute, entry.Timestamp})
+	if err != nil {
+		return err
+	}
+
+	//  Delete index entry to state.
+	err = stub.DelState(deviceAttrIndexKey)
+	if err != nil {
+		return newChaincodeError(errCodeInternal, "Failed to delete index entry: "+err.Error())
+	}
+	if removedIndexKeys == nil {
+		removedIndexKeys = make(map[string]bool)
+	}
+	removedIndexKeys[deviceAttrIndexKey] = true
+
+	if bucket, ok := timeBucket(entry.Timestamp); ok {
+		deviceBucketIndexKey, err := stub.CreateCompositeKey(deviceBucketIndexName, []string{entry.DeviceName, bucket, entry.Timestamp})
+		if err != nil {
+			return err
+		}
+		err = stub.DelState(deviceBucketIndexKey)
+		if err != nil {
+			return newChaincodeError(errCodeInternal, "Failed to delete index entry: "+err.Error())
+		}
+	}
+
+	deviceAttributeIndexKey, err := stub.CreateCompositeKey(deviceAttributeIndexName, []string{entry.DeviceName, entry.Attribute})
+	if err != nil {
+		return err
+	}
+	err = removeIndexIfUnused(stub, deviceAttributeIndexKey, removedIndexKeys, []string{entry.DeviceName, entry.Attribute})
+	if err != nil {
+		return err
+	}
+
+	deviceIndexKey, err := stub.CreateCompositeKey(deviceIndexName, []string{entry.DeviceName})
+	if err != nil {
+		return err
+	}
+	return removeIndexIfUnused(stub, deviceIndexKey, removedIndexKeys, []string{entry.DeviceName})
+}
+
+// =========================================================================================
+// removeLegacyEntryIndexes deletes the device~attr~time and device~bucket~time keys of an
+// entry whose timestamp is not normalized, its time bucket was formatted as RFC3339Nano.
+// The device and device~attr keys do not hold the timestamp and stay.
+// =========================================================================================
+func removeLegacyEntryIndexes(stub shim.ChaincodeStubInterface, entry *Entry, timestamp time.Time) error {
+	deviceAttrIndexKey, err := stub.CreateCompositeKey(deviceAttrIndexName, []string{entry.DeviceName, entry.Attribute, entry.Timestamp})
+	if err != nil {
+		return err
+	}
+	err = stub.DelState(deviceAttrIndexKey)
+	if err != nil {
+		return newChaincodeError(errCodeInternal, "Failed to delete index entry: "+err.Error())
+	}
+
+	bucket := timestamp.Truncate(timeBucketSize).UTC().Format(time.RFC3339Nano)
+	deviceBucketIndexKey, err := stub.CreateCompositeKey(deviceBucketIndexName, []string{entry.DeviceName, bucket, entry.Timestamp})
+	if err != nil {
+		return err
+	}
+	err = stub.DelState(deviceBucketIndexKey)
+	if err != nil {
+		return newChaincodeError(errCodeInternal, "Failed to delete index entry: "+err.Error())
+	}
+	return nil
+}
+
+// =========================================================================================
+// removeIndexIfUnused deletes the index key unless entries other than the ones indexed
+// under removedIndexKeys match the device~attr~time partial key with the given attributes.
+// Deletions in the running transaction are not visible to range queries, so the removed
+// entries' index keys are skipped explicitly.
+// =========================================================================================
+func removeIndexIfUnused(stub shim.ChaincodeStubInterface, indexKey string, removedIndexKeys map[string]bool, attributes []string) error {
+	deviceAttrResultsIterator, err := stub.GetStateByPartialCompositeKey(deviceAttrIndexName, attributes)
+	if err != nil {
+		return err
+	}
+	defer deviceAttrResultsIterator.Close()
+
+	for deviceAttrResultsIterator.HasNext() {
+		responseRange, err := deviceAttrResultsIterator.Next()
+		if err != nil {
+			return err
+		}
+		if !removedIndexKeys[responseRange.Key] {
+			return nil
+		}
+	}
+
+	err = stub.DelState(indexKey)
+	if err != nil {
+		return newChaincodeError(errCodeInternal, "Failed to delete index entry: "+err.Error())
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// Update Entry - change the attribute value of an existing entry
+// An update to the value already stored is skipped, nothing is written and the response is
+// marked unchanged, so retries and repeated readings leave no empty history entries. Pass
+// force as true to write a new version regardless.
+// ============================================================================================================================
+func (t *SimpleChaincode) updateEntry(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var err error
+
+	//   0       	1                 2                  3 (optional)
+	// "timestamp", "attributeValue", "expectedVersion", "force"
+	if err := checkArgCount(args, 3, 4); err != nil {
+		return nil, err
+	}
+
+	//input sanitation
+	logger.Debug("- start entry update")
+	if len(args[0]) <= 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "1st argument must be a non-empty string")
+	}
+	if len(args[1]) <= 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "2nd argument must be a non-empty string")
+	}
+	expectedVersion, err := strconv.Atoi(args[2])
+	if err != nil || expectedVersion < 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "3rd argument must be a non-negative integer")
+	}
+	force := false
+	if len(args) == 4 {
+		force, err = strconv.ParseBool(args[3])
+		if err != nil {
+			return nil, newChaincodeError(errCodeBadArgs, "force must be true or false: "+args[3])
+		}
+	}
+	timestamp := entryKeyArg(args[0])
+
+	if err := authorizeCreator(stub); err != nil {
+		return nil, err
+	}
+	attributeValue := args[1]
+
+	//load the existing entry
+	entryAsBytes, err := stub.GetState(timestamp)
+	if err != nil {
+		return nil, newChaincodeError(errCodeInternal, "Failed to get entry: "+err.Error())
+	} else if entryAsBytes == nil {
+		logger.Info("Cannot update, entry not found: " + timestamp)
+		return nil, newNotFoundError(timestamp, "Cannot update, entry not found: "+timestamp)
+	}
+
+	entry := Entry{}
+	err = json.Unmarshal(entryAsBytes, &entry)
+	if err != nil {
+		return nil, err
+	}
+	if entry.Deleted {
+		logger.Info("Cannot update, entry deleted: " + timestamp)
+		return nil, newNotFoundError(timestamp, "Cannot update, entry deleted: "+timestamp)
+	}
+	// optimistic concurrency, the update is based on a version that has been overwritten since
+	if entry.Version != expectedVersion {
+		logger.Info("Cannot update, version conflict: " + timestamp)
+		return nil, newChaincodeError(errCodeVersionConflict, fmt.Sprintf("version conflict, entry %s is at version %d, not %d", timestamp, entry.Version, expectedVersion))
+	}
+	newValue := encodeAttributeValue(attributeValue, entry.ValueType)
+	if !force && sameJSONValue(entry.AttributeValue, newValue) {
+		logger.Info("- entry update skipped, value unchanged: " + timestamp)
+		return json.Marshal(EntryResponse{TxID: stub.GetTxID(), Entry: entryAsBytes, Unchanged: true})
+	}
+	// the entry with its new value is validated like a created entry, on a copy
+	strict, err := isStrictMode(stub)
+	if err != nil {
+		return nil, err
+	}
+	updated := entry
+	updated.AttributeValue = newValue
+	err = validateEntry(&updated, strict)
+	if err != nil {
+		return nil, err
+	}
+	entryJSONasBytes, err := writeEntryValue(stub, timestamp, &entry, newValue)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info("- end entry update")
+	return json.Marshal(EntryResponse{TxID: stub.GetTxID(), Entry: entryJSONasBytes})
+}
+
+// =========================================================================================
+// writeEntryValue stores a new attribute value of an entry as its next version under the
+// state key of the entry, deviceName and attribute stay as they were
+// =========================================================================================
+func writeEntryValue(stub shim.ChaincodeStubInterface, key string, entry *Entry, newValue json.RawMessage) ([]byte, error) {
+	entry.Version++
+	entry.AttributeValue = newValue
+	err := applyValueType(entry)
+	if err != nil {
+		return nil, err
+	}
+	entry.LastTxID = stub.GetTxID()
+	err = sealEntry(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	entryJSONasBytes, err := marshalEntry(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	// Save entry to state
+	err = stub.PutState(key, entryJSONasBytes)
+	if err != nil {
+		return nil, err
+	}
+	return entryJSONasBytes, nil
+}
+
+// ============================================================================================================================
+// Update Entries Batch - change the attribute values of many existing entries at once
+// The first argument is a JSON object mapping the key of each entry to its new attribute
+// value, given as updateEntry takes it. Calibration corrections are applied whatever the
+// version of each entry. Entries are updated in key order, each on its own: entries that
+// are missing, soft-deleted or whose value is invalid are skipped and reported back, entries
+// already holding the value are left untouched.
+// ============================================================================================================================
+func (t *SimpleChaincode) updateEntriesBatch(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//   0
+	// "{timestamp: attributeValue, ...}"
+	if err := checkArgCount(args, 1, 1); err != nil {
+		return nil, err
+	}
+
+	//input sanitation
+	logger.Debug("- start batch entry update")
+	err := authorizeCreator(stub)
+	if err != nil {
+		return nil, err
+	}
+	var updates map[string]string
+	err = json.Unmarshal([]byte(args[0]), &updates)
+	if err != nil || updates == nil {
+		return nil, newChaincodeError(errCodeBadArgs, "1st argument must be a JSON object mapping timestamps to attribute values")
+	}
+	if len(updates) > maxUpdateBatchSize {
+		return nil, newChaincodeError(errCodeBadArgs, fmt.Sprintf("a batch update may change at most %d entries, got %d", maxUpdateBatchSize, len(updates)))
+	}
+	strict, err := isStrictMode(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	// map iteration order is random, every peer has to write the entries in the same order
+	timestamps := make([]string, 0, len(updates))
+	for timestamp := range updates {
+		timestamps = append(timestamps, timestamp)
+	}
+	sort.Strings(timestamps)
+
+	result := BatchUpdateResult{Updated: []string{}, Unchanged: []string{}, Failed: []BatchFailure{}}
+	for _, timestamp := range timestamps {
+		unchanged, err := updateBatchEntry(stub, timestamp, updates[timestamp], strict)
+		if err != nil {
+			logger.Warning("- batch entry update failed: " + err.Error())
+			failure := BatchFailure{timestamp, err.Error(), errCodeInternal}
+			var ccErr *chaincodeError
+			if errors.As(err, &ccErr) {
+				failure.Error = ccErr.Message
+				failure.Code = ccErr.Code
+			}
+			result.Failed = append(result.Failed, failure)
+			continue
+		}
+		if unchanged {
+			result.Unchanged = append(result.Unchanged, timestamp)
+			continue
+		}
+		result.Updated = append(result.Updated, timestamp)
+	}
+
+	resultJSONasBytes, err := json.Marshal(result)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info("- end batch entry update")
+	return resultJSONasBytes, nil
+}
+
+// =========================================================================================
+// updateBatchEntry sets the attribute value of a single entry of a batch update, unchanged
+// tells that the entry already held the value and nothing was written. The entry with its
+// new value is validated as validateEntry does for created entries before it is written.
+// =========================================================================================
+func updateBatchEntry(stub shim.ChaincodeStubInterface, key string, attributeValue string, strict bool) (bool, error) {
+	if len(key) <= 0 {
+		return false, newValidationError("timestamp", "must be a non-empty string")
+	}
+	timestamp := entryKeyArg(key)
+	if len(attributeValue) <= 0 {
+		return false, newValidationError("attributeValue", "must be a non-empty string")
+	}
+
+	entryAsBytes, err := stub.GetState(timestamp)
+	if err != nil {
+		return false, newChaincodeError(errCodeInternal, "Failed to get entry: "+err.Error())
+	} else if entryAsBytes == nil {
+		return false, newNotFoundError(timestamp, "Cannot update, entry not found: "+timestamp)
+	}
+	entry := Entry{}
+	err = json.Unmarshal(entryAsBytes, &entry)
+	if err != nil {
+		return false, newChaincodeError(errCodeInternal, "Failed to decode entry: "+err.Error())
+	}
+	if entry.Deleted {
+		return false, newNotFoundError(timestamp, "Cannot update, entry deleted: "+timestamp)
+	}
+
+	newValue := encodeAttributeValue(attributeValue, entry.ValueType)
+	if sameJSONValue(entry.AttributeValue, newValue) {
+		return true, nil
+	}
+	// validate a copy, the value is coerced to the type of the entry only once it is written
+	updated := entry
+	updated.AttributeValue = newValue
+	err = validateEntry(&updated, strict)
+	if err != nil {
+		return false, err
+	}
+	_, err = writeEntryValue(stub, timestamp, &entry, newValue)
+	return false, err
+}
+
+// =========================================================================================
+// sameJSONValue tells whether two JSON texts hold the same value, whatever their spacing,
+// escaping and object key order. Invalid JSON is never the same.
+// =========================================================================================
+func sameJSONValue(a json.RawMessage, b json.RawMessage) bool {
+	var valueA, valueB interface{}
+	if json.Unmarshal(a, &valueA) != nil || json.Unmarshal(b, &valueB) != nil {
+		return false
+	}
+	// marshalling sorts object keys, equal values therefore marshal to equal bytes
+	canonicalA, errA := json.Marshal(valueA)
+	canonicalB, errB := json.Marshal(valueB)
+	return errA == nil && errB == nil && bytes.Equal(canonicalA, canonicalB)
+}
+
+// ============================================================================================================================
+// Patch Entry - overwrite selected fields of an existing entry
+// The patch is a JSON object holding any of deviceName, attribute, attributeValue and
+// valueType. The timestamp is the key of the entry and cannot be patched, the other fields
+// are maintained by the chaincode. Like updateEntry, the expected version must be passed.
+// ============================================================================================================================
+func (t *SimpleChaincode) patchEntry(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var err error
+
+	//   0       	1        2
+	// "timestamp", "{patch}", "expectedVersion"
+	if err := checkArgCount(args, 3, 3); err != nil {
+		return nil, err
+	}
+
+	//input sanitation
+	logger.Debug("- start entry patch")
+	if len(args[0]) <= 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "1st argument must be a non-empty string")
+	}
+	if len(args[1]) <= 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "2nd argument must be a non-empty string")
+	}
+	expectedVersion, err := strconv.Atoi(args[2])
+	if err != nil || expectedVersion < 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "3rd argument must be a non-negative integer")
+	}
+	timestamp := entryKeyArg(args[0])
+
+	if err := authorizeCreator(stub); err != nil {
+		return nil, err
+	}
+
+	var patch map[string]json.RawMessage
+	err = json.Unmarshal([]byte(args[1]), &patch)
+	if err != nil || patch == nil {
+		return nil, newChaincodeError(errCodeBadArgs, "2nd argument must be a JSON object of fields to overwrite")
+	}
+	for field := range patch {
+		if field == "timestamp" {
+			return nil, newChaincodeError(errCodeBadArgs, "timestamp is the key of the entry and cannot be patched")
+		}
+		if !patchableFields[field] {
+			return nil, newChaincodeError(errCodeBadArgs, "field cannot be patched: "+strconv.Quote(field))
+		}
+	}
+
+	//load the existing entry
+	entryAsBytes, err := stub.GetState(timestamp)
+	if err != nil {
+		return nil, newChaincodeError(errCodeInternal, "Failed to get entry: "+err.Error())
+	} else if entryAsBytes == nil {
+		logger.Info("Cannot patch, entry not found: " + timestamp)
+		return nil, newNotFoundError(timestamp, "Cannot patch, entry not found: "+timestamp)
+	}
+
+	existing := Entry{}
+	err = json.Unmarshal(entryAsBytes, &existing)
+	if err != nil {
+		return nil, err
+	}
+	if existing.Deleted {
+		logger.Info("Cannot patch, entry deleted: " + timestamp)
+		return nil, newNotFoundError(timestamp, "Cannot patch, entry deleted: "+timestamp)
+	}
+	if existing.Version != expectedVersion {
+		logger.Info("Cannot patch, version conflict: " + timestamp)
+		return nil, newChaincodeError(errCodeVersionConflict, fmt.Sprintf("version conflict, entry %s is at version %d, not %d", timestamp, existing.Version, expectedVersion))
+	}
+
+	// merge the patch into a copy of the entry, the patched fields are then validated as a whole
+	entry := existing
+	err = json.Unmarshal([]byte(args[1]), &entry)
+	if err != nil {
+		return nil, newChaincodeError(errCodeBadArgs, "2nd argument holds a field of the wrong type: "+err.Error())
+	}
+	strict, err := isStrictMode(stub)
+	if err != nil {
+		return nil, err
+	}
+	err = validateEntry(&entry, strict)
+	if err != nil {
+		return nil, err
+	}
+	if entryKey(entry.DeviceName, entry.Timestamp) != entryKey(existing.DeviceName, existing.Timestamp) {
+		return nil, newChaincodeError(errCodeBadArgs, "deviceName is part of the key of the entry and cannot be patched")
+	}
+	err = checkRegisteredAttribute(stub, &entry)
+	if err != nil {
+		return nil, err
+	}
+	entry.Version++
+
+	// the entry may move to another device or attribute, it is indexed anew
+	err = removeEntryIndexes(stub, &existing, nil)
+	if err != nil {
+		return nil, err
+	}
+	entryJSONasBytes, err := putEntry(stub, &entry)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info("- end entry patch")
+	return json.Marshal(EntryResponse{TxID: stub.GetTxID(), Entry: entryJSONasBytes})
+}
+
+// ============================================================================================================================
+// Delete Entry - remove an entry from chaincode state
+// ============================================================================================================================
+func (t *SimpleChaincode) deleteEntry(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var err error
+
+	//   0
+	// "timestamp"
+	if err := checkArgCount(args, 1, 1); err != nil {
+		return nil, err
+	}
+
+	//input sanitation
+	logger.Debug("- start entry deletion")
+	if len(args[0]) <= 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "1st argument must be a non-empty string")
+	}
+	timestamp := entryKeyArg(args[0])
+
+	if err := authorizeCreator(stub); err != nil {
+		return nil, err
+	}
+
+	//check that the entry exists
+	entryAsBytes, err := stub.GetState(timestamp)
+	if err != nil {
+		return nil, newChaincodeError(errCodeInternal, "Failed to get entry: "+err.Error())
+	} else if entryAsBytes == nil {
+		logger.Info("Cannot delete, entry not found: " + timestamp)
+		return nil, newNotFoundError(timestamp, "Cannot delete, entry not found: "+timestamp)
+	}
+
+	err = removeEntry(stub, timestamp, entryAsBytes, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info("- end entry deletion")
+	return nil, nil
+}
+
+// =========================================================================================
+// removeEntry deletes the entry stored under a key and its index entries,
+// entryAsBytes is the stored entry. removedIndexKeys is passed on to removeEntryIndexes.
+// =========================================================================================
+func removeEntry(stub shim.ChaincodeStubInterface, key string, entryAsBytes []byte, removedIndexKeys map[string]bool) error {
+	// Remove entry from state
+	err := stub.DelState(key)
+	if err != nil {
+		return newChaincodeError(errCodeInternal, "Failed to delete entry: "+err.Error())
+	}
+
+	// maintain the index
+	entry := Entry{}
+	err = json.Unmarshal(entryAsBytes, &entry)
+	if err != nil {
+		return err
+	}
+	return removeEntryIndexes(stub, &entry, removedIndexKeys)
+}
+
+// ============================================================================================================================
+// Delete Entries By Device - remove all entries of a device from chaincode state
+// At most maxDeletionsPerCall entries are deleted per invocation. When more remain, the
+// result carries a bookmark which is passed to the next invocation to continue.
+// ============================================================================================================================
+func (t *SimpleChaincode) deleteEntriesByDevice(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//   0             1 (optional)
+	// "deviceName", "bookmark"
+	if err := checkArgCount(args, 1, 2); err != nil {
+		return nil, err
+	}
+
+	//input sanitation
+	logger.Debug("- start device entries deletion")
+	if len(args[0]) <= 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "1st argument must be a non-empty string")
+	}
+	deviceName := args[0]
+	bookmark := ""
+	if len(args) == 2 {
+		bookmark = args[1]
+	}
+
+	err := authorizeCreator(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	// the device~attr~time index lists the entries of the device. Paginated range queries are
+	// not allowed in transactions that write, the bookmark is therefore the index key to resume at.
+	deviceAttrResultsIterator, err := stub.GetStateByPartialCompositeKey(deviceAttrIndexName, []string{deviceName})
+	if err != nil {
+		return nil, err
+	}
+	defer deviceAttrResultsIterator.Close()
+
+	result := DeletionResult{}
+	removedIndexKeys := make(map[string]bool)
+	for deviceAttrResultsIterator.HasNext() {
+		responseRange, err := deviceAttrResultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		if responseRange.Key < bookmark {
+			continue
+		}
+		if result.Deleted >= maxDeletionsPerCall {
+			result.Bookmark = responseRange.Key
+			break
+		}
+
+		// get the timestamp of the entry from device~attr~time composite key
+		indexKey, err := decodeIndexKey(stub, responseRange.Key, deviceAttrIndexName)
+		if err != nil {
+			return nil, err
+		}
+		key := entryKey(deviceName, indexKey.Timestamp)
+
+		entryAsBytes, err := stub.GetState(key)
+		if err != nil {
+			return nil, newChaincodeError(errCodeInternal, "Failed to get entry: "+err.Error())
+		}
+		if entryAsBytes == nil {
+			// stale index entry without an entry, drop it
+			err = stub.DelState(responseRange.Key)
+			if err != nil {
+				return nil, newChaincodeError(errCodeInternal, "Failed to delete index entry: "+err.Error())
+			}
+			continue
+		}
+		err = removeEntry(stub, key, entryAsBytes, removedIndexKeys)
+		if err != nil {
+			return nil, err
+		}
+		result.Deleted++
+	}
+
+	resultJSONasBytes, err := json.Marshal(result)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info("- end device entries deletion: " + string(resultJSONasBytes))
+	return resultJSONasBytes, nil
+}
+
+// ============================================================================================================================
+// Sync Device - replace all entries of a device by the supplied ones in one transaction
+// Every supplied entry is checked before the first existing entry is deleted, so an invalid
+// payload fails without touching state. Unlike deleteByDevice the deletion cannot be continued
+// in another transaction, a device with more than maxDeletionsPerCall entries is rejected.
+// ============================================================================================================================
+func (t *SimpleChaincode) syncDevice(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//   0             1
+	// "deviceName", "[{entry}, {entry}, ...]"
+	if err := checkArgCount(args, 2, 2); err != nil {
+		return nil, err
+	}
+
+	//input sanitation
+	logger.Debug("- start device sync")
+	if len(args[0]) <= 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "1st argument must be a non-empty string")
+	}
+	if len(args[1]) <= 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "2nd argument must be a non-empty string")
+	}
+	deviceName := args[0]
+
+	err := authorizeCreator(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []Entry
+	err = json.Unmarshal([]byte(args[1]), &entries)
+	if err != nil {
+		return nil, newChaincodeError(errCodeBadArgs, "2nd argument must be a JSON array of entries: "+err.Error())
+	}
+
+	// ==== Check every entry before anything is deleted ====
+	// writes are not visible to reads within the same transaction, so duplicates inside the payload are tracked here
+	seen := make(map[string]bool)
+	for i := range entries {
+		entry := &entries[i]
+		err = validateNewEntry(stub, entry)
+		if err == nil && entry.DeviceName != deviceName {
+			err = newChaincodeError(errCodeBadArgs, "deviceName must be "+deviceName+", got "+entry.DeviceName)
+		}
+		key := entryKey(deviceName, entry.Timestamp)
+		if err == nil && seen[entry.Timestamp] {
+			err = newDuplicateKeyError(key, "This entry already exists in the payload: "+key)
+		}
+		if err == nil {
+			// the entries of the device are replaced, an entry of another device under the same key is not
+			err = checkSyncKeyAvailable(stub, key, deviceName)
+		}
+		if err == nil {
+			err = setProvenance(stub, entry)
+		}
+		if err != nil {
+			logger.Warningf("- device sync failed at entry %d: %s", i, err.Error())
+			var ccErr *chaincodeError
+			if errors.As(err, &ccErr) {
+				return nil, &chaincodeError{Message: fmt.Sprintf("sync entry %d: %s", i, ccErr.Message), Code: ccErr.Code, cause: ccErr.cause}
+			}
+			return nil, err
+		}
+		seen[entry.Timestamp] = true
+	}
+
+	// ==== Delete the existing entries of the device ====
+	deviceAttrResultsIterator, err := stub.GetStateByPartialCompositeKey(deviceAttrIndexName, []string{deviceName})
+	if err != nil {
+		return nil, err
+	}
+	defer deviceAttrResultsIterator.Close()
+
+	result := SyncResult{}
+	// versions of the replaced entries, an entry supplied again under the same timestamp continues its version
+	versions := make(map[string]int)
+	removedIndexKeys := make(map[string]bool)
+	for deviceAttrResultsIterator.HasNext() {
+		responseRange, err := deviceAttrResultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		if result.Deleted >= maxDeletionsPerCall {
+			return nil, newChaincodeError(errCodeResultLimit, fmt.Sprintf("device %s has more than %d entries, delete them with deleteByDevice first", deviceName, maxDeletionsPerCall))
+		}
+
+		// get the timestamp of the entry from device~attr~time composite key
+		indexKey, err := decodeIndexKey(stub, responseRange.Key, deviceAttrIndexName)
+		if err != nil {
+			return nil, err
+		}
+		timestamp := indexKey.Timestamp
+		key := entryKey(deviceName, timestamp)
+
+		entryAsBytes, err := stub.GetState(key)
+		if err != nil {
+			return nil, newChaincodeError(errCodeInternal, "Failed to get entry: "+err.Error())
+		}
+		if entryAsBytes == nil {
+			// stale index entry without an entry, drop it
+			err = stub.DelState(responseRange.Key)
+			if err != nil {
+				return nil, newChaincodeError(errCodeInternal, "Failed to delete index entry: "+err.Error())
+			}
+			continue
+		}
+		existing := Entry{}
+		err = json.Unmarshal(entryAsBytes, &existing)
+		if err != nil {
+			return nil, err
+		}
+		versions[timestamp] = existing.Version
+		err = removeEntry(stub, key, entryAsBytes, removedIndexKeys)
+		if err != nil {
+			return nil, err
+		}
+		result.Deleted++
+	}
+
+	// ==== Create the supplied entries ====
+	for i := range entries {
+		entry := &entries[i]
+		entry.Version = versions[entry.Timestamp] + 1
+		_, err = putEntry(stub, entry)
+		if err != nil {
+			return nil, err
+		}
+		result.Created++
+	}
+
+	resultJSONasBytes, err := json.Marshal(result)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info("- end device sync: " + string(resultJSONasBytes))
+	return resultJSONasBytes, nil
+}
+
+// =========================================================================================
+// checkSyncKeyAvailable fails when the key holds an entry of a device other than deviceName
+// =========================================================================================
+func checkSyncKeyAvailable(stub shim.ChaincodeStubInterface, key string, deviceName string) error {
+	entryAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return newChaincodeError(errCodeInternal, "Failed to get entry: "+err.Error())
+	}
+	if entryAsBytes == nil {
+		return nil
+	}
+	existing := Entry{}
+	err = json.Unmarshal(entryAsBytes, &existing)
+	if err != nil {
+		return err
+	}
+	if existing.DeviceName != deviceName {
+		return newDuplicateKeyError(key, "This entry already exists for device "+existing.DeviceName+": "+key)
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// Purge Expired - remove the entries older than a cutoff time from chaincode state
+// Entry keys are timestamps, the expired entries are therefore the key range up to the
+// cutoff and no rich query support is needed. At most maxDeletionsPerCall entries are
+// deleted per invocation, when more remain the result carries a bookmark which is passed
+// to the next invocation to continue.
+// ============================================================================================================================
+func (t *SimpleChaincode) purgeExpired(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//   0         1 (optional)
+	// "cutoff", "bookmark"
+	if err := checkArgCount(args, 1, 2); err != nil {
+		return nil, err
+	}
+
+	//input sanitation
+	logger.Debug("- start expired entries purge")
+	if err := checkKeyScheme(keySchemeTimestamp, "purgeExpired"); err != nil {
+		return nil, err
+	}
+	cutoffTime, err := time.Parse(time.RFC3339, args[0])
+	if err != nil {
+		return nil, newChaincodeError(errCodeBadArgs, "cutoff must be a RFC3339 timestamp: "+args[0])
+	}
+	// keys hold normalized timestamps, the cutoff is normalized alike
+	cutoff := normalizeTimestamp(cutoffTime)
+	bookmark := ""
+	if len(args) == 2 {
+		bookmark = args[1]
+	}
+
+	err = authorizeCreator(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	// the end key is exclusive, entries written at the cutoff are kept
+	resultsIterator, err := stub.GetStateByRange(bookmark, cutoff)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	result := DeletionResult{}
+	removedIndexKeys := make(map[string]bool)
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		if isCompositeKey(queryResponse.Key) {
+			continue
+		}
+		if result.Deleted >= maxDeletionsPerCall {
+			result.Bookmark = queryResponse.Key
+			break
+		}
+		err = removeEntry(stub, queryResponse.Key, queryResponse.Value, removedIndexKeys)
+		if err != nil {
+			return nil, err
+		}
+		result.Deleted++
+	}
+
+	resultJSONasBytes, err := json.Marshal(result)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info("- end expired entries purge: " + string(resultJSONasBytes))
+	return resultJSONasBytes, nil
+}
+
+// ============================================================================================================================
+// Invoke Idempotent - run an invoke function at most once per idempotency key
+// The first invocation under a key runs the function and stores its result under the key,
+// retries with the same function and arguments return that result without running it
+// again, so clients delivering at least once can resend safely. Reusing a key for another
+// invocation is rejected. Failed invocations are not recorded and may be retried.
+// Every record stays in state until it is pruned, storage therefore grows with the number
+// of keys used. Clients should only send keys for operations they may retry, and an admin
+// should run pruneIdempotencyKeys with a cutoff older than the longest retry window.
+// ============================================================================================================================
+func (t *SimpleChaincode) invokeIdempotent(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//   0                 1           2...
+	// "idempotencyKey", "function", "arguments of the function"...
+	if len(args) < 2 {
+		return nil, newChaincodeError(errCodeBadArgs, "Incorrect number of arguments. Expecting at least 2")
+	}
+	if len(args[0]) <= 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "1st argument must be a non-empty string")
+	}
+	if len(args[0]) > maxNameLength {
+		return nil, newChaincodeError(errCodeBadArgs, fmt.Sprintf("idempotency key must be at most %d bytes long", maxNameLength))
+	}
+	idempotencyKey := args[0]
+	function := args[1]
+	fn, ok := t.invokeFunctions[function]
+	if !ok || function == "idempotent" {
+		return nil, newChaincodeError(errCodeBadArgs, "2nd argument must be an invoke function: "+strconv.Quote(function))
+	}
+
+	argsAsBytes, err := json.Marshal(args[1:])
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(argsAsBytes)
+	argsHash := hex.EncodeToString(sum[:])
+
+	recordKey, err := stub.CreateCompositeKey(idempotencyKeyName, []string{idempotencyKey})
+	if err != nil {
+		return nil, newChaincodeError(errCodeBadArgs, "Invalid idempotency key: "+err.Error())
+	}
+	recordAsBytes, err := stub.GetState(recordKey)
+	if err != nil {
+		return nil, newChaincodeError(errCodeInternal, "Failed to get idempotency record: "+err.Error())
+	}
+	if recordAsBytes != nil {
+		record := IdempotencyRecord{}
+		err = json.Unmarshal(recordAsBytes, &record)
+		if err != nil {
+			return nil, newChaincodeError(errCodeInternal, "Failed to decode idempotency record: "+err.Error())
+		}
+		if record.ArgsHash != argsHash {
+			return nil, newDuplicateKeyError(recordKey, "Idempotency key already used for another invocation: "+idempotencyKey)
+		}
+		logger.Info("- idempotent retry of " + record.Function + ", returning the result of " + record.TxID)
+		return record.Result, nil
+	}
+
+	result, err := fn(stub, args[2:])
+	if err != nil {
+		return nil, err
+	}
+
+	txTimestamp, err := getTxTimestampString(stub)
+	if err != nil {
+		return nil, err
+	}
+	recordAsBytes, err = json.Marshal(IdempotencyRecord{function, argsHash, result, stub.GetTxID(), txTimestamp})
+	if err != nil {
+		return nil, err
+	}
+	err = stub.PutState(recordKey, recordAsBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// ============================================================================================================================
+// Prune Idempotency Keys - remove the idempotency records written before a cutoff time
+// Only admin organizations may call it. Retries under a pruned key run the function again.
+// At most maxDeletionsPerCall records are deleted per invocation, when more remain the
+// result carries a bookmark which is passed to the next invocation to continue.
+// ============================================================================================================================
+func (t *SimpleChaincode) pruneIdempotencyKeys(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//   0         1 (optional)
+	// "cutoff", "bookmark"
+	if err := checkArgCount(args, 1, 2); err != nil {
+		return nil, err
+	}
+	if err := authorizeAdmin(stub); err != nil {
+		return nil, err
+	}
+	cutoff, err := time.Parse(time.RFC3339, args[0])
+	if err != nil {
+		return nil, newChaincodeError(errCodeBadArgs, "cutoff must be a RFC3339 timestamp: "+args[0])
+	}
+	bookmark := ""
+	if len(args) == 2 {
+		bookmark = args[1]
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(idempotencyKeyName, []string{})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	result := DeletionResult{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, keyParts, err := stub.SplitCompositeKey(queryResponse.Key)
+		if err != nil {
+			return nil, err
+		}
+		// partial composite key queries cannot start at a key, the records before the
+		// bookmark are skipped
+		if len(keyParts) != 1 || keyParts[0] < bookmark {
+			continue
+		}
+		record := IdempotencyRecord{}
+		err = json.Unmarshal(queryResponse.Value, &record)
+		if err != nil {
+			return nil, newChaincodeError(errCodeInternal, "Failed to decode idempotency record "+keyParts[0]+": "+err.Error())
+		}
+		written, err := time.Parse(time.RFC3339Nano, record.TxTimestamp)
+		if err != nil || !written.Before(cutoff) {
+			continue
+		}
+		if result.Deleted >= maxDeletionsPerCall {
+			result.Bookmark = keyParts[0]
+			break
+		}
+		err = stub.DelState(queryResponse.Key)
+		if err != nil {
+			return nil, err
+		}
+		result.Deleted++
+	}
+
+	resultJSONasBytes, err := json.Marshal(result)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info("- end idempotency key pruning: " + string(resultJSONasBytes))
+	return resultJSONasBytes, nil
+}
+
+// ============================================================================================================================
+// Set Strict Mode - enable or relax the optional validations of written entries
+// Only admin organizations may call it. Relaxing lets deployments that predate a check keep
+// accepting what they accepted before while their clients migrate, see isStrictMode for the
+// checks concerned. Returns the new setting.
+// ============================================================================================================================
+func (t *SimpleChaincode) setStrictMode(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//   0
+	// "strict"
+	if err := checkArgCount(args, 1, 1); err != nil {
+		return nil, err
+	}
+	if err := authorizeAdmin(stub); err != nil {
+		return nil, err
+	}
+	strict, err := strconv.ParseBool(args[0])
+	if err != nil {
+		return nil, newChaincodeError(errCodeBadArgs, "1st argument must be true or false: "+args[0])
+	}
+
+	settingKey, err := stub.CreateCompositeKey(configName, []string{strictModeSetting})
+	if err != nil {
+		return nil, err
+	}
+	settingAsBytes := []byte(strconv.FormatBool(strict))
+	err = stub.PutState(settingKey, settingAsBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Warning("- strict mode set to " + string(settingAsBytes))
+	return settingAsBytes, nil
+}
+
+// ============================================================================================================================
+// Reset All - remove every key from chaincode state, entries, indexes and bookkeeping alike
+// Meant for test environments. Only admin organizations may call it and the confirmation
+// argument must be given. All keys are deleted in a single transaction, there is no
+// bookmark to continue with, so it is not suited to large ledgers.
+// ============================================================================================================================
+func (t *SimpleChaincode) resetAll(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//   0
+	// "CONFIRM"
+	if err := checkArgCount(args, 1, 1); err != nil {
+		return nil, err
+	}
+	if err := authorizeAdmin(stub); err != nil {
+		return nil, err
+	}
+	if args[0] != resetConfirmation {
+		return nil, newChaincodeError(errCodeBadArgs, "1st argument must be "+strconv.Quote(resetConfirmation)+" to confirm the reset")
+	}
+
+	logger.Warning("- start reset of all state")
+
+	result := DeletionResult{}
+	deleteAll := func(resultsIterator shim.StateQueryIteratorInterface, compositeKeys bool) error {
+		defer resultsIterator.Close()
+		for resultsIterator.HasNext() {
+			queryResponse, err := resultsIterator.Next()
+			if err != nil {
+				return err
+			}
+			// a range over simple keys may list composite keys on some peers, those are
+			// deleted with their object type
+			if isCompositeKey(queryResponse.Key) != compositeKeys {
+				continue
+			}
+			err = stub.DelState(queryResponse.Key)
+			if err != nil {
+				return err
+			}
+			result.Deleted++
+		}
+		return nil
+	}
+
+	resultsIterator, err := stub.GetStateByRange("", "")
+	if err != nil {
+		return nil, err
+	}
+	err = deleteAll(resultsIterator, false)
+	if err != nil {
+		return nil, err
+	}
+
+	// composite keys are not part of the simple key range, every object type is read
+	// on its own
+	objectTypes := []string{deviceRegistryName, deviceRateName, deviceMetaName, deviceLogName, idempotencyKeyName, configName}
+	for indexName := range compositeIndexNames {
+		objectTypes = append(objectTypes, indexName)
+	}
+	for _, objectType := range objectTypes {
+		resultsIterator, err := stub.GetStateByPartialCompositeKey(objectType, []string{})
+		if err != nil {
+			return nil, err
+		}
+		err = deleteAll(resultsIterator, true)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	resultJSONasBytes, err := json.Marshal(result)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Warning("- end reset of all state: " + string(resultJSONasBytes))
+	return resultJSONasBytes, nil
+}
+
+// ============================================================================================================================
+// Soft Delete Entry - mark an entry as deleted without removing it from chaincode state
+// The entry stays in state and in its history, but is hidden from queries unless they
+// explicitly ask for deleted entries.
+// ============================================================================================================================
+func (t *SimpleChaincode) softDeleteEntry(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//   0
+	// "timestamp"
+	if err := checkArgCount(args, 1, 1); err != nil {
+		return nil, err
+	}
+
+	//input sanitation
+	logger.Debug("- start entry soft deletion")
+	if len(args[0]) <= 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "1st argument must be a non-empty string")
+	}
+	timestamp := entryKeyArg(args[0])
+
+	if err := authorizeCreator(stub); err != nil {
+		return nil, err
+	}
+
+	//load the existing entry
+	entryAsBytes, err := stub.GetState(timestamp)
+	if err != nil {
+		return nil, newChaincodeError(errCodeInternal, "Failed to get entry: "+err.Error())
+	} else if entryAsBytes == nil {
+		logger.Info("Cannot delete, entry not found: " + timestamp)
+		return nil, newNotFoundError(timestamp, "Cannot delete, entry not found: "+timestamp)
+	}
+
+	entry := Entry{}
+	err = json.Unmarshal(entryAsBytes, &entry)
+	if err != nil {
+		return nil, err
+	}
+	if entry.Deleted {
+		return nil, newNotFoundError(timestamp, "Cannot delete, entry already deleted: "+timestamp)
+	}
+	entry.Deleted = true
+	entry.Version++
+	entry.DeletedAt, err = getTxTimestampString(stub)
+	if err != nil {
+		return nil, err
+	}
+	entry.LastTxID = stub.GetTxID()
+	err = sealEntry(&entry)
+	if err != nil {
+		return nil, err
+	}
+
+	entryJSONasBytes, err := marshalEntry(&entry)
+	if err != nil {
+		return nil, err
+	}
+
+	// Save entry to state, the index entries stay as they are
+	err = stub.PutState(timestamp, entryJSONasBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info("- end entry soft deletion")
+	return entryJSONasBytes, nil
+}
+
+// ============================================================================================================================
+// Add Tag / Remove Tag - label an entry, e.g. "calibration" or "anomaly", for later filtering
+// Tags are kept sorted and unique. Adding a tag the entry already has, or removing one it
+// does not have, leaves the entry untouched.
+// ============================================================================================================================
+func (t *SimpleChaincode) addTag(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	return updateEntryTags(stub, args, true)
+}
+
+func (t *SimpleChaincode) removeTag(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	return updateEntryTags(stub, args, false)
+}
+
+// =========================================================================================
+// updateEntryTags adds the tag named in args to an entry, or removes it when add is false
+// =========================================================================================
+func updateEntryTags(stub shim.ChaincodeStubInterface, args []string, add bool) ([]byte, error) {
+
+	//   0            1
+	// "timestamp", "tag"
+	if err := checkArgCount(args, 2, 2); err != nil {
+		return nil, err
+	}
+
+	//input sanitation
+	logger.Debug("- start entry tagging")
+	if len(args[0]) <= 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "1st argument must be a non-empty string")
+	}
+	timestamp := entryKeyArg(args[0])
+
+	if err := authorizeCreator(stub); err != nil {
+		return nil, err
+	}
+	tag := args[1]
+	if !tagPattern.MatchString(tag) {
+		return nil, newChaincodeError(errCodeBadArgs, "tag may only contain letters, digits, dashes and underscores: "+strconv.Quote(tag))
+	}
+	if len(tag) > maxNameLength {
+		return nil, newChaincodeError(errCodeBadArgs, fmt.Sprintf("tag must be at most %d bytes long", maxNameLength))
+	}
+
+	//load the existing entry
+	entryAsBytes, err := stub.GetState(timestamp)
+	if err != nil {
+		return nil, newChaincodeError(errCodeInternal, "Failed to get entry: "+err.Error())
+	} else if entryAsBytes == nil {
+		logger.Info("Cannot tag, entry not found: " + timestamp)
+		return nil, newNotFoundError(timestamp, "Cannot tag, entry not found: "+timestamp)
+	}
+
+	entry := Entry{}
+	err = json.Unmarshal(entryAsBytes, &entry)
+	if err != nil {
+		return nil, err
+	}
+	if entry.Deleted {
+		logger.Info("Cannot tag, entry deleted: " + timestamp)
+		return nil, newNotFoundError(timestamp, "Cannot tag, entry deleted: "+timestamp)
+	}
+
+	tagged := false
+	tags := []string{}
+	for _, existing := range entry.Tags {
+		if existing == tag {
+			tagged = true
+			if !add {
+				continue
+			}
+		}
+		tags = append(tags, existing)
+	}
+	if tagged == add {
+		// nothing changes, the entry is not written again
+		return json.Marshal(EntryResponse{TxID: stub.GetTxID(), Entry: entryAsBytes, Unchanged: true})
+	}
+	if add {
+		if len(tags) >= maxTags {
+			return nil, newChaincodeError(errCodeBadArgs, fmt.Sprintf("an entry may have at most %d tags", maxTags))
+		}
+		tags = append(tags, tag)
+		sort.Strings(tags)
+	}
+	entry.Tags = tags
+	entry.Version++
+	entry.LastTxID = stub.GetTxID()
+	err = sealEntry(&entry)
+	if err != nil {
+		return nil, err
+	}
+
+	entryJSONasBytes, err := marshalEntry(&entry)
+	if err != nil {
+		return nil, err
+	}
+
+	// Save entry to state, the index entries stay as they are
+	err = stub.PutState(timestamp, entryJSONasBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info("- end entry tagging")
+	return json.Marshal(EntryResponse{TxID: stub.GetTxID(), Entry: entryJSONasBytes})
+}
+
+// ===== Verify the integrity of an entry =========================================
+// verifyIntegrity recomputes the hash of a stored entry over its canonical form and compares
+// it to the hash stored with the entry. Fabric already prevents tampering with state, a
+// mismatch points at a bug in the chaincode or its migrations that corrupted the entry.
+// Entries written before hashing was introduced have no hash until they are migrated.
+// =========================================================================================
+func (t *SimpleChaincode) verifyIntegrity(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//   0
+	// "timestamp"
+	if err := checkArgCount(args, 1, 1); err != nil {
+		return nil, err
+	}
+	if len(args[0]) <= 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "1st argument must be a non-empty string")
+	}
+	timestamp := entryKeyArg(args[0])
+
+	entryAsBytes, err := stub.GetState(timestamp)
+	if err != nil {
+		return nil, newChaincodeError(errCodeInternal, "Failed to get entry: "+err.Error())
+	} else if entryAsBytes == nil {
+		return nil, newNotFoundError(timestamp, "Entry not found: "+timestamp)
+	}
+	entry := Entry{}
+	err = json.Unmarshal(entryAsBytes, &entry)
+	if err != nil {
+		return nil, newChaincodeError(errCodeInternal, "Failed to decode entry "+timestamp+": "+err.Error())
+	}
+
+	computedHash, err := entryHash(&entry)
+	if err != nil {
+		return nil, err
+	}
+	result := IntegrityResult{entry.Hash, computedHash, entry.Hash == computedHash}
+	if !result.Valid {
+		logger.Warning("Integrity check failed for entry: " + timestamp)
+	}
+
+	return json.Marshal(result)
+}
+
+// ===== Check whether an entry exists ============================================
+// existsEntry tells whether an entry is stored under a timestamp, returning
+// {"exists":true|false}. A missing entry is not an error. Soft-deleted entries still
+// occupy their key and are reported as existing.
+// =========================================================================================
+func (t *SimpleChaincode) existsEntry(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//   0
+	// "timestamp"
+	if err := checkArgCount(args, 1, 1); err != nil {
+		return nil, err
+	}
+	if len(args[0]) <= 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "1st argument must be a non-empty string")
+	}
+	timestamp := entryKeyArg(args[0])
+
+	entryAsBytes, err := stub.GetState(timestamp)
+	if err != nil {
+		return nil, newChaincodeError(errCodeInternal, "Failed to get entry: "+err.Error())
+	}
+
+	return json.Marshal(ExistsResult{entryAsBytes != nil})
+}
+
+// ===== List devices =============================================================
+// listDevices returns the sorted names of all devices having entries, read from the
+// device set index maintained as entries are created and deleted.
+// Works on every state database, no rich query support is needed.
+// =========================================================================================
+func (t *SimpleChaincode) listDevices(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if err := checkArgCount(args, 0, 0); err != nil {
+		return nil, err
+	}
+
+	deviceResultsIterator, err := stub.GetStateByPartialCompositeKey(deviceIndexName, []string{})
+	if err != nil {
+		return nil, err
+	}
+	defer deviceResultsIterator.Close()
+
+	deviceNames := []string{}
+	for deviceResultsIterator.HasNext() {
+		responseRange, err := deviceResultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		indexKey, err := decodeIndexKey(stub, responseRange.Key, deviceIndexName)
+		if err != nil {
+			return nil, err
+		}
+		deviceNames = append(deviceNames, indexKey.DeviceName)
+	}
+	sort.Strings(deviceNames)
+
+	return json.Marshal(deviceNames)
+}
+
+// ===== Query a composite key index, paged =======================================
+// queryCompositeIndex returns one page of the keys of an entry index matching the leading
+// key parts, each decoded back into its parts, together with the bookmark of the next page.
+// Works on every state database, the efficient secondary index lookup on LevelDB.
+// =========================================================================================
+func (t *SimpleChaincode) queryCompositeIndex(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//   0            1           2           3... (optional)
+	// "objectType", "pageSize", "bookmark", "keyPart"...
+	if len(args) < 3 {
+		return nil, newChaincodeError(errCodeBadArgs, "Incorrect number of arguments. Expecting at least 3")
+	}
+	objectType := args[0]
+	if !compositeIndexNames[objectType] {
+		return nil, newChaincodeError(errCodeBadArgs, "1st argument must be the name of an entry index: "+strconv.Quote(objectType))
+	}
+	pageSize, err := strconv.ParseInt(args[1], 10, 32)
+	if err != nil || pageSize <= 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "2nd argument must be a positive integer")
+	}
+	bookmark := args[2]
+	keyParts := args[3:]
+
+	resultsIterator, responseMetadata, err := stub.GetStateByPartialCompositeKeyWithPagination(objectType, keyParts, int32(pageSize), bookmark)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	indexKeys := []CompositeIndexKey{}
+	for resultsIterator.HasNext() {
+		responseRange, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		// reject malformed keys, the response keeps the raw key parts of each index
+		if _, err := decodeIndexKey(stub, responseRange.Key, objectType); err != nil {
+			return nil, err
+		}
+		keyObjectType, compositeKeyParts, err := stub.SplitCompositeKey(responseRange.Key)
+		if err != nil {
+			return nil, err
+		}
+		indexKeys = append(indexKeys, CompositeIndexKey{responseRange.Key, keyObjectType, compositeKeyParts})
+	}
+
+	indexKeysAsBytes, err := json.Marshal(indexKeys)
+	if err != nil {
+		return nil, err
+	}
+	bufferWithPaginationInfo := addPaginationMetadataToQueryResults(bytes.NewBuffer(indexKeysAsBytes), responseMetadata)
+
+	logger.Debugf("- queryCompositeIndex queryResult:\n%s", bufferWithPaginationInfo.String())
+
+	return bufferWithPaginationInfo.Bytes(), nil
+}
+
+// ===== List the attributes of a device ==========================================
+// listAttributesForDevice returns the sorted names of the attributes a device has entries
+// for, read from the device~attr index maintained as entries are created and deleted.
+// Works on every state database, no rich query support is needed.
+// =========================================================================================
+func (t *SimpleChaincode) listAttributesForDevice(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//   0
+	// "deviceName"
+	if err := checkArgCount(args, 1, 1); err != nil {
+		return nil, err
+	}
+	if len(args[0]) <= 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "1st argument must be a non-empty string")
+	}
+	deviceName := args[0]
+	if !deviceNamePattern.MatchString(deviceName) {
+		return nil, newChaincodeError(errCodeBadArgs, "deviceName may only contain letters, digits, dashes and underscores: "+strconv.Quote(deviceName))
+	}
+
+	deviceAttributeResultsIterator, err := stub.GetStateByPartialCompositeKey(deviceAttributeIndexName, []string{deviceName})
+	if err != nil {
+		return nil, err
+	}
+	defer deviceAttributeResultsIterator.Close()
+
+	attributes := []string{}
+	for deviceAttributeResultsIterator.HasNext() {
+		responseRange, err := deviceAttributeResultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		indexKey, err := decodeIndexKey(stub, responseRange.Key, deviceAttributeIndexName)
+		if err != nil {
+			return nil, err
+		}
+		attributes = append(attributes, indexKey.Attribute)
+	}
+	sort.Strings(attributes)
+
+	return json.Marshal(attributes)
+}
+
+// ===== Read a private entry =====================================================
+// readPrivateEntry returns the entry stored under a key in a private data collection.
+// Only peers of the organizations that are members of the collection hold the entry,
+// the query has to be sent to one of them.
+// =========================================================================================
+func (t *SimpleChaincode) readPrivateEntry(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//   0             1
+	// "collection", "timestamp"
+	if err := checkArgCount(args, 2, 2); err != nil {
+		return nil, err
+	}
+	if len(args[0]) <= 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "1st argument must be a non-empty string")
+	}
+	if len(args[1]) <= 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "2nd argument must be a non-empty string")
+	}
+	collection := args[0]
+	timestamp := entryKeyArg(args[1])
+
+	entryAsBytes, err := stub.GetPrivateData(collection, timestamp)
+	if err != nil {
+		return nil, newChaincodeError(errCodeInternal, "Failed to get private entry: "+err.Error())
+	} else if entryAsBytes == nil {
+		return nil, newNotFoundError(timestamp, "Private entry not found: "+timestamp)
+	}
+
+	return entryAsBytes, nil
+}
+
+// ===== Get the log of a device ==================================================
+// getDeviceLog returns the readings appended to the log of a device by appendDeviceLog,
+// oldest first. A device without a log has an empty one.
+// =========================================================================================
+func (t *SimpleChaincode) getDeviceLog(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//   0
+	// "deviceName"
+	if err := checkArgCount(args, 1, 1); err != nil {
+		return nil, err
+	}
+	if len(args[0]) <= 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "1st argument must be a non-empty string")
+	}
+	deviceName := args[0]
+
+	logKey, err := stub.CreateCompositeKey(deviceLogName, []string{deviceName})
+	if err != nil {
+		return nil, err
+	}
+	deviceLog, err := readDeviceLog(stub, logKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(deviceLog)
+}
+
+// ===== Get the metadata of a device =============================================
+// getDeviceMeta returns the display metadata stored for a device by setDeviceMeta
+// =========================================================================================
+func (t *SimpleChaincode) getDeviceMeta(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//   0
+	// "deviceName"
+	if err := checkArgCount(args, 1, 1); err != nil {
+		return nil, err
+	}
+	if len(args[0]) <= 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "1st argument must be a non-empty string")
+	}
+	deviceName := args[0]
+
+	metaKey, err := stub.CreateCompositeKey(deviceMetaName, []string{deviceName})
+	if err != nil {
+		return nil, err
+	}
+	metaAsBytes, err := stub.GetState(metaKey)
+	if err != nil {
+		return nil, newChaincodeError(errCodeInternal, "Failed to get device meta: "+err.Error())
+	} else if metaAsBytes == nil {
+		return nil, newNotFoundError(deviceName, "No metadata for device: "+deviceName)
+	}
+
+	return metaAsBytes, nil
+}
+
+// ===== Get an entry with its metadata ===========================================
+// getEntryWithMeta returns the entry stored under a timestamp. When the optional second
+// argument is true the number of modifications recorded in the key's history is added,
+// counting it walks the whole history of the key so it is only done on request.
+// =========================================================================================
+func (t *SimpleChaincode) getEntryWithMeta(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//   0            1 (optional)
+	// "timestamp", "includeHistoryCount"
+	if err := checkArgCount(args, 1, 2); err != nil {
+		return nil, err
+	}
+	if len(args[0]) <= 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "1st argument must be a non-empty string")
+	}
+	timestamp := entryKeyArg(args[0])
+	includeHistoryCount := false
+	if len(args) == 2 {
+		var err error
+		includeHistoryCount, err = strconv.ParseBool(args[1])
+		if err != nil {
+			return nil, newChaincodeError(errCodeBadArgs, "includeHistoryCount must be true or false: "+args[1])
+		}
+	}
+
+	entryAsBytes, err := stub.GetState(timestamp)
+	if err != nil {
+		return nil, newChaincodeError(errCodeInternal, "Failed to get entry: "+err.Error())
+	} else if entryAsBytes == nil {
+		return nil, newNotFoundError(timestamp, "Entry not found: "+timestamp)
+	}
+
+	result := EntryWithMeta{Entry: entryAsBytes}
+	if includeHistoryCount {
+		resultsIterator, err := stub.GetHistoryForKey(timestamp)
+		if err != nil {
+			return nil, err
+		}
+		defer resultsIterator.Close()
+
+		historyCount := 0
+		for resultsIterator.HasNext() {
+			_, err := resultsIterator.Next()
+			if err != nil {
+				return nil, err
+			}
+			historyCount++
+		}
+		result.HistoryCount = &historyCount
+	}
+
+	return json.Marshal(result)
+}
+
+// ===== Get the provenance of an entry ===========================================
+// getEntryProvenance returns the entry stored under a key together with its provenance
+// fields in one place: the creating client, the creating transaction's time, the last
+// transaction that wrote it and its version. Endorsements are not visible to chaincode,
+// LastTxID is the handle to look them up in the block of that transaction. Entries
+// written before provenance was recorded have empty fields.
+// =========================================================================================
+func (t *SimpleChaincode) getEntryProvenance(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//   0
+	// "timestamp"
+	if err := checkArgCount(args, 1, 1); err != nil {
+		return nil, err
+	}
+	if len(args[0]) <= 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "1st argument must be a non-empty string")
+	}
+	timestamp := entryKeyArg(args[0])
+
+	entryAsBytes, err := stub.GetState(timestamp)
+	if err != nil {
+		return nil, newChaincodeError(errCodeInternal, "Failed to get entry: "+err.Error())
+	} else if entryAsBytes == nil {
+		return nil, newNotFoundError(timestamp, "Entry not found: "+timestamp)
+	}
+	entry := Entry{}
+	err = json.Unmarshal(entryAsBytes, &entry)
+	if err != nil {
+		return nil, newChaincodeError(errCodeInternal, "Failed to decode entry "+timestamp+": "+err.Error())
+	}
+
+	return json.Marshal(EntryProvenance{timestamp, entry.CreatedBy, entry.TxTimestamp, entry.LastTxID, entry.Version, entryAsBytes})
+}
+
+// ===== Read several entries =====================================================
+// readEntries returns the entries stored under the timestamps of a JSON array, in the order
+// of the array. A timestamp without an entry yields null rather than failing the read, at
+// most maxEntriesPerRead entries are read in one call.
+// =========================================================================================
+func (t *SimpleChaincode) readEntries(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//   0
+	// "[\"timestamp\", \"timestamp\", ...]"
+	if err := checkArgCount(args, 1, 1); err != nil {
+		return nil, err
+	}
+	var timestamps []string
+	err := json.Unmarshal([]byte(args[0]), &timestamps)
+	if err != nil {
+		return nil, newChaincodeError(errCodeBadArgs, "1st argument must be a JSON array of timestamps: "+err.Error())
+	}
+	if len(timestamps) == 0 || len(timestamps) > maxEntriesPerRead {
+		return nil, newChaincodeError(errCodeBadArgs, fmt.Sprintf("between 1 and %d timestamps must be passed", maxEntriesPerRead))
+	}
+
+	entries := make([]json.RawMessage, len(timestamps))
+	for i, timestamp := range timestamps {
+		if len(timestamp) <= 0 || isCompositeKey(timestamp) {
+			return nil, newChaincodeError(errCodeBadArgs, "timestamps must be non-empty entry keys: "+strconv.Quote(timestamp))
+		}
+		entryAsBytes, err := stub.GetState(entryKeyArg(timestamp))
+		if err != nil {
+			return nil, newChaincodeError(errCodeInternal, "Failed to get entry: "+err.Error())
+		}
+		if entryAsBytes != nil {
+			entries[i] = entryAsBytes
+		}
+	}
+
+	return json.Marshal(entries)
+}
+
+// ===== Get the most recent entries ==============================================
+// recentEntries returns the newest entries across all devices, most recent first, using
+// a descending sort on the timestamp index. At most maxRecentEntries may be requested.
+// Only available on state databases that support rich query (e.g. CouchDB)
+// =========================================================================================
+func (t *SimpleChaincode) recentEntries(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//   0
+	// "count"
+	if err := checkArgCount(args, 1, 1); err != nil {
+		return nil, err
+	}
+	count, err := strconv.Atoi(args[0])
+	if err != nil || count <= 0 || count > maxRecentEntries {
+		return nil, newChaincodeError(errCodeBadArgs, fmt.Sprintf("1st argument must be an integer between 1 and %d", maxRecentEntries))
+	}
+
+	// sorting requires every matched document to have the sort field, hence the $gt null condition
+	query := newRichQuery(map[string]interface{}{"timestamp": map[string]interface{}{"$gt": nil}}, false)
+	query.Sort = []map[string]string{{"timestamp": "desc"}}
+	query.UseIndex = []string{"_design/indexTimestampDoc", "indexTimestamp"}
+	query.Limit = count
+
+	queryResults, err := getQueryResultForQueryString(stub, query.String())
+	if err != nil {
+		return nil, err
+	}
+	return queryResults, nil
+}
+
+// ===== Get all entries ==========================================================
+// getAllEntries returns every entry in state, index entries are left out.
+// This scans the whole key space and buffers the complete result, which is
+// expensive on large ledgers. It is intended for admin tooling such as migrations
+// and debugging only.
+// =========================================================================================
+func (t *SimpleChaincode) getAllEntries(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//   0 (optional)
+	// "includeDeleted"
+	if err := checkArgCount(args, 0, 1); err != nil {
+		return nil, err
+	}
+	includeDeleted, err := parseIncludeDeleted(args, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Debug("- start getAllEntries")
+
+	resultsIterator, err := stub.GetStateByRange("", "")
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	buffer, err := constructQueryResponseFromIterator(filterDeleted(resultsIterator, includeDeleted))
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Debugf("- getAllEntries queryResult:\n%s", buffer.String())
+
+	return buffer.Bytes(), nil
+}
+
+// ===== Get all entries, paged ===================================================
+// getAllEntriesPaged returns the entries in state one page at a time, together with the
+// bookmark of the next page. Index entries are left out of the records, so a page may
+// hold fewer records than the fetched records count.
+// Works on every state database, no rich query support is needed.
+// =========================================================================================
+func (t *SimpleChaincode) getAllEntriesPaged(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//   0           1 (optional)  2 (optional)
+	// "pageSize", "bookmark",    "includeDeleted"
+	if err := checkArgCount(args, 1, 3); err != nil {
+		return nil, err
+	}
+	pageSize, err := strconv.ParseInt(args[0], 10, 32)
+	if err != nil || pageSize <= 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "1st argument must be a positive integer")
+	}
+	bookmark := ""
+	if len(args) > 1 {
+		bookmark = args[1]
+	}
+	includeDeleted, err := parseIncludeDeleted(args, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	resultsIterator, responseMetadata, err := stub.GetStateByRangeWithPagination("", "", int32(pageSize), bookmark)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	buffer, err := constructQueryResponseFromIterator(filterDeleted(resultsIterator, includeDeleted))
+	if err != nil {
+		return nil, err
+	}
+
+	bufferWithPaginationInfo := addPaginationMetadataToQueryResults(buffer, responseMetadata)
+
+	logger.Debugf("- getAllEntriesPaged queryResult:\n%s", bufferWithPaginationInfo.String())
+
+	return bufferWithPaginationInfo.Bytes(), nil
+}
+
+// ===== Query entries by time range ==============================================
+// getEntriesByTimeRange performs a range query on the entry keys. Since the keys are
+// fixed width timestamps they sort chronologically, so a key range is a time window.
+// The start key is inclusive whereas the end key is exclusive, as per Fabric semantics.
+// Range queries always iterate in ascending key order, so a descending result is built by
+// buffering the whole range in memory and emitting it in reverse. The buffer is capped at
+// maxQueryResults records, larger ranges have to be narrowed or read in ascending order.
+// Works on every state database, no rich query support is needed.
+// =========================================================================================
+func (t *SimpleChaincode) getEntriesByTimeRange(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//   0                 1               2 (optional)      3 (optional)
+	// "startTimestamp", "endTimestamp", "includeDeleted", "descending"
+	if err := checkArgCount(args, 2, 4); err != nil {
+		return nil, err
+	}
+	if len(args[0]) <= 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "1st argument must be a non-empty string")
+	}
+	if len(args[1]) <= 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "2nd argument must be a non-empty string")
+	}
+	includeDeleted, err := parseIncludeDeleted(args, 2)
+	if err != nil {
+		return nil, err
+	}
+	descending := false
+	if len(args) == 4 {
+		descending, err = strconv.ParseBool(args[3])
+		if err != nil {
+			return nil, newChaincodeError(errCodeBadArgs, "descending must be true or false: "+args[3])
+		}
+	}
+
+	if err := checkKeyScheme(keySchemeTimestamp, "byTimeRange"); err != nil {
+		return nil, err
+	}
+	// keys hold normalized timestamps, the bounds are normalized alike
+	startTimestamp, endTimestamp, err := normalizeTimeRange(args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	resultsIterator, err := stub.GetStateByRange(startTimestamp, endTimestamp)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	entriesIterator := filterDeleted(resultsIterator, includeDeleted)
+	if descending {
+		entriesIterator, err = reverseResults(entriesIterator)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	buffer, err := constructQueryResponseFromIterator(entriesIterator)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Debugf("- getEntriesByTimeRange queryResult:\n%s", buffer.String())
+
+	return buffer.Bytes(), nil
+}
+
+// ===== Query the entries of a device by time range ==============================
+// getDeviceEntriesByTimeRange performs a range query on the keys of one device. Under the
+// device key scheme these are deviceName_timestamp, the keys of a device are therefore
+// contiguous and sort chronologically. The start time is inclusive, the end time exclusive.
+// Only available with entryKeyScheme set to keySchemeDevice.
+// Works on every state database, no rich query support is needed.
+// =========================================================================================
+func (t *SimpleChaincode) getDeviceEntriesByTimeRange(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//   0             1           2          3 (optional)
+	// "deviceName", "startTime", "endTime", "includeDeleted"
+	if err := checkArgCount(args, 3, 4); err != nil {
+		return nil, err
+	}
+	if len(args[0]) <= 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "1st argument must be a non-empty string")
+	}
+	if err := checkKeyScheme(keySchemeDevice, "deviceByTimeRange"); err != nil {
+		return nil, err
+	}
+	deviceName := args[0]
+	if !deviceNamePattern.MatchString(deviceName) || strings.Contains(deviceName, entryKeySeparator) {
+		return nil, newChaincodeError(errCodeBadArgs, "deviceName may only contain letters, digits and dashes: "+strconv.Quote(deviceName))
+	}
+	// keys hold normalized timestamps, the bounds are normalized alike
+	startTime, endTime, err := normalizeTimeRange(args[1], args[2])
+	if err != nil {
+		return nil, err
+	}
+	includeDeleted, err := parseIncludeDeleted(args, 3)
+	if err != nil {
+		return nil, err
+	}
+
+	startKey := entryKey(deviceName, startTime)
+	endKey := entryKey(deviceName, endTime)
+
+	resultsIterator, err := stub.GetStateByRange(startKey, endKey)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	buffer, err := constructQueryResponseFromIterator(filterDeleted(resultsIterator, includeDeleted))
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Debugf("- getDeviceEntriesByTimeRange queryResult:\n%s", buffer.String())
+
+	return buffer.Bytes(), nil
+}
+
+// ===== Query the entries of a device by time bucket =============================
+// getDeviceEntriesByTimeBucket returns the entries of a device within a time window, read
+// through the device~bucket~time index: the buckets overlapping the window are scanned and
+// only the entries they list are loaded. The start time is inclusive, the end time exclusive,
+// the window may span at most maxBucketsPerQuery buckets of timeBucketSize.
+// Works on every state database and with either entry key scheme.
+// =========================================================================================
+func (t *SimpleChaincode) getDeviceEntriesByTimeBucket(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//   0             1            2          3 (optional)
+	// "deviceName", "startTime", "endTime", "includeDeleted"
+	if err := checkArgCount(args, 3, 4); err != nil {
+		return nil, err
+	}
+	if len(args[0]) <= 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "1st argument must be a non-empty string")
+	}
+	deviceName := args[0]
+	startTimestamp, endTimestamp, err := normalizeTimeRange(args[1], args[2])
+	if err != nil {
+		return nil, err
+	}
+	includeDeleted, err := parseIncludeDeleted(args, 3)
+	if err != nil {
+		return nil, err
+	}
+	startTime, _ := time.Parse(time.RFC3339, startTimestamp)
+	endTime, _ := time.Parse(time.RFC3339, endTimestamp)
+
+	firstBucket := startTime.UTC().Truncate(timeBucketSize)
+	if endTime.Sub(firstBucket) > maxBucketsPerQuery*timeBucketSize {
+		return nil, newChaincodeError(errCodeBadArgs, fmt.Sprintf("the time window may span at most %d buckets of %s", maxBucketsPerQuery, timeBucketSize))
+	}
+
+	var results []*queryresult.KV
+	for bucket := firstBucket; bucket.Before(endTime); bucket = bucket.Add(timeBucketSize) {
+		bucketResultsIterator, err := stub.GetStateByPartialCompositeKey(deviceBucketIndexName, []string{deviceName, normalizeTimestamp(bucket)})
+		if err != nil {
+			return nil, err
+		}
+		for bucketResultsIterator.HasNext() {
+			responseRange, err := bucketResultsIterator.Next()
+			if err != nil {
+				bucketResultsIterator.Close()
+				return nil, err
+			}
+			indexKey, err := decodeIndexKey(stub, responseRange.Key, deviceBucketIndexName)
+			if err != nil {
+				bucketResultsIterator.Close()
+				return nil, err
+			}
+			timestamp := indexKey.Timestamp
+			entryTime, err := time.Parse(time.RFC3339Nano, timestamp)
+			if err != nil || entryTime.Before(startTime) || !entryTime.Before(endTime) {
+				continue
+			}
+
+			key := entryKey(deviceName, timestamp)
+			entryAsBytes, err := stub.GetState(key)
+			if err != nil {
+				bucketResultsIterator.Close()
+				return nil, newChaincodeError(errCodeInternal, "Failed to get entry: "+err.Error())
+			}
+			if entryAsBytes == nil {
+				continue // stale index entry
+			}
+			if len(results) >= maxQueryResults {
+				bucketResultsIterator.Close()
+				return nil, newChaincodeError(errCodeResultLimit, fmt.Sprintf("Window matches more than %d records, narrow the window", maxQueryResults))
+			}
+			results = append(results, &queryresult.KV{Key: key, Value: entryAsBytes})
+		}
+		bucketResultsIterator.Close()
+	}
+
+	buffer, err := constructQueryResponseFromIterator(filterDeleted(&sliceStateIterator{results: results}, includeDeleted))
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Debugf("- getDeviceEntriesByTimeBucket queryResult:\n%s", buffer.String())
+
+	return buffer.Bytes(), nil
+}
+
+// ===== Query timestamps by device and attribute =================================
+// getTimestampsByDeviceAttribute lists the timestamps of all entries of a device
+// and attribute using the device~attr~time composite key index.
+// Works on every state database, no rich query support is needed.
+// =========================================================================================
+func (t *SimpleChaincode) getTimestampsByDeviceAttribute(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//   0             1
+	// "deviceName", "attribute"
+	if err := checkArgCount(args, 2, 2); err != nil {
+		return nil, err
+	}
+	if len(args[0]) <= 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "1st argument must be a non-empty string")
+	}
+	if len(args[1]) <= 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "2nd argument must be a non-empty string")
+	}
+
+	deviceName := args[0]
+	attribute := args[1]
+
+	// Query the device~attr~time index by device and attribute
+	// This will execute a key range query on all keys starting with 'deviceName~attribute'
+	deviceAttrResultsIterator, err := stub.GetStateByPartialCompositeKey(deviceAttrIndexName, []string{deviceName, attribute})
+	if err != nil {
+		return nil, err
+	}
+	defer deviceAttrResultsIterator.Close()
+
+	// buffer is a JSON array containing the timestamps
+	var buffer bytes.Buffer
+	buffer.WriteString("[")
+
+	bArrayMemberAlreadyWritten := false
+	for deviceAttrResultsIterator.HasNext() {
+		responseRange, err := deviceAttrResultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		// get the device, attribute and timestamp from device~attr~time composite key
+		indexKey, err := decodeIndexKey(stub, responseRange.Key, deviceAttrIndexName)
+		if err != nil {
+			return nil, err
+		}
+		returnedTimestamp := indexKey.Timestamp
+
+		// Add a comma before array members, suppress it for the first array member
+		if bArrayMemberAlreadyWritten == true {
+			buffer.WriteString(",")
+		}
+		writeJSONString(&buffer, returnedTimestamp)
+		bArrayMemberAlreadyWritten = true
+	}
+	buffer.WriteString("]")
+
+	logger.Debugf("- getTimestampsByDeviceAttribute queryResult:\n%s", buffer.String())
+
+	return buffer.Bytes(), nil
+}
+
+// ===== Query entries by device ==================================================
+// queryByDevice queries for entries based on a passed in device name.
+// This is an example of a parameterized query where the query logic is baked into the chaincode,
+// and accepting a single query parameter (deviceName).
+// Only available on state databases that support rich query (e.g. CouchDB)
+// =========================================================================================
+func (t *SimpleChaincode) queryByDevice(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//   0             1 (optional)
+	// "deviceName", "includeDeleted"
+	if err := checkArgCount(args, 1, 2); err != nil {
+		return nil, err
+	}
+	if len(args[0]) <= 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "1st argument must be a non-empty string")
+	}
+	includeDeleted, err := parseIncludeDeleted(args, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	deviceName := args[0]
+
+	queryString := newRichQuery(map[string]interface{}{"deviceName": deviceName}, includeDeleted).String()
+
+	queryResults, err := getQueryResultForQueryString(stub, queryString)
+	if err != nil {
+		return nil, err
+	}
+	return queryResults, nil
+}
+
+// ===== Query entries by tag =====================================================
+// queryByTag queries for the entries labelled with a tag
+// Only available on state databases that support rich query (e.g. CouchDB)
+// =========================================================================================
+func (t *SimpleChaincode) queryByTag(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//   0      1 (optional)
+	// "tag", "includeDeleted"
+	if err := checkArgCount(args, 1, 2); err != nil {
+		return nil, err
+	}
+	if !tagPattern.MatchString(args[0]) {
+		return nil, newChaincodeError(errCodeBadArgs, "tag may only contain letters, digits, dashes and underscores: "+strconv.Quote(args[0]))
+	}
+	includeDeleted, err := parseIncludeDeleted(args, 1)
+	if err != nil {
+		return nil, err
+	}
+	tag := args[0]
+
+	queryString := newRichQuery(map[string]interface{}{
+		"tags": map[string]interface{}{"$elemMatch": map[string]interface{}{"$eq": tag}},
+	}, includeDeleted).String()
+
+	return getQueryResultForQueryString(stub, queryString)
+}
+
+// ===== Query entries by value pattern ===========================================
+// queryByValuePattern queries for the entries of an attribute whose value matches a regular
+// expression. The pattern is checked with Go's regexp before it is sent, CouchDB evaluates
+// it with its own (PCRE) engine, so the syntax both share is the one to rely on. Only
+// values stored as JSON strings can match.
+// Only available on state databases that support rich query (e.g. CouchDB)
+// =========================================================================================
+func (t *SimpleChaincode) queryByValuePattern(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//   0            1          2 (optional)
+	// "attribute", "pattern", "includeDeleted"
+	if err := checkArgCount(args, 2, 3); err != nil {
+		return nil, err
+	}
+	if len(args[0]) <= 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "1st argument must be a non-empty string")
+	}
+	if len(args[1]) <= 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "2nd argument must be a non-empty string")
+	}
+	if len(args[1]) > maxNameLength {
+		return nil, newChaincodeError(errCodeBadArgs, fmt.Sprintf("pattern must be at most %d bytes long", maxNameLength))
+	}
+	_, err := regexp.Compile(args[1])
+	if err != nil {
+		return nil, newChaincodeError(errCodeBadArgs, "2nd argument must be a valid regular expression: "+err.Error())
+	}
+	includeDeleted, err := parseIncludeDeleted(args, 2)
+	if err != nil {
+		return nil, err
+	}
+	attribute := args[0]
+	pattern := args[1]
+
+	queryString := newRichQuery(map[string]interface{}{
+		"attribute":      attribute,
+		"attributeValue": map[string]interface{}{"$regex": pattern},
+	}, includeDeleted).String()
+
+	return getQueryResultForQueryString(stub, queryString)
+}
+
+// ===== Query entries by transaction =============================================
+// queryByTxID returns the entries last written by a transaction, soft-deleted ones included.
+// Entries are found by their lastTxId field: entries deleted by the transaction and entries
+// overwritten by a later transaction are not returned, the history of a key has those.
+// Only available on state databases that support rich query (e.g. CouchDB)
+// =========================================================================================
+func (t *SimpleChaincode) queryByTxID(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//   0
+	// "txId"
+	if err := checkArgCount(args, 1, 1); err != nil {
+		return nil, err
+	}
+	if len(args[0]) <= 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "1st argument must be a non-empty string")
+	}
+	txID := args[0]
+
+	queryString := newRichQuery(map[string]interface{}{"lastTxId": txID}, true).String()
+
+	return getQueryResultForQueryString(stub, queryString)
+}
+
+// ===== Chaincode info ===========================================================
+// getInfo returns the version and build time of the deployed chaincode together with
+// the functions it supports, for readiness checks and introspection
+// =========================================================================================
+func (t *SimpleChaincode) getInfo(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if err := checkArgCount(args, 0, 0); err != nil {
+		return nil, err
+	}
+
+	info := ChaincodeInfo{
+		Version:         chaincodeVersion,
+		BuildTimestamp:  buildTimestamp,
+		InvokeFunctions: []string{"init"},
+		QueryFunctions:  []string{},
+	}
+	for function := range t.invokeFunctions {
+		info.InvokeFunctions = append(info.InvokeFunctions, function)
+	}
+	for function := range t.queryFunctions {
+		info.QueryFunctions = append(info.QueryFunctions, function)
+	}
+	sort.Strings(info.InvokeFunctions)
+	sort.Strings(info.QueryFunctions)
+
+	infoJSONasBytes, err := json.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	return infoJSONasBytes, nil
+}
+
+// ===== Entry schema =============================================================
+// describeSchema returns the fields of the Entry struct as stored in state, read from the
+// struct itself so that clients generating code follow new fields without a change here
+// =========================================================================================
+func (t *SimpleChaincode) describeSchema(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if err := checkArgCount(args, 0, 0); err != nil {
+		return nil, err
+	}
+
+	entryType := reflect.TypeOf(Entry{})
+	schema := EntrySchema{Type: entryType.Name(), Fields: schemaFields(entryType)}
+	return json.Marshal(schema)
+}
+
+// =========================================================================================
+// schemaFields describes the JSON encoded fields of a struct type in declaration order,
+// unexported fields and fields tagged "-" are left out like the JSON encoder does
+// =========================================================================================
+func schemaFields(structType reflect.Type) []SchemaField {
+	fields := []SchemaField{}
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		tagParts := strings.Split(tag, ",")
+		schemaField := SchemaField{Name: field.Name, JSONName: tagParts[0], Type: field.Type.String()}
+		if schemaField.JSONName == "" {
+			schemaField.JSONName = field.Name
+		}
+		for _, option := range tagParts[1:] {
+			if option == "omitempty" {
+				schemaField.OmitEmpty = true
+			}
+		}
+
+		fieldType := field.Type
+		if fieldType.Kind() == reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+		if fieldType.Kind() == reflect.Struct {
+			schemaField.Fields = schemaFields(fieldType)
+		}
+		fields = append(fields, schemaField)
+	}
+	return fields
+}
+
+// ===== Snapshot of a device =====================================================
+// deviceSnapshot returns a JSON object mapping each attribute of a device to its most
+// recent entry. The entries of the device are queried and reduced to the latest one per
+// attribute, soft-deleted entries are left out.
+// Only available on state databases that support rich query (e.g. CouchDB)
+// =========================================================================================
+func (t *SimpleChaincode) deviceSnapshot(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//   0
+	// "deviceName"
+	if err := checkArgCount(args, 1, 1); err != nil {
+		return nil, err
+	}
+	if len(args[0]) <= 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "1st argument must be a non-empty string")
+	}
+	deviceName := args[0]
+
+	queryString := newRichQuery(map[string]interface{}{"deviceName": deviceName}, false).String()
+
+	logger.Debugf("- deviceSnapshot queryString:\n%s", queryString)
+
+	resultsIterator, err := stub.GetQueryResult(queryString)
+	if err != nil {
+		return nil, richQueryError(err)
+	}
+	defer resultsIterator.Close()
+
+	latest := make(map[string]json.RawMessage)
+	latestTimes := make(map[string]time.Time)
+	limitedIterator := &limitedStateIterator{resultsIterator, maxQueryResults, false}
+	for limitedIterator.HasNext() {
+		queryResponse, err := limitedIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		if isCompositeKey(queryResponse.Key) {
+			continue
+		}
+		entry := Entry{}
+		err = json.Unmarshal(queryResponse.Value, &entry)
+		if err != nil {
+			return nil, newChaincodeError(errCodeInternal, "Failed to decode entry "+queryResponse.Key+": "+err.Error())
+		}
+		timestamp, err := time.Parse(time.RFC3339, entry.Timestamp)
+		if err != nil {
+			continue
+		}
+		if latestTime, ok := latestTimes[entry.Attribute]; ok && !timestamp.After(latestTime) {
+			continue
+		}
+		latest[entry.Attribute] = json.RawMessage(queryResponse.Value)
+		latestTimes[entry.Attribute] = timestamp
+	}
+	if limitedIterator.truncated {
+		return nil, newChaincodeError(errCodeResultLimit, fmt.Sprintf("Device has more than %d entries, a snapshot cannot be taken", maxQueryResults))
+	}
+
+	snapshotJSONasBytes, err := json.Marshal(latest)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Debugf("- deviceSnapshot queryResult:\n%s", string(snapshotJSONasBytes))
+
+	return snapshotJSONasBytes, nil
+}
+
+// ===== Query entries of several devices =========================================
+// queryByDevices queries for the entries of any of the devices named in a JSON array,
+// at most maxDevicesPerQuery devices are accepted in one call.
+// Only available on state databases that support rich query (e.g. CouchDB)
+// =========================================================================================
+func (t *SimpleChaincode) queryByDevices(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//   0                                        1 (optional)
+	// "[\"deviceName\", \"deviceName\", ...]", "includeDeleted"
+	if err := checkArgCount(args, 1, 2); err != nil {
+		return nil, err
+	}
+	var deviceNames []string
+	err := json.Unmarshal([]byte(args[0]), &deviceNames)
+	if err != nil {
+		return nil, newChaincodeError(errCodeBadArgs, "1st argument must be a JSON array of device names: "+err.Error())
+	}
+	if len(deviceNames) == 0 || len(deviceNames) > maxDevicesPerQuery {
+		return nil, newChaincodeError(errCodeBadArgs, fmt.Sprintf("between 1 and %d device names must be passed", maxDevicesPerQuery))
+	}
+	for _, deviceName := range deviceNames {
+		if !deviceNamePattern.MatchString(deviceName) {
+			return nil, newChaincodeError(errCodeBadArgs, "deviceName may only contain letters, digits, dashes and underscores: "+strconv.Quote(deviceName))
+		}
+	}
+	includeDeleted, err := parseIncludeDeleted(args, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	queryString := newRichQuery(map[string]interface{}{"deviceName": map[string]interface{}{"$in": deviceNames}}, includeDeleted).String()
+
+	queryResults, err := getQueryResultForQueryString(stub, queryString)
+	if err != nil {
+		return nil, err
+	}
+	return queryResults, nil
+}
+
+// ===== Query entries by attribute ===============================================
+// queryByAttribute queries for entries of every device based on a passed in attribute.
+// Only available on state databases that support rich query (e.g. CouchDB)
+// =========================================================================================
+func (t *SimpleChaincode) queryByAttribute(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//   0            1 (optional)
+	// "attribute", "includeDeleted"
+	if err := checkArgCount(args, 1, 2); err != nil {
+		return nil, err
+	}
+	if len(args[0]) <= 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "1st argument must be a non-empty string")
+	}
+	includeDeleted, err := parseIncludeDeleted(args, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	attribute := args[0]
+
+	queryString := newRichQuery(map[string]interface{}{"attribute": attribute}, includeDeleted).String()
+
+	queryResults, err := getQueryResultForQueryString(stub, queryString)
+	if err != nil {
+		return nil, err
+	}
+	return queryResults, nil
+}
+
+// ===== Query entries by device, attribute and time range ========================
+// queryByDeviceAttributeRange queries for the entries of a device attribute within a
+// time window. Both ends of the window are inclusive.
+// Only available on state databases that support rich query (e.g. CouchDB)
+// =========================================================================================
+func (t *SimpleChaincode) queryByDeviceAttributeRange(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//   0             1            2            3          4 (optional)
+	// "deviceName", "attribute", "startTime", "endTime", "includeDeleted"
+	if err := checkArgCount(args, 4, 5); err != nil {
+		return nil, err
+	}
+	if len(args[0]) <= 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "1st argument must be a non-empty string")
+	}
+	if len(args[1]) <= 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "2nd argument must be a non-empty string")
+	}
+	startTime, endTime, err := normalizeTimeRange(args[2], args[3])
+	if err != nil {
+		return nil, err
+	}
+	includeDeleted, err := parseIncludeDeleted(args, 4)
+	if err != nil {
+		return nil, err
+	}
+
+	deviceName := args[0]
+	attribute := args[1]
+
+	queryString := deviceAttributeRangeQuery(deviceName, attribute, startTime, endTime, includeDeleted)
+
+	queryResults, err := getQueryResultForQueryString(stub, queryString)
+	if err != nil {
+		return nil, err
+	}
+	return queryResults, nil
+}
+
+// =========================================================================================
+// deviceAttributeRangeQuery builds the rich query selecting the entries of a device
+// attribute within a time window, both ends inclusive
+// =========================================================================================
+func deviceAttributeRangeQuery(deviceName string, attribute string, startTime string, endTime string, includeDeleted bool) string {
+	return newRichQuery(map[string]interface{}{
+		"deviceName": deviceName,
+		"attribute":  attribute,
+		"timestamp":  timeRangeCondition(startTime, endTime),
+	}, includeDeleted).String()
+}
+
+// ===== Aggregate a numeric attribute ============================================
+// aggregateAttribute computes count, min, max, sum and average over the values of a
+// device attribute within a time window, both ends inclusive. Values that are not
+// numeric are skipped and counted separately. A window of more than maxQueryResults
+// entries fails with RESULT_LIMIT_EXCEEDED.
+// Only available on state databases that support rich query (e.g. CouchDB)
+// =========================================================================================
+func (t *SimpleChaincode) aggregateAttribute(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//   0             1            2            3
+	// "deviceName", "attribute", "startTime", "endTime"
+	if err := checkArgCount(args, 4, 4); err != nil {
+		return nil, err
+	}
+	if len(args[0]) <= 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "1st argument must be a non-empty string")
+	}
+	if len(args[1]) <= 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "2nd argument must be a non-empty string")
+	}
+	startTime, endTime, err := normalizeTimeRange(args[2], args[3])
+	if err != nil {
+		return nil, err
+	}
+
+	deviceName := args[0]
+	attribute := args[1]
+
+	queryString := deviceAttributeRangeQuery(deviceName, attribute, startTime, endTime, false)
+
+	logger.Debugf("- aggregateAttribute queryString:\n%s", queryString)
+
+	resultsIterator, err := stub.GetQueryResult(queryString)
+	if err != nil {
+		return nil, richQueryError(err)
+	}
+	defer resultsIterator.Close()
+
+	aggregate := Aggregate{}
+	limitedIterator := &limitedStateIterator{resultsIterator, maxQueryResults, false}
+	for limitedIterator.HasNext() {
+		queryResponse, err := limitedIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		if isCompositeKey(queryResponse.Key) {
+			continue
+		}
+		entry := Entry{}
+		err = json.Unmarshal(queryResponse.Value, &entry)
+		if err != nil {
+			aggregate.Skipped++
+			continue
+		}
+		value, ok := numericValue(&entry)
+		if !ok {
+			aggregate.Skipped++
+			continue
+		}
+		if aggregate.Count == 0 || value < *aggregate.Min {
+			aggregate.Min = &value
+		}
+		if aggregate.Count == 0 || value > *aggregate.Max {
+			aggregate.Max = &value
+		}
+		aggregate.Sum += value
+		aggregate.Count++
+	}
+	if limitedIterator.truncated {
+		return nil, newChaincodeError(errCodeResultLimit, fmt.Sprintf("Window matches more than %d records, narrow the time window", maxQueryResults))
+	}
+	if aggregate.Count > 0 {
+		avg := aggregate.Sum / float64(aggregate.Count)
+		aggregate.Avg = &avg
+	}
+
+	aggregateJSONasBytes, err := json.Marshal(aggregate)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Debugf("- aggregateAttribute queryResult:\n%s", string(aggregateJSONasBytes))
+
+	return aggregateJSONasBytes, nil
+}
+
+// ===== Deltas of a numeric attribute ============================================
+// deltaSeries returns the change between consecutive numeric readings of a device
+// attribute within a time window, both ends inclusive, ordered by timestamp. Readings
+// that are not numeric are skipped, counted and flagged as a gap on the next delta.
+// Only available on state databases that support rich query (e.g. CouchDB)
+// =========================================================================================
+func (t *SimpleChaincode) deltaSeries(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//   0             1            2            3
+	// "deviceName", "attribute", "startTime", "endTime"
+	if err := checkArgCount(args, 4, 4); err != nil {
+		return nil, err
+	}
+	if len(args[0]) <= 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "1st argument must be a non-empty string")
+	}
+	if len(args[1]) <= 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "2nd argument must be a non-empty string")
+	}
+	startTime, endTime, err := normalizeTimeRange(args[2], args[3])
+	if err != nil {
+		return nil, err
+	}
+
+	deviceName := args[0]
+	attribute := args[1]
+
+	readings, err := queryReadings(stub, deviceName, attribute, startTime, endTime)
+	if err != nil {
+		return nil, err
+	}
+
+	series := DeltaSeries{Deltas: []Delta{}}
+	var previous *reading
+	gap := false
+	for i := range readings {
+		if !readings[i].numeric {
+			series.Skipped++
+			gap = previous != nil
+			continue
+		}
+		if previous != nil {
+			series.Deltas = append(series.Deltas, Delta{
+				Timestamp: readings[i].timestamp,
+				Delta:     readings[i].value - previous.value,
+				Gap:       gap,
+			})
+		}
+		previous = &readings[i]
+		gap = false
+	}
+
+	seriesJSONasBytes, err := json.Marshal(series)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Debugf("- deltaSeries queryResult:\n%s", string(seriesJSONasBytes))
+
+	return seriesJSONasBytes, nil
+}
+
+// reading is an entry of a device attribute reduced to its time and numeric value,
+// numeric is false for values that are not numbers
+type reading struct {
+	time      time.Time
+	timestamp string
+	value     float64
+	numeric   bool
+	record    QueryRecord // the entry as stored
+}
+
+// =========================================================================================
+// queryReadings returns the readings of a device attribute within a time window, both ends
+// inclusive, in timestamp order. The rich query result is not guaranteed to be in timestamp
+// order, the readings are therefore collected and sorted, at most maxQueryResults of them.
+// =========================================================================================
+func queryReadings(stub shim.ChaincodeStubInterface, deviceName string, attribute string, startTime string, endTime string) ([]reading, error) {
+	queryString := deviceAttributeRangeQuery(deviceName, attribute, startTime, endTime, false)
+
+	logger.Debugf("- queryReadings queryString:\n%s", queryString)
+
+	resultsIterator, err := stub.GetQueryResult(queryString)
+	if err != nil {
+		return nil, richQueryError(err)
+	}
+	defer resultsIterator.Close()
+
+	var readings []reading
+	limitedIterator := &limitedStateIterator{resultsIterator, maxQueryResults, false}
+	for limitedIterator.HasNext() {
+		queryResponse, err := limitedIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		if isCompositeKey(queryResponse.Key) {
+			continue
+		}
+		entry := Entry{}
+		err = json.Unmarshal(queryResponse.Value, &entry)
+		if err != nil {
+			return nil, newChaincodeError(errCodeInternal, "Failed to decode entry "+queryResponse.Key+": "+err.Error())
+		}
+		timestamp, err := time.Parse(time.RFC3339Nano, entry.Timestamp)
+		if err != nil {
+			return nil, newChaincodeError(errCodeInternal, "Failed to parse timestamp of entry "+queryResponse.Key+": "+err.Error())
+		}
+		value, ok := numericValue(&entry)
+		readings = append(readings, reading{timestamp, entry.Timestamp, value, ok, QueryRecord{queryResponse.Key, json.RawMessage(queryResponse.Value)}})
+	}
+	if limitedIterator.truncated {
+		return nil, newChaincodeError(errCodeResultLimit, fmt.Sprintf("Window matches more than %d records, narrow the time window", maxQueryResults))
+	}
+	sort.SliceStable(readings, func(i, j int) bool {
+		return readings[i].time.Before(readings[j].time)
+	})
+	return readings, nil
+}
+
+// thresholdOperators are the comparisons checkThreshold applies, a reading breaches the
+// threshold when the comparison of its value with the threshold holds
+var thresholdOperators = map[string]func(value float64, threshold float64) bool{
+	">":  func(value float64, threshold float64) bool { return value > threshold },
+	">=": func(value float64, threshold float64) bool { return value >= threshold },
+	"<":  func(value float64, threshold float64) bool { return value < threshold },
+	"<=": func(value float64, threshold float64) bool { return value <= threshold },
+	"==": func(value float64, threshold float64) bool { return value == threshold },
+	"!=": func(value float64, threshold float64) bool { return value != threshold },
+}
+
+// ===== Threshold breaches of a device attribute =================================
+// checkThreshold returns the entries of a device attribute within a time window, both ends
+// inclusive, whose numeric value breaches a threshold, in timestamp order. The operator is
+// one of >, >=, <, <=, == or !=, e.g. ">" "30" finds the readings above 30. Entries with
+// non-numeric values are skipped.
+// Only available on state databases that support rich query (e.g. CouchDB)
+// =========================================================================================
+func (t *SimpleChaincode) checkThreshold(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//   0             1            2           3            4            5
+	// "deviceName", "attribute", "operator", "threshold", "startTime", "endTime"
+	if err := checkArgCount(args, 6, 6); err != nil {
+		return nil, err
+	}
+	if len(args[0]) <= 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "1st argument must be a non-empty string")
+	}
+	if len(args[1]) <= 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "2nd argument must be a non-empty string")
+	}
+	breaches, ok := thresholdOperators[args[2]]
+	if !ok {
+		return nil, newChaincodeError(errCodeBadArgs, "3rd argument must be one of >, >=, <, <=, == or !=: "+strconv.Quote(args[2]))
+	}
+	threshold, err := strconv.ParseFloat(args[3], 64)
+	if err != nil || math.IsNaN(threshold) || math.IsInf(threshold, 0) {
+		return nil, newChaincodeError(errCodeBadArgs, "4th argument must be a finite number: "+args[3])
+	}
+	startTime, endTime, err := normalizeTimeRange(args[4], args[5])
+	if err != nil {
+		return nil, err
+	}
+
+	deviceName := args[0]
+	attribute := args[1]
+
+	readings, err := queryReadings(stub, deviceName, attribute, startTime, endTime)
+	if err != nil {
+		return nil, err
+	}
+
+	records := []QueryRecord{}
+	for i := range readings {
+		if readings[i].numeric && breaches(readings[i].value, threshold) {
+			records = append(records, readings[i].record)
+		}
+	}
+
+	recordsJSONasBytes, err := json.Marshal(records)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Debugf("- checkThreshold queryResult:\n%s", string(recordsJSONasBytes))
+
+	return recordsJSONasBytes, nil
+}
+
+// ===== Gaps in the reporting of a device ========================================
+// reportingGaps returns the periods within a time window, both ends inclusive, in which a
+// device attribute went without a reading for longer than the expected interval. The
+// window bounds count as readings, so a device that stopped reporting shows a gap up to
+// the end of the window and a device without readings a single gap over the whole window.
+// Only available on state databases that support rich query (e.g. CouchDB)
+// =========================================================================================
+func (t *SimpleChaincode) reportingGaps(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//   0             1            2                   3            4
+	// "deviceName", "attribute", "expectedInterval", "startTime", "endTime"
+	if err := checkArgCount(args, 5, 5); err != nil {
+		return nil, err
+	}
+	if len(args[0]) <= 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "1st argument must be a non-empty string")
+	}
+	if len(args[1]) <= 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "2nd argument must be a non-empty string")
+	}
+	expectedInterval, err := time.ParseDuration(args[2])
+	if err != nil || expectedInterval <= 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "3rd argument must be a positive duration such as 5m or 1h: "+args[2])
+	}
+	startTime, endTime, err := normalizeTimeRange(args[3], args[4])
+	if err != nil {
+		return nil, err
+	}
+
+	deviceName := args[0]
+	attribute := args[1]
+
+	readings, err := queryReadings(stub, deviceName, attribute, startTime, endTime)
+	if err != nil {
+		return nil, err
+	}
+
+	// normalizeTimeRange has checked that both bounds parse
+	windowStart, _ := time.Parse(time.RFC3339, startTime)
+	windowEnd, _ := time.Parse(time.RFC3339, endTime)
+	gaps := []Gap{}
+	addGap := func(start time.Time, end time.Time) {
+		if end.Sub(start) > expectedInterval {
+			gaps = append(gaps, Gap{normalizeTimestamp(start), normalizeTimestamp(end), end.Sub(start).Seconds()})
+		}
+	}
+	previous := windowStart
+	for i := range readings {
+		addGap(previous, readings[i].time)
+		previous = readings[i].time
+	}
+	addGap(previous, windowEnd)
+
+	gapsJSONasBytes, err := json.Marshal(gaps)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Debugf("- reportingGaps queryResult:\n%s", string(gapsJSONasBytes))
+
+	return gapsJSONasBytes, nil
+}
+
+// ===== Downsample a numeric attribute ===========================================
+// downsample splits a time window, both ends inclusive, into buckets of a fixed duration
+// counted from the start of the window, and returns one sample per bucket holding readings
+// of a device attribute: the last numeric reading, or the average of the numeric readings
+// with the avg mode. Buckets without readings are left out.
+// Only available on state databases that support rich query (e.g. CouchDB)
+// =========================================================================================
+func (t *SimpleChaincode) downsample(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//   0             1            2                 3            4          5 (optional)
+	// "deviceName", "attribute", "bucketDuration", "startTime", "endTime", "last" or "avg"
+	if err := checkArgCount(args, 5, 6); err != nil {
+		return nil, err
+	}
+	if len(args[0]) <= 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "1st argument must be a non-empty string")
+	}
+	if len(args[1]) <= 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "2nd argument must be a non-empty string")
+	}
+	bucketDuration, err := time.ParseDuration(args[2])
+	if err != nil || bucketDuration <= 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "3rd argument must be a positive duration such as 1m or 1h: "+args[2])
+	}
+	startTime, endTime, err := normalizeTimeRange(args[3], args[4])
+	if err != nil {
+		return nil, err
+	}
+	mode := downsampleLast
+	if len(args) == 6 {
+		mode = args[5]
+	}
+	if mode != downsampleLast && mode != downsampleAverage {
+		return nil, newChaincodeError(errCodeBadArgs, "6th argument must be last or avg: "+mode)
+	}
+
+	deviceName := args[0]
+	attribute := args[1]
+
+	readings, err := queryReadings(stub, deviceName, attribute, startTime, endTime)
+	if err != nil {
+		return nil, err
+	}
+
+	// normalizeTimeRange has checked that the start time parses
+	windowStart, _ := time.Parse(time.RFC3339, startTime)
+	samples := []Sample{}
+	var sum float64
+	numericCount := 0
+	currentBucket := int64(-1)
+	for i := range readings {
+		bucket := int64(readings[i].time.Sub(windowStart) / bucketDuration)
+		if bucket != currentBucket {
+			samples = append(samples, Sample{Bucket: normalizeTimestamp(windowStart.Add(time.Duration(bucket) * bucketDuration))})
+			currentBucket = bucket
+			sum = 0
+			numericCount = 0
+		}
+		sample := &samples[len(samples)-1]
+		sample.Timestamp = readings[i].timestamp
+		sample.Count++
+		if !readings[i].numeric {
+			continue
+		}
+		value := readings[i].value
+		if mode == downsampleAverage {
+			sum += value
+			numericCount++
+			value = sum / float64(numericCount)
+		}
+		sample.Value = &value
+	}
+
+	samplesJSONasBytes, err := json.Marshal(samples)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Debugf("- downsample queryResult:\n%s", string(samplesJSONasBytes))
+
+	return samplesJSONasBytes, nil
+}
+
+// ===== Export entries as NDJSON =================================================
+// exportNDJSON returns the entries of a device within a time window, both ends inclusive,
+// as newline-delimited JSON: the records getQueryResultForQueryString returns as an array,
+// one per line, each line ending with a newline. Consumers can process the lines one by one.
+// Soft-deleted entries are left out.
+// Only available on state databases that support rich query (e.g. CouchDB)
+// =========================================================================================
+func (t *SimpleChaincode) exportNDJSON(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//   0             1            2
+	// "deviceName", "startTime", "endTime"
+	if err := checkArgCount(args, 3, 3); err != nil {
+		return nil, err
+	}
+	if len(args[0]) <= 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "1st argument must be a non-empty string")
+	}
+	startTime, endTime, err := normalizeTimeRange(args[1], args[2])
+	if err != nil {
+		return nil, err
+	}
+
+	deviceName := args[0]
+
+	queryString := newRichQuery(map[string]interface{}{
+		"deviceName": deviceName,
+		"timestamp":  timeRangeCondition(startTime, endTime),
+	}, false).String()
+
+	logger.Debugf("- exportNDJSON queryString:\n%s", queryString)
+
+	resultsIterator, err := stub.GetQueryResult(queryString)
+	if err != nil {
+		return nil, richQueryError(err)
+	}
+	defer resultsIterator.Close()
+
+	// the encoder ends every record with a newline
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false) // records are written as stored
+
+	limitedIterator := &limitedStateIterator{resultsIterator, maxQueryResults, false}
+	for limitedIterator.HasNext() {
+		queryResponse, err := limitedIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		if isCompositeKey(queryResponse.Key) {
+			continue
+		}
+		err = encoder.Encode(newQueryRecord(queryResponse))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if limitedIterator.truncated {
+		return nil, newChaincodeError(errCodeResultLimit, fmt.Sprintf("Export matches more than %d records, narrow the time window", maxQueryResults))
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// ===== Export entries as CSV ====================================================
+// exportCSV returns the entries of a device within a time window, both ends inclusive, as
+// CSV with the header row timestamp,deviceName,attribute,attributeValue. JSON values are
+// exported as their JSON text. Soft-deleted entries are left out.
+// Only available on state databases that support rich query (e.g. CouchDB)
+// =========================================================================================
+func (t *SimpleChaincode) exportCSV(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//   0             1            2
+	// "deviceName", "startTime", "endTime"
+	if err := checkArgCount(args, 3, 3); err != nil {
+		return nil, err
+	}
+	if len(args[0]) <= 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "1st argument must be a non-empty string")
+	}
+	startTime, endTime, err := normalizeTimeRange(args[1], args[2])
+	if err != nil {
+		return nil, err
+	}
+
+	deviceName := args[0]
+
+	queryString := newRichQuery(map[string]interface{}{
+		"deviceName": deviceName,
+		"timestamp":  timeRangeCondition(startTime, endTime),
+	}, false).String()
+
+	logger.Debugf("- exportCSV queryString:\n%s", queryString)
+
+	resultsIterator, err := stub.GetQueryResult(queryString)
+	if err != nil {
+		return nil, richQueryError(err)
+	}
+	defer resultsIterator.Close()
+
+	// the csv writer quotes fields containing commas, quotes or line breaks
+	var buffer bytes.Buffer
+	writer := csv.NewWriter(&buffer)
+	err = writer.Write([]string{"timestamp", "deviceName", "attribute", "attributeValue"})
+	if err != nil {
+		return nil, err
+	}
+
+	limitedIterator := &limitedStateIterator{resultsIterator, maxQueryResults, false}
+	for limitedIterator.HasNext() {
+		queryResponse, err := limitedIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		if isCompositeKey(queryResponse.Key) {
+			continue
+		}
+		entry := Entry{}
+		err = json.Unmarshal(queryResponse.Value, &entry)
+		if err != nil {
+			return nil, newChaincodeError(errCodeInternal, "Failed to decode entry "+queryResponse.Key+": "+err.Error())
+		}
+		attributeValue, ok := stringValue(&entry)
+		if !ok {
+			attributeValue = string(entry.AttributeValue)
+		}
+		err = writer.Write([]string{entry.Timestamp, entry.DeviceName, entry.Attribute, attributeValue})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if limitedIterator.truncated {
+		return nil, newChaincodeError(errCodeResultLimit, fmt.Sprintf("Export matches more than %d records, narrow the time window", maxQueryResults))
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// =========================================================================================
+// numericValue returns the value of an entry as a number. Entries typed as numbers carry
+// their parsed value, other string values and JSON numbers are parsed. ok is false for
+// non-numeric values.
+// =========================================================================================
+func numericValue(entry *Entry) (float64, bool) {
+	if entry.NumericValue != nil {
+		return *entry.NumericValue, true
+	}
+	valueAsString, ok := stringValue(entry)
+	if !ok {
+		valueAsString = string(entry.AttributeValue)
+	}
+	value, err := strconv.ParseFloat(valueAsString, 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, false
+	}
+	return value, true
+}
+
+// =========================================================================================
+// checkArgCount checks that at least minArgs and at most maxArgs arguments were passed.
+// Surplus arguments are rejected rather than ignored, they usually mean that the
+// client passed parameters in the wrong order.
+// =========================================================================================
+func checkArgCount(args []string, minArgs int, maxArgs int) error {
+	expecting := strconv.Itoa(minArgs)
+	if maxArgs == minArgs+1 {
+		expecting = fmt.Sprintf("%d or %d", minArgs, maxArgs)
+	} else if maxArgs > minArgs {
+		expecting = fmt.Sprintf("%d to %d", minArgs, maxArgs)
+	}
+	if len(args) > maxArgs {
+		return newChaincodeError(errCodeBadArgs, "Incorrect number of arguments, too many arguments. Expecting "+expecting)
+	}
+	if len(args) < minArgs {
+		return newChaincodeError(errCodeBadArgs, "Incorrect number of arguments. Expecting "+expecting)
+	}
+	return nil
+}
+
+// =========================================================================================
+// checkArgsUTF8 rejects arguments that are not valid UTF-8. Invalid sequences would be
+// replaced when the values are marshalled to JSON, so what is stored and indexed would
+// silently differ from what the client sent.
+// =========================================================================================
+func checkArgsUTF8(args []string) error {
+	for i, arg := range args {
+		if !utf8.ValidString(arg) {
+			return newChaincodeError(errCodeBadArgs, fmt.Sprintf("argument %d is not valid UTF-8: %q", i+1, arg))
+		}
+	}
+	return nil
+}
+
+// =========================================================================================
+// checkStrictArgs applies checkArgsUTF8 when the ledger is in strict mode
+// =========================================================================================
+func checkStrictArgs(stub shim.ChaincodeStubInterface, args []string) error {
+	strict, err := isStrictMode(stub)
+	if err != nil {
+		return err
+	}
+	if strict {
+		return checkArgsUTF8(args)
+	}
+	return nil
+}
+
+// =========================================================================================
+// normalizeTimeRange checks that both ends of a time window are RFC3339 timestamps and
+// that the window does not end before it starts. The ends are returned normalized like
+// entry timestamps, so that they compare with stored timestamps whatever their offset.
+// =========================================================================================
+func normalizeTimeRange(startTime string, endTime string) (string, string, error) {
+	start, err := time.Parse(time.RFC3339, startTime)
+	if err != nil {
+		return "", "", newChaincodeError(errCodeBadArgs, "start time must be a RFC3339 timestamp: "+startTime)
+	}
+	end, err := time.Parse(time.RFC3339, endTime)
+	if err != nil {
+		return "", "", newChaincodeError(errCodeBadArgs, "end time must be a RFC3339 timestamp: "+endTime)
+	}
+	if end.Before(start) {
+		return "", "", newChaincodeError(errCodeBadArgs, "end time must not be earlier than start time")
+	}
+	return normalizeTimestamp(start), normalizeTimestamp(end), nil
+}
+
+// ===== Count entries by device ==================================================
+// countEntriesByDevice counts the entries of a device using the same selector as
+// queryByDevice, without buffering the records themselves.
+// Only available on state databases that support rich query (e.g. CouchDB)
+// =========================================================================================
+func (t *SimpleChaincode) countEntriesByDevice(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//   0
+	// "deviceName"
+	if err := checkArgCount(args, 1, 1); err != nil {
+		return nil, err
+	}
+	if len(args[0]) <= 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "1st argument must be a non-empty string")
+	}
+
+	deviceName := args[0]
+
+	queryString := newRichQuery(map[string]interface{}{"deviceName": deviceName}, false).String()
+
+	resultsIterator, err := stub.GetQueryResult(queryString)
+	if err != nil {
+		return nil, richQueryError(err)
+	}
+	defer resultsIterator.Close()
+
+	count := 0
+	for resultsIterator.HasNext() {
+		_, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		count++
+	}
+
+	countJSONasBytes, err := json.Marshal(DeviceCount{deviceName, count})
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Debugf("- countEntriesByDevice queryResult:\n%s", string(countJSONasBytes))
+
+	return countJSONasBytes, nil
+}
+
+// ===== Count entries of every device ============================================
+// deviceCounts returns a JSON object mapping each device name to the number of its stored
+// entries, soft-deleted ones included. The device~attr~time index is scanned key by key,
+// no entry is loaded. A counter maintained on every write would be cheaper to read, but
+// every create of a device would then read and write the same key, so concurrent creates for
+// a device would fail MVCC validation.
+// Works on every state database, no rich query support is needed.
+// =========================================================================================
+func (t *SimpleChaincode) deviceCounts(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if err := checkArgCount(args, 0, 0); err != nil {
+		return nil, err
+	}
+
+	deviceAttrResultsIterator, err := stub.GetStateByPartialCompositeKey(deviceAttrIndexName, []string{})
+	if err != nil {
+		return nil, err
+	}
+	defer deviceAttrResultsIterator.Close()
+
+	counts := make(map[string]int)
+	for deviceAttrResultsIterator.HasNext() {
+		responseRange, err := deviceAttrResultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		indexKey, err := decodeIndexKey(stub, responseRange.Key, deviceAttrIndexName)
+		if err != nil {
+			return nil, err
+		}
+		counts[indexKey.DeviceName]++
+	}
+
+	return json.Marshal(counts)
+}
+
+// ===== Latest entry for device and attribute ====================================
+// getLatestEntryForDeviceAttribute returns the most recent entry of a device attribute.
+// The query sorts by timestamp descending and limits the result to a single entry,
+// sorting requires the indexDeviceAttributeTimestamp index shipped in META-INF.
+// Only available on state databases that support rich query (e.g. CouchDB)
+// =========================================================================================
+func (t *SimpleChaincode) getLatestEntryForDeviceAttribute(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//   0             1
+	// "deviceName", "attribute"
+	if err := checkArgCount(args, 2, 2); err != nil {
+		return nil, err
+	}
+	if len(args[0]) <= 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "1st argument must be a non-empty string")
+	}
+	if len(args[1]) <= 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "2nd argument must be a non-empty string")
+	}
+
+	deviceName := args[0]
+	attribute := args[1]
+
+	query := newRichQuery(map[string]interface{}{"deviceName": deviceName, "attribute": attribute}, false)
+	query.Sort = []map[string]string{{"deviceName": "desc"}, {"attribute": "desc"}, {"timestamp": "desc"}}
+	query.UseIndex = []string{"_design/indexDeviceAttributeTimestampDoc", "indexDeviceAttributeTimestamp"}
+	query.Limit = 1
+	queryString := query.String()
+
+	logger.Debugf("- getLatestEntryForDeviceAttribute queryString:\n%s", queryString)
+
+	resultsIterator, err := stub.GetQueryResult(queryString)
+	if err != nil {
+		return nil, richQueryError(err)
+	}
+	defer resultsIterator.Close()
+
+	if !resultsIterator.HasNext() {
+		return nil, newNotFoundError(deviceName, "No entry found for device "+deviceName+" and attribute "+attribute)
+	}
+	queryResponse, err := resultsIterator.Next()
+	if err != nil {
+		return nil, err
+	}
+
+	return queryResponse.Value, nil
+}
+
+// ===== First entry for device ===================================================
+// firstEntryForDevice returns the oldest entry of a device, whatever its attribute, as
+// the baseline reading of an installation. The query sorts by timestamp ascending and
+// limits the result to a single entry, sorting requires the indexDeviceTimestamp index
+// shipped in META-INF.
+// Only available on state databases that support rich query (e.g. CouchDB)
+// =========================================================================================
+func (t *SimpleChaincode) firstEntryForDevice(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//   0
+	// "deviceName"
+	if err := checkArgCount(args, 1, 1); err != nil {
+		return nil, err
+	}
+	if len(args[0]) <= 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "1st argument must be a non-empty string")
+	}
+
+	deviceName := args[0]
+
+	query := newRichQuery(map[string]interface{}{"deviceName": deviceName}, false)
+	query.Sort = []map[string]string{{"deviceName": "asc"}, {"timestamp": "asc"}}
+	query.UseIndex = []string{"_design/indexDeviceTimestampDoc", "indexDeviceTimestamp"}
+	query.Limit = 1
+	queryString := query.String()
+
+	logger.Debugf("- firstEntryForDevice queryString:\n%s", queryString)
+
+	resultsIterator, err := stub.GetQueryResult(queryString)
+	if err != nil {
+		return nil, richQueryError(err)
+	}
+	defer resultsIterator.Close()
+
+	if !resultsIterator.HasNext() {
+		return nil, newNotFoundError(deviceName, "No entry found for device "+deviceName)
+	}
+	queryResponse, err := resultsIterator.Next()
+	if err != nil {
+		return nil, err
+	}
+
+	return queryResponse.Value, nil
 }
 
-func main() {
-	err := shim.Start(new(SimpleChaincode))
+// ===== Ad hoc rich query ========================================================
+// This method uses a query string to perform a rich query.
+// Query string matching state database syntax is passed in and executed as is.
+// Supports ad hoc queries that can be defined at runtime by the client.
+// =========================================================================================
+func (t *SimpleChaincode) adHocQuery(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//   0
+	// "queryString"
+	if err := checkArgCount(args, 1, 1); err != nil {
+		return nil, err
+	}
+
+	queryString := args[0]
+	err := validateQueryString(queryString, requireAdHocQueryLimit)
 	if err != nil {
-		fmt.Printf("Error starting Simple chaincode: %s", err)
+		return nil, err
 	}
-}
 
-type Entry struct {
-	Timestamp      string `json:"timestamp"` // used as ID
-	DeviceName     string `json:"deviceName"`
-	Attribute      string `json:"attribute"`
-	AttributeValue string `json:"attributeValue"`
+	queryResults, err := getQueryResultForQueryString(stub, queryString)
+	if err != nil {
+		return nil, err
+	}
+	return queryResults, nil
 }
 
-// ============================================================================================================================
-// Init - reset all the things
-// Init is called during chaincode instantiation to initialize any data.
-// Chaincode upgrade also calls this function to reset or to migrate data.
-// ============================================================================================================================
-func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
-	return nil, nil
+// =========================================================================================
+// validateQueryString checks a client supplied rich query before it reaches the state
+// database: it has to be a JSON object with a selector object and only the query fields
+// listed in adHocQueryFields. When requireLimit is set the query must also carry a limit.
+// =========================================================================================
+func validateQueryString(queryString string, requireLimit bool) error {
+	var query map[string]json.RawMessage
+	err := json.Unmarshal([]byte(queryString), &query)
+	if err != nil {
+		return newChaincodeError(errCodeBadArgs, "query must be a JSON object: "+err.Error())
+	}
+	for field := range query {
+		if !adHocQueryFields[field] {
+			return newChaincodeError(errCodeBadArgs, "query field is not supported: "+strconv.Quote(field))
+		}
+	}
+	var selector map[string]json.RawMessage
+	if query["selector"] == nil || json.Unmarshal(query["selector"], &selector) != nil || selector == nil {
+		return newChaincodeError(errCodeBadArgs, "query must have a selector object")
+	}
+	if requireLimit && query["limit"] == nil {
+		return newChaincodeError(errCodeBadArgs, "query must have a limit")
+	}
+	return nil
 }
 
-// ============================================================================================================================
-// Invoke - Entry point for Invocations
-// Invoke is called per transaction on the chaincode.
-// ============================================================================================================================
-func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
-	fmt.Println("invoke is running " + function)
+// ===== History query ========================================================
+// This method returns every modification ever made to an entry, including deletions.
+// Each element holds the transaction ID, the entry value as it was written by
+// that transaction (null for deletions), the transaction timestamp and the delete flag.
+// =========================================================================================
+func (t *SimpleChaincode) getHistoryForEntry(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 
-	// Handle different functions
-	if function == "init" { //initialize the chaincode state, used as reset
-		return t.Init(stub, "init", args)
-	} else if function == "create" {
-		return t.createEntry(stub, args)
+	//   0
+	// "timestamp"
+	if err := checkArgCount(args, 1, 1); err != nil {
+		return nil, err
+	}
+	if len(args[0]) <= 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "1st argument must be a non-empty string")
 	}
-	fmt.Println("invoke did not find func: " + function)
 
-	return nil, errors.New("Received unknown function invocation: " + function)
-}
+	timestamp := entryKeyArg(args[0])
 
-// ============================================================================================================================
-// Query - Entry point for Queries
-// ============================================================================================================================
-func (t *SimpleChaincode) Query(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
-	fmt.Println("query is running " + function)
+	logger.Debugf("- start getHistoryForEntry: %s", timestamp)
 
-	// Handle different functions
-	if function == "adHocQuery" { //find entries based on an ad hoc rich query
-		return t.adHocQuery(stub, args)
+	resultsIterator, err := stub.GetHistoryForKey(timestamp)
+	if err != nil {
+		return nil, err
 	}
-	fmt.Println("query did not find func: " + function)
+	defer resultsIterator.Close()
 
-	return nil, errors.New("Received unknown function query: " + function)
-}
+	// buffer is a JSON array containing historic values for the entry
+	var buffer bytes.Buffer
+	buffer.WriteString("[")
 
-// ============================================================================================================================
-// Create Entry - create a new entry, store into chaincode state
-// ============================================================================================================================
-func (t *SimpleChaincode) createEntry(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	var err error
+	bArrayMemberAlreadyWritten := false
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		// Add a comma before array members, suppress it for the first array member
+		if bArrayMemberAlreadyWritten == true {
+			buffer.WriteString(",")
+		}
+		buffer.WriteString("{\"TxId\":")
+		writeJSONString(&buffer, response.TxId)
+
+		buffer.WriteString(", \"Value\":")
+		// if it was a delete operation on given key, then we need to set the
+		// corresponding value null. Else, we will write the response.Value
+		// as-is (as the Value itself a JSON entry)
+		if response.IsDelete {
+			buffer.WriteString("null")
+		} else {
+			buffer.WriteString(string(response.Value))
+		}
 
-	//   0       	1       		2    		 3
-	// "timestamp", "deviceName", "attribute", "attributeValue"
-	if len(args) != 4 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 4")
+		buffer.WriteString(", \"Timestamp\":")
+		buffer.WriteString("\"")
+		buffer.WriteString(time.Unix(response.Timestamp.Seconds, int64(response.Timestamp.Nanos)).UTC().Format(time.RFC3339Nano))
+		buffer.WriteString("\"")
+
+		buffer.WriteString(", \"IsDelete\":")
+		buffer.WriteString(strconv.FormatBool(response.IsDelete))
+		buffer.WriteString("}")
+		bArrayMemberAlreadyWritten = true
 	}
+	buffer.WriteString("]")
 
-	//input sanitation
-	fmt.Println("- start entry creation")
+	logger.Debugf("- getHistoryForEntry returning:\n%s", buffer.String())
+
+	return buffer.Bytes(), nil
+}
+
+// ===== Ad hoc rich query with pagination ========================================
+// Same as adHocQuery, but only a single page of pageSize results is returned.
+// The response carries the records together with the response metadata; the
+// returned Bookmark is passed back in the next call to fetch the following page.
+// =========================================================================================
+func (t *SimpleChaincode) adHocQueryWithPagination(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//   0              1           2
+	// "queryString", "pageSize", "bookmark"
+	if err := checkArgCount(args, 2, 3); err != nil {
+		return nil, err
+	}
 	if len(args[0]) <= 0 {
-		return nil, errors.New("1st argument must be a non-empty string")
+		return nil, newChaincodeError(errCodeBadArgs, "1st argument must be a non-empty string")
 	}
-	if len(args[1]) <= 0 {
-		return nil, errors.New("2nd argument must be a non-empty string")
+
+	queryString := args[0]
+	err := validateQueryString(queryString, false)
+	if err != nil {
+		return nil, err
 	}
-	if len(args[2]) <= 0 {
-		return nil, errors.New("3rd argument must be a non-empty string")
+	pageSize, err := strconv.ParseInt(args[1], 10, 32)
+	if err != nil || pageSize <= 0 {
+		return nil, newChaincodeError(errCodeBadArgs, "2nd argument must be a positive integer")
 	}
-	if len(args[3]) <= 0 {
-		return nil, errors.New("4th argument must be a non-empty string")
+	bookmark := ""
+	if len(args) > 2 {
+		bookmark = args[2]
 	}
-	timestamp := args[0]
-	deviceName := args[1]
-	attribute := args[2]
-	attributeValue := args[3]
 
-	//check if entry already exists
-	entryAsBytes, err := stub.GetState(timestamp)
+	queryResults, err := getQueryResultForQueryStringWithPagination(stub, queryString, int32(pageSize), bookmark)
 	if err != nil {
-		return nil, errors.New("Failed to get entry: " + err.Error())
-	} else if entryAsBytes != nil {
-		fmt.Println("This entry already exists: " + timestamp)
-		return nil, errors.New("This entry already exists: " + timestamp)
+		return nil, err
 	}
+	return queryResults, nil
+}
 
-	// ==== Create Entry object and marshal to JSON ====
-	entry := &Entry{timestamp, deviceName, attribute, attributeValue}
-	entryJSONasBytes, err := json.Marshal(entry)
+// =========================================================================================
+// getQueryResultForQueryString executes the passed in query string.
+// Result set is built and returned as a byte array containing the JSON results.
+// =========================================================================================
+func getQueryResultForQueryString(stub shim.ChaincodeStubInterface, queryString string) ([]byte, error) {
+
+	logger.Debugf("- getQueryResultForQueryString queryString:\n%s", queryString)
+
+	resultsIterator, err := stub.GetQueryResult(queryString)
 	if err != nil {
-		return nil, err
+		return nil, richQueryError(err)
 	}
+	defer resultsIterator.Close()
 
-	// Save entry to state
-	err = stub.PutState(timestamp, entryJSONasBytes)
+	// stop reading once the result limit is reached instead of buffering an unbounded result
+	limitedIterator := &limitedStateIterator{resultsIterator, maxQueryResults, false}
+	buffer, err := constructQueryResponseFromIterator(limitedIterator)
 	if err != nil {
 		return nil, err
 	}
+	if limitedIterator.truncated {
+		logger.Warningf("- getQueryResultForQueryString result exceeds %d records", maxQueryResults)
+		return nil, newChaincodeError(errCodeResultLimit, fmt.Sprintf("Query matches more than %d records, use the paginated query instead", maxQueryResults))
+	}
 
-	fmt.Println("- end entry creation")
-	return nil, nil
+	logger.Debugf("- getQueryResultForQueryString queryResult:\n%s", buffer.String())
+
+	return buffer.Bytes(), nil
 }
 
-// ===== Ad hoc rich query ========================================================
-// This method uses a query string to perform a rich query.
-// Query string matching state database syntax is passed in and executed as is.
-// Supports ad hoc queries that can be defined at runtime by the client.
 // =========================================================================================
-func (t *SimpleChaincode) adHocQuery(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+// getQueryResultForQueryStringWithPagination executes the passed in query string with
+// pagination info. Result set is built and returned as a byte array containing the JSON
+// results together with the response metadata.
+// =========================================================================================
+func getQueryResultForQueryStringWithPagination(stub shim.ChaincodeStubInterface, queryString string, pageSize int32, bookmark string) ([]byte, error) {
 
-	//   0
-	// "queryString"
-	if len(args) < 1 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 1")
-	}
+	logger.Debugf("- getQueryResultForQueryStringWithPagination queryString:\n%s", queryString)
 
-	queryString := args[0]
+	resultsIterator, responseMetadata, err := stub.GetQueryResultWithPagination(queryString, pageSize, bookmark)
+	if err != nil {
+		return nil, richQueryError(err)
+	}
+	defer resultsIterator.Close()
 
-	queryResults, err := getQueryResultForQueryString(stub, queryString)
+	buffer, err := constructQueryResponseFromIterator(resultsIterator)
 	if err != nil {
 		return nil, err
 	}
-	return queryResults, nil
+
+	bufferWithPaginationInfo := addPaginationMetadataToQueryResults(buffer, responseMetadata)
+
+	logger.Debugf("- getQueryResultForQueryStringWithPagination queryResult:\n%s", bufferWithPaginationInfo.String())
+
+	return bufferWithPaginationInfo.Bytes(), nil
 }
 
 // =========================================================================================
-// getQueryResultForQueryString executes the passed in query string.
-// Result set is built and returned as a byte array containing the JSON results.
+// limitedStateIterator wraps a result iterator and ends the iteration after limit results.
+// truncated is set when the wrapped iterator had more results than the limit.
 // =========================================================================================
-func getQueryResultForQueryString(stub shim.ChaincodeStubInterface, queryString string) ([]byte, error) {
-	
-	fmt.Printf("- getQueryResultForQueryString queryString:\n%s\n", queryString)
+type limitedStateIterator struct {
+	shim.StateQueryIteratorInterface
+	remaining int
+	truncated bool
+}
 
-	resultsIterator, err := stub.GetQueryResult(queryString)
+func (it *limitedStateIterator) HasNext() bool {
+	if !it.StateQueryIteratorInterface.HasNext() {
+		return false
+	}
+	if it.remaining <= 0 {
+		it.truncated = true
+		return false
+	}
+	return true
+}
+
+func (it *limitedStateIterator) Next() (*queryresult.KV, error) {
+	it.remaining--
+	return it.StateQueryIteratorInterface.Next()
+}
+
+// =========================================================================================
+// reverseResults reads all entries of a result iterator and returns an iterator over them
+// in reverse order. Index entries are dropped. At most maxQueryResults entries are buffered,
+// a larger result fails with RESULT_LIMIT_EXCEEDED.
+// =========================================================================================
+func reverseResults(resultsIterator shim.StateQueryIteratorInterface) (shim.StateQueryIteratorInterface, error) {
+	var results []*queryresult.KV
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		if isCompositeKey(queryResponse.Key) {
+			continue
+		}
+		if len(results) >= maxQueryResults {
+			return nil, newChaincodeError(errCodeResultLimit, fmt.Sprintf("Range matches more than %d records, narrow the range or read it in ascending order", maxQueryResults))
+		}
+		results = append(results, queryResponse)
+	}
+	for i, j := 0, len(results)-1; i < j; i, j = i+1, j-1 {
+		results[i], results[j] = results[j], results[i]
+	}
+	return &sliceStateIterator{results: results}, nil
+}
+
+// =========================================================================================
+// sliceStateIterator iterates over results held in memory
+// =========================================================================================
+type sliceStateIterator struct {
+	results []*queryresult.KV
+	next    int
+}
+
+func (it *sliceStateIterator) HasNext() bool {
+	return it.next < len(it.results)
+}
+
+func (it *sliceStateIterator) Next() (*queryresult.KV, error) {
+	if !it.HasNext() {
+		return nil, errors.New("no more results")
+	}
+	it.next++
+	return it.results[it.next-1], nil
+}
+
+func (it *sliceStateIterator) Close() error {
+	return nil
+}
+
+// =========================================================================================
+// activeEntriesIterator wraps a result iterator and skips soft-deleted entries
+// =========================================================================================
+type activeEntriesIterator struct {
+	shim.StateQueryIteratorInterface
+	next *queryresult.KV
+	err  error
+}
+
+func (it *activeEntriesIterator) HasNext() bool {
+	for it.next == nil && it.err == nil && it.StateQueryIteratorInterface.HasNext() {
+		queryResponse, err := it.StateQueryIteratorInterface.Next()
+		if err != nil {
+			it.err = err
+			break
+		}
+		entry := Entry{}
+		if isCompositeKey(queryResponse.Key) || json.Unmarshal(queryResponse.Value, &entry) != nil || !entry.Deleted {
+			it.next = queryResponse
+		}
+	}
+	return it.next != nil || it.err != nil
+}
+
+func (it *activeEntriesIterator) Next() (*queryresult.KV, error) {
+	if !it.HasNext() {
+		return nil, errors.New("no more results")
+	}
+	queryResponse, err := it.next, it.err
+	it.next, it.err = nil, nil
+	return queryResponse, err
+}
+
+// =========================================================================================
+// filterDeleted hides soft-deleted entries from a result iterator unless includeDeleted is set
+// =========================================================================================
+func filterDeleted(resultsIterator shim.StateQueryIteratorInterface, includeDeleted bool) shim.StateQueryIteratorInterface {
+	if includeDeleted {
+		return resultsIterator
+	}
+	return &activeEntriesIterator{StateQueryIteratorInterface: resultsIterator}
+}
+
+// =========================================================================================
+// richQuery is a CouchDB query. Queries are always assembled from a richQuery and never by
+// concatenating strings, so that client supplied values are escaped.
+// =========================================================================================
+type richQuery struct {
+	Selector map[string]interface{} `json:"selector"`
+	Sort     []map[string]string    `json:"sort,omitempty"`
+	UseIndex []string               `json:"use_index,omitempty"`
+	Limit    int                    `json:"limit,omitempty"`
+}
+
+// =========================================================================================
+// newRichQuery builds a query whose selector matches the given field to value constraints.
+// A value is either matched for equality or is an operator condition such as the one made
+// by timeRangeCondition. Soft-deleted entries are excluded unless includeDeleted is set.
+// =========================================================================================
+func newRichQuery(constraints map[string]interface{}, includeDeleted bool) *richQuery {
+	selector := make(map[string]interface{}, len(constraints)+1)
+	for field, value := range constraints {
+		selector[field] = value
+	}
+	if !includeDeleted {
+		selector["deleted"] = map[string]interface{}{"$ne": true}
+	}
+	return &richQuery{Selector: selector}
+}
+
+// String returns the query as JSON, the fields of the selector are sorted
+func (query *richQuery) String() string {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false) // values are matched as they are stored
+	encoder.Encode(query)        // constraints are strings, numbers and maps of them, they always encode
+	return strings.TrimSuffix(buffer.String(), "\n")
+}
+
+// =========================================================================================
+// timeRangeCondition is the selector condition matching RFC3339 timestamps within a time
+// window, both ends inclusive
+// =========================================================================================
+func timeRangeCondition(startTime string, endTime string) map[string]interface{} {
+	return map[string]interface{}{"$gte": startTime, "$lte": endTime}
+}
+
+// =========================================================================================
+// parseIncludeDeleted reads the optional includeDeleted flag at the given argument index,
+// soft-deleted entries are excluded by default
+// =========================================================================================
+func parseIncludeDeleted(args []string, index int) (bool, error) {
+	if len(args) <= index {
+		return false, nil
+	}
+	includeDeleted, err := strconv.ParseBool(args[index])
 	if err != nil {
-		return nil, err
+		return false, newChaincodeError(errCodeBadArgs, "includeDeleted must be true or false: "+args[index])
 	}
-	defer resultsIterator.Close()
+	return includeDeleted, nil
+}
 
-	// buffer is a JSON array containing QueryRecords
+// =========================================================================================
+// constructQueryResponseFromIterator constructs a JSON array containing query results from
+// a given result iterator
+// =========================================================================================
+func constructQueryResponseFromIterator(resultsIterator shim.StateQueryIteratorInterface) (*bytes.Buffer, error) {
+	// buffer is a JSON array containing QueryRecords, each record is written as soon as it
+	// is read so only the output is held in memory
 	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false) // records are written as stored
 	buffer.WriteString("[")
 
 	bArrayMemberAlreadyWritten := false
@@ -172,24 +6122,110 @@ func getQueryResultForQueryString(stub shim.ChaincodeStubInterface, queryString
 		if err != nil {
 			return nil, err
 		}
+		// index entries are bookkeeping, not entries, they are never part of a result
+		if isCompositeKey(queryResponse.Key) {
+			continue
+		}
 		// Add a comma before array members, suppress it for the first array member
 		if bArrayMemberAlreadyWritten == true {
 			buffer.WriteString(",")
 		}
-		buffer.WriteString("{\"Key\":")
-		buffer.WriteString("\"")
-		buffer.WriteString(queryResponse.Key)
-		buffer.WriteString("\"")
-
-		buffer.WriteString(", \"Record\":")
-		// Record is a JSON object, so we write as-is
-		buffer.WriteString(string(queryResponse.Value))
-		buffer.WriteString("}")
+		err = encoder.Encode(newQueryRecord(queryResponse))
+		if err != nil {
+			return nil, err
+		}
+		buffer.Truncate(buffer.Len() - 1) // drop the newline the encoder ends every value with
 		bArrayMemberAlreadyWritten = true
 	}
 	buffer.WriteString("]")
 
-	fmt.Printf("- getQueryResultForQueryString queryResult:\n%s\n", buffer.String())
+	return &buffer, nil
+}
 
-	return buffer.Bytes(), nil
+// =========================================================================================
+// newQueryRecord builds the QueryRecord of a state value. Entries are stored as JSON and
+// are embedded as they are, any other value is embedded as a JSON string so that it can
+// never break the result apart.
+// =========================================================================================
+func newQueryRecord(kv *queryresult.KV) QueryRecord {
+	if json.Valid(kv.Value) {
+		return QueryRecord{kv.Key, json.RawMessage(kv.Value)}
+	}
+	valueAsBytes, _ := json.Marshal(string(kv.Value)) // marshalling a string cannot fail
+	return QueryRecord{kv.Key, json.RawMessage(valueAsBytes)}
+}
+
+// =========================================================================================
+// writeJSONString writes a string to the buffer as a quoted and escaped JSON string.
+// Strings coming from state or clients must never be concatenated into JSON unescaped.
+// =========================================================================================
+func writeJSONString(buffer *bytes.Buffer, value string) {
+	valueAsBytes, _ := json.Marshal(value) // marshalling a string cannot fail
+	buffer.Write(valueAsBytes)
+}
+
+// =========================================================================================
+// decodeIndexKey splits a key of the entry index objectType into its typed parts. Keys that
+// are not composite keys, belong to another index or have the wrong number of parts for the
+// index are malformed and fail.
+// =========================================================================================
+func decodeIndexKey(stub shim.ChaincodeStubInterface, key string, objectType string) (*decodedIndexKey, error) {
+	expectedParts, ok := indexKeyParts[objectType]
+	if !ok {
+		return nil, newChaincodeError(errCodeInternal, "Not an entry index: "+strconv.Quote(objectType))
+	}
+	// splitting a key outside the composite key namespace is not defined
+	if !isCompositeKey(key) {
+		return nil, newChaincodeError(errCodeInternal, "Malformed index key, not a composite key: "+strconv.Quote(key))
+	}
+	keyObjectType, keyParts, err := stub.SplitCompositeKey(key)
+	if err != nil {
+		return nil, newChaincodeError(errCodeInternal, "Malformed index key "+strconv.Quote(key)+": "+err.Error())
+	}
+	if keyObjectType != objectType {
+		return nil, newChaincodeError(errCodeInternal, "Malformed index key, expected a "+objectType+" key: "+strconv.Quote(key))
+	}
+	if len(keyParts) != expectedParts {
+		return nil, newChaincodeError(errCodeInternal, fmt.Sprintf("Malformed index key, expected %d parts, got %d: %q", expectedParts, len(keyParts), key))
+	}
+
+	decoded := &decodedIndexKey{ObjectType: keyObjectType, DeviceName: keyParts[0]}
+	switch objectType {
+	case deviceAttrIndexName:
+		decoded.Attribute = keyParts[1]
+		decoded.Timestamp = keyParts[2]
+	case deviceAttributeIndexName:
+		decoded.Attribute = keyParts[1]
+	case deviceBucketIndexName:
+		decoded.Bucket = keyParts[1]
+		decoded.Timestamp = keyParts[2]
+	}
+	return decoded, nil
+}
+
+// =========================================================================================
+// isCompositeKey tells whether a key was built by CreateCompositeKey, such keys
+// start with the composite key namespace (the null character)
+// =========================================================================================
+func isCompositeKey(key string) bool {
+	return strings.HasPrefix(key, compositeKeyNamespace)
+}
+
+// =========================================================================================
+// addPaginationMetadataToQueryResults wraps the JSON array of query results into an object
+// that also holds the pagination metadata (fetched records count and next bookmark)
+// =========================================================================================
+func addPaginationMetadataToQueryResults(buffer *bytes.Buffer, responseMetadata *pb.QueryResponseMetadata) *bytes.Buffer {
+
+	var wrapped bytes.Buffer
+	wrapped.WriteString("{\"Records\":")
+	wrapped.Write(buffer.Bytes())
+
+	wrapped.WriteString(", \"ResponseMetadata\":{\"FetchedRecordsCount\":")
+	wrapped.WriteString(strconv.FormatInt(int64(responseMetadata.FetchedRecordsCount), 10))
+	wrapped.WriteString(", \"Bookmark\":")
+	writeJSONString(&wrapped, responseMetadata.Bookmark)
+	wrapped.WriteString("}}")
+
+	return &wrapped
 }
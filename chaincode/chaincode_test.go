@@ -0,0 +1,3512 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
+	"github.com/hyperledger/fabric/protos/msp"
+)
+
+// newTestStub returns a MockStub invoked by a client of an authorized organization
+func newTestStub() *shim.MockStub {
+	stub := shim.NewMockStub("ars", new(SimpleChaincode))
+	stub.Creator = newSerializedIdentity("Org1MSP", "gateway-1")
+	return stub
+}
+
+// newStrictTestStub is newTestStub instantiated like a new deployment, strict mode is on
+func newStrictTestStub() *shim.MockStub {
+	stub := newTestStub()
+	mockInit(stub, "instantiate", nil)
+	return stub
+}
+
+// newSerializedIdentity builds the creator of a transaction, a serialized identity
+// holding a self-signed certificate with the given common name
+func newSerializedIdentity(mspID string, commonName string) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+
+	creator, err := proto.Marshal(&msp.SerializedIdentity{Mspid: mspID, IdBytes: certPEM})
+	if err != nil {
+		panic(err)
+	}
+	return creator
+}
+
+// keyOf returns the stored key of an entry written with an RFC3339 timestamp
+func keyOf(timestamp string) string {
+	parsed, err := time.Parse(time.RFC3339Nano, timestamp)
+	if err != nil {
+		panic(err)
+	}
+	return normalizeTimestamp(parsed)
+}
+
+// keysOf returns the stored keys of entries written with RFC3339 timestamps
+func keysOf(timestamps ...string) []string {
+	keys := make([]string, len(timestamps))
+	for i, timestamp := range timestamps {
+		keys[i] = keyOf(timestamp)
+	}
+	return keys
+}
+
+// checkErrorCode asserts that err is a structured chaincode error with the given code
+func checkErrorCode(t *testing.T, err error, code string) {
+	t.Helper()
+	if err == nil {
+		t.Fatalf("expected %s error, got none", code)
+	}
+	ccErr, ok := err.(*chaincodeError)
+	if !ok {
+		t.Fatalf("expected a chaincode error, got %T: %v", err, err)
+	}
+	if ccErr.Code != code {
+		t.Fatalf("expected code %s, got %s (%s)", code, ccErr.Code, ccErr.Message)
+	}
+}
+
+// mockArgs builds the arguments of a proposal, the function name followed by its arguments
+func mockArgs(function string, args []string) [][]byte {
+	proposalArgs := [][]byte{[]byte(function)}
+	for _, arg := range args {
+		proposalArgs = append(proposalArgs, []byte(arg))
+	}
+	return proposalArgs
+}
+
+// mockInvoke runs an invoke function in a mock transaction and returns its result, errors
+// keep their type. What Invoke sends to the peer is covered by TestInvokeResponse.
+func mockInvoke(stub *shim.MockStub, txID string, function string, args []string) ([]byte, error) {
+	stub.MockTransactionStart(txID)
+	defer stub.MockTransactionEnd(txID)
+	return new(SimpleChaincode).invoke(stub, function, args)
+}
+
+// mockInit runs Init in a mock transaction, like mockInvoke
+func mockInit(stub *shim.MockStub, txID string, args []string) ([]byte, error) {
+	stub.MockTransactionStart(txID)
+	defer stub.MockTransactionEnd(txID)
+	return new(SimpleChaincode).initialize(stub, args)
+}
+
+// mockQueryEnvelope sends a query through Invoke, like a peer would, and returns the
+// QueryResponse envelope it answers with
+func mockQueryEnvelope(stub *shim.MockStub, function string, args []string) ([]byte, error) {
+	response := stub.MockInvoke("query", mockArgs(function, args))
+	if response.Status != shim.OK {
+		return nil, errors.New(response.Message)
+	}
+	return response.Payload, nil
+}
+
+// mockQuery runs a query through Invoke and unwraps its response envelope, returning the
+// payload or the error described by the envelope as a chaincode error
+func mockQuery(stub *shim.MockStub, function string, args []string) (json.RawMessage, error) {
+	responseAsBytes, err := mockQueryEnvelope(stub, function, args)
+	if err != nil {
+		return nil, err
+	}
+	response := QueryResponse{}
+	if err := json.Unmarshal(responseAsBytes, &response); err != nil {
+		return nil, err
+	}
+	if response.Status != statusOK {
+		return nil, &chaincodeError{Message: response.Message, Code: response.Code}
+	}
+	return response.Payload, nil
+}
+
+func TestCreateEntry(t *testing.T) {
+	stub := newTestStub()
+
+	payload, err := mockInvoke(stub, "tx1", "create", []string{"2017-06-01T10:00:00Z", "sensor-1", "temperature", "21.5"})
+	if err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+
+	response := EntryResponse{}
+	if err := json.Unmarshal(payload, &response); err != nil {
+		t.Fatalf("create returned invalid JSON: %v", err)
+	}
+	if response.TxID != "tx1" {
+		t.Fatalf("expected transaction ID tx1, got %q", response.TxID)
+	}
+	entry := Entry{}
+	if err := json.Unmarshal(response.Entry, &entry); err != nil {
+		t.Fatalf("create returned an invalid entry: %v", err)
+	}
+	if entry.Timestamp != "2017-06-01T10:00:00.000000000Z" || entry.DeviceName != "sensor-1" ||
+		entry.Attribute != "temperature" || string(entry.AttributeValue) != `"21.5"` {
+		t.Fatalf("unexpected entry returned: %+v", entry)
+	}
+	if entry.CreatedBy == nil || entry.CreatedBy.MSPID != "Org1MSP" || entry.CreatedBy.CommonName != "gateway-1" {
+		t.Fatalf("unexpected creator recorded: %+v", entry.CreatedBy)
+	}
+	if _, err := time.Parse(time.RFC3339Nano, entry.TxTimestamp); err != nil {
+		t.Fatalf("invalid transaction timestamp recorded %q: %v", entry.TxTimestamp, err)
+	}
+
+	stored := stub.State["2017-06-01T10:00:00.000000000Z"]
+	if string(stored) != string(response.Entry) {
+		t.Fatalf("stored entry %s does not match returned entry %s", stored, response.Entry)
+	}
+
+	indexKey, _ := stub.CreateCompositeKey(deviceAttrIndexName, []string{"sensor-1", "temperature", "2017-06-01T10:00:00.000000000Z"})
+	if stub.State[indexKey] == nil {
+		t.Fatalf("index entry was not stored")
+	}
+}
+
+func TestCreateEntryInvalidArgs(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{"no args", []string{}},
+		{"missing args", []string{"2017-06-01T10:00:00Z", "sensor-1", "temperature"}},
+		{"empty timestamp", []string{"", "sensor-1", "temperature", "21.5"}},
+		{"empty deviceName", []string{"2017-06-01T10:00:00Z", "", "temperature", "21.5"}},
+		{"empty attribute", []string{"2017-06-01T10:00:00Z", "sensor-1", "", "21.5"}},
+		{"empty attributeValue", []string{"2017-06-01T10:00:00Z", "sensor-1", "temperature", ""}},
+		{"invalid timestamp", []string{"yesterday", "sensor-1", "temperature", "21.5"}},
+		{"reserved prefix", []string{"_2017-06-01T10:00:00Z", "sensor-1", "temperature", "21.5"}},
+		{"index prefix", []string{"device~attr~time", "sensor-1", "temperature", "21.5"}},
+		{"future timestamp", []string{time.Now().UTC().Add(time.Hour).Format(time.RFC3339), "sensor-1", "temperature", "21.5"}},
+		{"whitespace deviceName", []string{"2017-06-01T10:00:00Z", "   ", "temperature", "21.5"}},
+		{"deviceName with space", []string{"2017-06-01T10:00:00Z", "sensor 1", "temperature", "21.5"}},
+		{"deviceName with null character", []string{"2017-06-01T10:00:00Z", "sensor\x001", "temperature", "21.5"}},
+		{"deviceName with control character", []string{"2017-06-01T10:00:00Z", "sensor\n1", "temperature", "21.5"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stub := newStrictTestStub()
+			stored := len(stub.State)
+
+			_, err := mockInvoke(stub, "tx1", "create", test.args)
+			checkErrorCode(t, err, errCodeBadArgs)
+			if len(stub.State) != stored {
+				t.Fatalf("nothing should be stored, found %d keys", len(stub.State)-stored)
+			}
+		})
+	}
+}
+
+func TestCreateEntryJSONValue(t *testing.T) {
+	stub := newTestStub()
+
+	_, err := mockInvoke(stub, "tx1", "create", []string{"2017-06-01T10:00:00Z", "gps-1", "position", `{"lat":45.81,"lon":15.98}`, "json"})
+	if err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	var stored struct {
+		AttributeValue struct {
+			Lat float64 `json:"lat"`
+			Lon float64 `json:"lon"`
+		} `json:"attributeValue"`
+	}
+	if err := json.Unmarshal(stub.State["2017-06-01T10:00:00.000000000Z"], &stored); err != nil {
+		t.Fatalf("stored entry is not a nested JSON value: %v", err)
+	}
+	if stored.AttributeValue.Lat != 45.81 || stored.AttributeValue.Lon != 15.98 {
+		t.Fatalf("unexpected value stored: %s", stub.State["2017-06-01T10:00:00.000000000Z"])
+	}
+
+	_, err = mockInvoke(stub, "tx2", "create", []string{"2017-06-01T11:00:00Z", "gps-1", "position", `{"lat":`, "json"})
+	checkErrorCode(t, err, errCodeBadArgs)
+}
+
+func TestCreateEntryDuplicate(t *testing.T) {
+	stub := newTestStub()
+	args := []string{"2017-06-01T10:00:00Z", "sensor-1", "temperature", "21.5"}
+
+	if _, err := mockInvoke(stub, "tx1", "create", args); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	stored := string(stub.State["2017-06-01T10:00:00.000000000Z"])
+
+	_, err := mockInvoke(stub, "tx2", "create", []string{"2017-06-01T10:00:00Z", "sensor-2", "humidity", "40"})
+	checkErrorCode(t, err, errCodeDuplicateKey)
+	if string(stub.State["2017-06-01T10:00:00.000000000Z"]) != stored {
+		t.Fatalf("duplicate create overwrote the stored entry")
+	}
+}
+
+func TestCreateEntryUnauthorizedOrganization(t *testing.T) {
+	stub := newTestStub()
+	stub.Creator = newSerializedIdentity("Org2MSP", "gateway-2")
+
+	_, err := mockInvoke(stub, "tx1", "create", []string{"2017-06-01T10:00:00Z", "sensor-1", "temperature", "21.5"})
+	checkErrorCode(t, err, errCodeForbidden)
+	if len(stub.State) != 0 {
+		t.Fatalf("nothing should be stored, found %d keys", len(stub.State))
+	}
+}
+
+// failingGetStateStub is a MockStub whose GetState always fails for entry keys,
+// reads of composite keys such as the device registry still succeed
+type failingGetStateStub struct {
+	*shim.MockStub
+}
+
+func (stub *failingGetStateStub) GetState(key string) ([]byte, error) {
+	if isCompositeKey(key) {
+		return stub.MockStub.GetState(key)
+	}
+	return nil, errors.New("state database unavailable")
+}
+
+func TestCreateEntryExistingKeyErrors(t *testing.T) {
+	args := []string{"2017-06-01T10:00:00Z", "sensor-1", "temperature", "21.5"}
+
+	tests := []struct {
+		name    string
+		stub    func() shim.ChaincodeStubInterface
+		code    string
+		message string
+	}{
+		{
+			name: "entry already exists",
+			stub: func() shim.ChaincodeStubInterface {
+				stub := newTestStub()
+				stub.MockTransactionStart("seed")
+				stub.PutState("2017-06-01T10:00:00.000000000Z", []byte(`{"timestamp":"2017-06-01T10:00:00.000000000Z"}`))
+				stub.MockTransactionEnd("seed")
+				stub.MockTransactionStart("tx1")
+				return stub
+			},
+			code:    errCodeDuplicateKey,
+			message: "This entry already exists: 2017-06-01T10:00:00.000000000Z",
+		},
+		{
+			name: "GetState fails",
+			stub: func() shim.ChaincodeStubInterface {
+				stub := newTestStub()
+				stub.MockTransactionStart("tx1")
+				return &failingGetStateStub{stub}
+			},
+			code:    errCodeInternal,
+			message: "Failed to get entry: state database unavailable",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := new(SimpleChaincode).createEntry(test.stub(), args)
+			checkErrorCode(t, err, test.code)
+			if !strings.Contains(err.(*chaincodeError).Message, test.message) {
+				t.Fatalf("expected message %q, got %q", test.message, err.(*chaincodeError).Message)
+			}
+		})
+	}
+}
+
+// fakeStateIterator iterates over a fixed list of key/value pairs
+type fakeStateIterator struct {
+	kvs  []*queryresult.KV
+	next int
+}
+
+func (it *fakeStateIterator) HasNext() bool {
+	return it.next < len(it.kvs)
+}
+
+func (it *fakeStateIterator) Close() error {
+	return nil
+}
+
+func (it *fakeStateIterator) Next() (*queryresult.KV, error) {
+	if !it.HasNext() {
+		return nil, errors.New("no more results")
+	}
+	it.next++
+	return it.kvs[it.next-1], nil
+}
+
+func TestConstructQueryResponseEscapesKeysAndValues(t *testing.T) {
+	tests := []struct {
+		name   string
+		key    string
+		value  string
+		record string
+	}{
+		{"plain timestamp", "2017-06-01T10:00:00Z", `{"deviceName":"sensor-1"}`, `{"deviceName":"sensor-1"}`},
+		{"unicode", "sensor-ü-2017", `{"deviceName":"sensor-ü"}`, `{"deviceName":"sensor-ü"}`},
+		{"double quote", `2017-06-01T10:00:00Z"`, `{"deviceName":"sensor-1"}`, `{"deviceName":"sensor-1"}`},
+		{"backslash", `2017-06-01\T10:00:00Z`, `{"deviceName":"sensor-1"}`, `{"deviceName":"sensor-1"}`},
+		{"control characters", "2017-06-01\tT10:00:00Z\n", `{"deviceName":"sensor-1"}`, `{"deviceName":"sensor-1"}`},
+		{"html characters", "<2017-06-01&T10:00:00Z>", `{"deviceName":"sensor-<1>"}`, `{"deviceName":"sensor-<1>"}`},
+		{"non JSON value", "2017-06-01T10:00:00Z", `not json", "injected":"`, `"not json\", \"injected\":\""`},
+		{"truncated JSON value", "2017-06-01T10:00:00Z", `{"deviceName":`, `"{\"deviceName\":"`},
+		{"binary value", "2017-06-01T10:00:00Z", "\x00\x01", `"\u0000\u0001"`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			kvs := []*queryresult.KV{
+				{Key: test.key, Value: []byte(test.value)},
+				{Key: "2017-06-01T11:00:00Z", Value: []byte(`{"timestamp":"2017-06-01T11:00:00Z","deviceName":"sensor-<1>"}`)},
+			}
+
+			buffer, err := constructQueryResponseFromIterator(&fakeStateIterator{kvs: kvs})
+			if err != nil {
+				t.Fatalf("constructQueryResponseFromIterator failed: %v", err)
+			}
+
+			var records []QueryRecord
+			if err := json.Unmarshal(buffer.Bytes(), &records); err != nil {
+				t.Fatalf("output is not valid JSON: %v\n%s", err, buffer.String())
+			}
+			if len(records) != len(kvs) {
+				t.Fatalf("expected %d records, got %d: %s", len(kvs), len(records), buffer.String())
+			}
+			if records[0].Key != test.key || string(records[0].Record) != test.record {
+				t.Fatalf("unexpected record %s: %s, expected %s", records[0].Key, records[0].Record, test.record)
+			}
+			if records[1].Key != kvs[1].Key || string(records[1].Record) != string(kvs[1].Value) {
+				t.Fatalf("record does not round trip: %+v", records[1])
+			}
+		})
+	}
+}
+
+// richQueryStub is a MockStub that answers every rich query with all keys in state,
+// emulating a selector that matches everything
+type richQueryStub struct {
+	*shim.MockStub
+}
+
+func (stub *richQueryStub) GetQueryResult(query string) (shim.StateQueryIteratorInterface, error) {
+	return stub.GetStateByRange("", "")
+}
+
+func TestQueryResultEscapesKeys(t *testing.T) {
+	stub := newTestStub()
+	key := `2017-06-01T10:00:00Z" ,"injected":"`
+	stub.MockTransactionStart("seed")
+	stub.PutState(key, []byte(`{"timestamp":"2017-06-01T10:00:00Z","deviceName":"sensor-1"}`))
+	stub.MockTransactionEnd("seed")
+
+	result, err := getQueryResultForQueryString(&richQueryStub{stub}, `{"selector":{}}`)
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+
+	var records []QueryRecord
+	if err := json.Unmarshal(result, &records); err != nil {
+		t.Fatalf("query output is not valid JSON: %v\n%s", err, result)
+	}
+	if len(records) != 1 || records[0].Key != key {
+		t.Fatalf("unexpected records: %+v", records)
+	}
+}
+
+// fakeQueryStub is a MockStub that answers every rich query with a fixed list of
+// key/value pairs and records the query it received
+type fakeQueryStub struct {
+	*shim.MockStub
+	kvs   []*queryresult.KV
+	query string
+}
+
+func (stub *fakeQueryStub) GetQueryResult(query string) (shim.StateQueryIteratorInterface, error) {
+	stub.query = query
+	return &fakeStateIterator{kvs: stub.kvs}, nil
+}
+
+func TestGetQueryResultForQueryString(t *testing.T) {
+	indexKey, _ := newTestStub().CreateCompositeKey(deviceAttrIndexName, []string{"sensor-1", "temperature", "2017-06-01T10:00:00Z"})
+
+	tests := []struct {
+		name     string
+		kvs      []*queryresult.KV
+		expected string
+	}{
+		{"empty", []*queryresult.KV{}, "[]"},
+		{
+			"single record",
+			[]*queryresult.KV{{Key: "2017-06-01T10:00:00Z", Value: []byte(`{"deviceName":"sensor-1"}`)}},
+			"[{\"Key\":\"2017-06-01T10:00:00Z\",\"Record\":{\"deviceName\":\"sensor-1\"}}]",
+		},
+		{
+			"several records",
+			[]*queryresult.KV{
+				{Key: "2017-06-01T10:00:00Z", Value: []byte(`{"deviceName":"sensor-1"}`)},
+				{Key: "2017-06-01T11:00:00Z", Value: []byte(`{"deviceName":"sensor-2"}`)},
+				{Key: "2017-06-01T12:00:00Z", Value: []byte(`{"deviceName":"sensor-3"}`)},
+			},
+			"[{\"Key\":\"2017-06-01T10:00:00Z\",\"Record\":{\"deviceName\":\"sensor-1\"}}" +
+				",{\"Key\":\"2017-06-01T11:00:00Z\",\"Record\":{\"deviceName\":\"sensor-2\"}}" +
+				",{\"Key\":\"2017-06-01T12:00:00Z\",\"Record\":{\"deviceName\":\"sensor-3\"}}]",
+		},
+		{
+			"index entries are left out",
+			[]*queryresult.KV{
+				{Key: indexKey, Value: []byte{0x00}},
+				{Key: "2017-06-01T10:00:00Z", Value: []byte(`{"deviceName":"sensor-1"}`)},
+			},
+			"[{\"Key\":\"2017-06-01T10:00:00Z\",\"Record\":{\"deviceName\":\"sensor-1\"}}]",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stub := &fakeQueryStub{MockStub: newTestStub(), kvs: test.kvs}
+
+			result, err := getQueryResultForQueryString(stub, `{"selector":{}}`)
+			if err != nil {
+				t.Fatalf("query failed: %v", err)
+			}
+			if string(result) != test.expected {
+				t.Fatalf("unexpected query result:\n%q\nexpected:\n%q", result, test.expected)
+			}
+			if stub.query != `{"selector":{}}` {
+				t.Fatalf("unexpected query string passed on: %s", stub.query)
+			}
+		})
+	}
+}
+
+func TestAdHocQuery(t *testing.T) {
+	stub := &fakeQueryStub{MockStub: newTestStub(), kvs: []*queryresult.KV{
+		{Key: "2017-06-01T10:00:00Z", Value: []byte(`{"deviceName":"sensor-1"}`)},
+		{Key: "2017-06-01T11:00:00Z", Value: []byte(`{"deviceName":"sensor-1"}`)},
+	}}
+	queryString := `{"selector":{"deviceName":"sensor-1"}}`
+
+	result, err := new(SimpleChaincode).adHocQuery(stub, []string{queryString})
+	if err != nil {
+		t.Fatalf("adHocQuery failed: %v", err)
+	}
+	if stub.query != queryString {
+		t.Fatalf("unexpected query string passed on: %s", stub.query)
+	}
+	var records []QueryRecord
+	if err := json.Unmarshal(result, &records); err != nil {
+		t.Fatalf("adHocQuery returned invalid JSON: %v\n%s", err, result)
+	}
+	if len(records) != 2 || records[0].Key != "2017-06-01T10:00:00Z" || records[1].Key != "2017-06-01T11:00:00Z" {
+		t.Fatalf("unexpected records: %+v", records)
+	}
+}
+
+func TestLimitedStateIterator(t *testing.T) {
+	kvs := []*queryresult.KV{
+		{Key: "2017-06-01T10:00:00Z", Value: []byte(`{}`)},
+		{Key: "2017-06-01T11:00:00Z", Value: []byte(`{}`)},
+		{Key: "2017-06-01T12:00:00Z", Value: []byte(`{}`)},
+	}
+
+	tests := []struct {
+		limit     int
+		truncated bool
+	}{
+		{2, true},
+		{3, false},
+		{4, false},
+	}
+
+	for _, test := range tests {
+		it := &limitedStateIterator{&fakeStateIterator{kvs: kvs}, test.limit, false}
+		buffer, err := constructQueryResponseFromIterator(it)
+		if err != nil {
+			t.Fatalf("limit %d: %v", test.limit, err)
+		}
+		var records []QueryRecord
+		if err := json.Unmarshal(buffer.Bytes(), &records); err != nil {
+			t.Fatalf("limit %d: invalid JSON: %v", test.limit, err)
+		}
+		if it.truncated != test.truncated {
+			t.Fatalf("limit %d: expected truncated=%v", test.limit, test.truncated)
+		}
+		expected := len(kvs)
+		if test.limit < expected {
+			expected = test.limit
+		}
+		if len(records) != expected {
+			t.Fatalf("limit %d: expected %d records, got %d", test.limit, expected, len(records))
+		}
+	}
+}
+
+func TestTooManyArguments(t *testing.T) {
+	tests := []struct {
+		name     string
+		invoke   bool
+		function string
+		args     []string
+	}{
+		{"create", true, "create", []string{"2017-06-01T10:00:00Z", "sensor-1", "temperature", "21.5", "number", "extra"}},
+		{"update", true, "update", []string{"2017-06-01T10:00:00Z", "22", "1", "true", "extra"}},
+		{"delete", true, "delete", []string{"2017-06-01T10:00:00Z", "extra"}},
+		{"adHocQuery", false, "adHocQuery", []string{`{"selector":{}}`, "extra"}},
+		{"adHocQueryWithPagination", false, "adHocQueryWithPagination", []string{`{"selector":{}}`, "10", "bookmark", "extra"}},
+		{"history", false, "history", []string{"2017-06-01T10:00:00Z", "extra"}},
+		{"queryByDevice", false, "queryByDevice", []string{"sensor-1", "true", "extra"}},
+		{"byTimeRange", false, "byTimeRange", []string{"2017-06-01T10:00:00Z", "2017-06-02T10:00:00Z", "true", "false", "extra"}},
+		{"info", false, "info", []string{"extra"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stub := newTestStub()
+
+			var err error
+			if test.invoke {
+				_, err = mockInvoke(stub, "tx1", test.function, test.args)
+			} else {
+				_, err = mockQuery(stub, test.function, test.args)
+			}
+			checkErrorCode(t, err, errCodeBadArgs)
+			if !strings.Contains(err.(*chaincodeError).Message, "too many arguments") {
+				t.Fatalf("expected a too many arguments error, got %q", err.(*chaincodeError).Message)
+			}
+		})
+	}
+}
+
+func TestSoftDeleteEntry(t *testing.T) {
+	stub := newTestStub()
+	for i, timestamp := range []string{"2017-06-01T10:00:00Z", "2017-06-01T11:00:00Z", "2017-06-01T12:00:00Z"} {
+		if _, err := mockInvoke(stub, "create"+strconv.Itoa(i), "create", []string{timestamp, "sensor-1", "temperature", "21.5"}); err != nil {
+			t.Fatalf("create failed: %v", err)
+		}
+	}
+
+	payload, err := mockInvoke(stub, "tx1", "softDelete", []string{"2017-06-01T11:00:00Z"})
+	if err != nil {
+		t.Fatalf("softDelete failed: %v", err)
+	}
+	entry := Entry{}
+	if err := json.Unmarshal(payload, &entry); err != nil || !entry.Deleted || entry.DeletedAt == "" {
+		t.Fatalf("entry not marked deleted: %s", payload)
+	}
+	if stub.State["2017-06-01T11:00:00.000000000Z"] == nil {
+		t.Fatalf("soft-deleted entry was removed from state")
+	}
+
+	_, err = mockInvoke(stub, "tx2", "softDelete", []string{"2017-06-01T11:00:00Z"})
+	checkErrorCode(t, err, errCodeNotFound)
+
+	tests := []struct {
+		args     []string
+		expected []string
+	}{
+		{[]string{"2017-06-01T00:00:00Z", "2017-06-02T00:00:00Z"}, []string{"2017-06-01T10:00:00Z", "2017-06-01T12:00:00Z"}},
+		{[]string{"2017-06-01T00:00:00Z", "2017-06-02T00:00:00Z", "false"}, []string{"2017-06-01T10:00:00Z", "2017-06-01T12:00:00Z"}},
+		{[]string{"2017-06-01T00:00:00Z", "2017-06-02T00:00:00Z", "true"}, []string{"2017-06-01T10:00:00Z", "2017-06-01T11:00:00Z", "2017-06-01T12:00:00Z"}},
+		{[]string{"2017-06-01T00:00:00Z", "2017-06-02T00:00:00Z", "false", "true"}, []string{"2017-06-01T12:00:00Z", "2017-06-01T10:00:00Z"}},
+		{[]string{"2017-06-01T00:00:00Z", "2017-06-02T00:00:00Z", "true", "true"}, []string{"2017-06-01T12:00:00Z", "2017-06-01T11:00:00Z", "2017-06-01T10:00:00Z"}},
+	}
+	for _, test := range tests {
+		result, err := mockQuery(stub, "byTimeRange", test.args)
+		if err != nil {
+			t.Fatalf("byTimeRange %v failed: %v", test.args, err)
+		}
+		var records []QueryRecord
+		if err := json.Unmarshal(result, &records); err != nil {
+			t.Fatalf("byTimeRange %v returned invalid JSON: %v", test.args, err)
+		}
+		keys := []string{}
+		for _, record := range records {
+			keys = append(keys, record.Key)
+		}
+		if strings.Join(keys, ",") != strings.Join(keysOf(test.expected...), ",") {
+			t.Fatalf("byTimeRange %v returned %v, expected %v", test.args, keys, test.expected)
+		}
+	}
+}
+
+func TestSoftDeletedEntryCannotBeModified(t *testing.T) {
+	stub := newTestStub()
+	if _, err := mockInvoke(stub, "tx1", "create", []string{"2017-06-01T10:00:00Z", "sensor-1", "temperature", "21.5"}); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	if _, err := mockInvoke(stub, "tx2", "addTag", []string{"2017-06-01T10:00:00Z", "calibrated"}); err != nil {
+		t.Fatalf("addTag failed: %v", err)
+	}
+	payload, err := mockInvoke(stub, "tx3", "softDelete", []string{"2017-06-01T10:00:00Z"})
+	if err != nil {
+		t.Fatalf("softDelete failed: %v", err)
+	}
+	deleted := stub.State[keyOf("2017-06-01T10:00:00Z")]
+	entry := Entry{}
+	if err := json.Unmarshal(payload, &entry); err != nil {
+		t.Fatalf("invalid softDelete response %s: %v", payload, err)
+	}
+	version := strconv.Itoa(entry.Version)
+
+	tests := []struct {
+		function string
+		args     []string
+	}{
+		{"update", []string{"2017-06-01T10:00:00Z", "22", version}},
+		{"update", []string{"2017-06-01T10:00:00Z", "22", version, "true"}},
+		{"patch", []string{"2017-06-01T10:00:00Z", `{"attributeValue":"22"}`, version}},
+		{"addTag", []string{"2017-06-01T10:00:00Z", "reviewed"}},
+		{"removeTag", []string{"2017-06-01T10:00:00Z", "calibrated"}},
+	}
+	for i, test := range tests {
+		_, err := mockInvoke(stub, "modify"+strconv.Itoa(i), test.function, test.args)
+		var notFoundErr *NotFoundError
+		if !errors.As(err, &notFoundErr) || !strings.Contains(err.Error(), "entry deleted") {
+			t.Fatalf("%s of a soft-deleted entry returned %v", test.function, err)
+		}
+		if string(stub.State[keyOf("2017-06-01T10:00:00Z")]) != string(deleted) {
+			t.Fatalf("%s modified a soft-deleted entry", test.function)
+		}
+	}
+}
+
+func TestUpdateEntryReturnsTransactionID(t *testing.T) {
+	stub := newTestStub()
+	if _, err := mockInvoke(stub, "tx1", "create", []string{"2017-06-01T10:00:00Z", "sensor-1", "temperature", "21.5"}); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+
+	payload, err := mockInvoke(stub, "tx2", "update", []string{"2017-06-01T10:00:00Z", "22", "1"})
+	if err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+	response := EntryResponse{}
+	if err := json.Unmarshal(payload, &response); err != nil {
+		t.Fatalf("update returned invalid JSON: %v", err)
+	}
+	if response.TxID == "" || response.TxID != "tx2" {
+		t.Fatalf("expected transaction ID tx2, got %q", response.TxID)
+	}
+	entry := Entry{}
+	if err := json.Unmarshal(response.Entry, &entry); err != nil || string(entry.AttributeValue) != `"22"` {
+		t.Fatalf("update returned unexpected entry: %s", response.Entry)
+	}
+}
+
+func TestDeleteEntriesByDevice(t *testing.T) {
+	stub := newTestStub()
+	entries := [][]string{
+		{"2017-06-01T10:00:00Z", "sensor-1", "temperature", "21.5"},
+		{"2017-06-01T11:00:00Z", "sensor-1", "humidity", "40"},
+		{"2017-06-01T12:00:00Z", "sensor-1", "temperature", "22"},
+		{"2017-06-01T13:00:00Z", "sensor-2", "temperature", "19"},
+	}
+	for i, args := range entries {
+		if _, err := mockInvoke(stub, "create"+strconv.Itoa(i), "create", args); err != nil {
+			t.Fatalf("create failed: %v", err)
+		}
+	}
+
+	defer func(limit int) { maxDeletionsPerCall = limit }(maxDeletionsPerCall)
+	maxDeletionsPerCall = 2
+
+	args := []string{"sensor-1"}
+	deleted := 0
+	for calls := 0; ; calls++ {
+		if calls > 2 {
+			t.Fatalf("deletion did not finish after %d calls", calls)
+		}
+		payload, err := mockInvoke(stub, "delete"+strconv.Itoa(calls), "deleteByDevice", args)
+		if err != nil {
+			t.Fatalf("deleteByDevice failed: %v", err)
+		}
+		result := DeletionResult{}
+		if err := json.Unmarshal(payload, &result); err != nil {
+			t.Fatalf("deleteByDevice returned invalid JSON: %v", err)
+		}
+		if result.Deleted > maxDeletionsPerCall {
+			t.Fatalf("deleted %d entries in one call, limit is %d", result.Deleted, maxDeletionsPerCall)
+		}
+		deleted += result.Deleted
+		if result.Bookmark == "" {
+			break
+		}
+		args = []string{"sensor-1", result.Bookmark}
+	}
+
+	if deleted != 3 {
+		t.Fatalf("expected 3 entries deleted, got %d", deleted)
+	}
+	for _, args := range entries[:3] {
+		if stub.State[keyOf(args[0])] != nil {
+			t.Fatalf("entry %s was not deleted", args[0])
+		}
+	}
+	if stub.State["2017-06-01T13:00:00.000000000Z"] == nil {
+		t.Fatalf("entry of another device was deleted")
+	}
+	for key := range stub.State {
+		if strings.Contains(key, "sensor-1") {
+			t.Fatalf("index entry %q was not deleted", key)
+		}
+	}
+}
+
+func TestRegisterDevice(t *testing.T) {
+	stub := newTestStub()
+
+	if _, err := mockInvoke(stub, "tx1", "registerDevice", []string{"sensor-1", `["temperature","humidity"]`}); err != nil {
+		t.Fatalf("registerDevice failed: %v", err)
+	}
+
+	if _, err := mockInvoke(stub, "tx2", "create", []string{"2017-06-01T10:00:00Z", "sensor-1", "temperature", "21.5"}); err != nil {
+		t.Fatalf("create of a registered attribute failed: %v", err)
+	}
+	_, err := mockInvoke(stub, "tx3", "create", []string{"2017-06-01T11:00:00Z", "sensor-1", "temprature", "21.5"})
+	checkErrorCode(t, err, errCodeBadArgs)
+	if stub.State["2017-06-01T11:00:00.000000000Z"] != nil {
+		t.Fatalf("entry with an unregistered attribute was stored")
+	}
+	if _, err := mockInvoke(stub, "tx4", "create", []string{"2017-06-01T12:00:00Z", "sensor-2", "temprature", "21.5"}); err != nil {
+		t.Fatalf("create for an unregistered device failed: %v", err)
+	}
+}
+
+func TestQueryResponseEnvelope(t *testing.T) {
+	stub := newTestStub()
+
+	responseAsBytes, err := mockQueryEnvelope(stub, "exists", []string{"2017-06-01T10:00:00Z"})
+	if err != nil {
+		t.Fatalf("exists failed: %v", err)
+	}
+	if string(responseAsBytes) != `{"status":200,"payload":{"exists":false}}` {
+		t.Fatalf("unexpected success envelope %s", responseAsBytes)
+	}
+
+	responseAsBytes, err = mockQueryEnvelope(stub, "history", []string{})
+	if err != nil {
+		t.Fatalf("a failing query must still return an envelope, got %v", err)
+	}
+	response := QueryResponse{}
+	if err := json.Unmarshal(responseAsBytes, &response); err != nil {
+		t.Fatalf("invalid error envelope %s: %v", responseAsBytes, err)
+	}
+	if response.Status != statusBadRequest || response.Code != errCodeBadArgs || response.Message == "" || response.Payload != nil {
+		t.Fatalf("unexpected error envelope %s", responseAsBytes)
+	}
+}
+
+func TestInvokeResponse(t *testing.T) {
+	stub := newTestStub()
+	seed := `[{"timestamp":"2017-06-01T10:00:00Z","deviceName":"sensor-1","attribute":"temperature","attributeValue":"21.5"}]`
+
+	// Init takes the arguments following the function name of the proposal
+	response := stub.MockInit("tx1", mockArgs("init", []string{seed}))
+	if response.Status != shim.OK || stub.State[keyOf("2017-06-01T10:00:00Z")] == nil {
+		t.Fatalf("Init failed: %+v", response)
+	}
+	response = stub.MockInit("tx2", mockArgs("init", []string{"not a seed"}))
+	if response.Status != shim.ERROR || !strings.Contains(response.Message, `"code":"BAD_ARGS"`) {
+		t.Fatalf("unexpected response to an invalid seed: %+v", response)
+	}
+
+	response = stub.MockInvoke("tx3", mockArgs("create", []string{"2017-06-01T11:00:00Z", "sensor-1", "temperature", "22"}))
+	entryResponse := EntryResponse{}
+	if response.Status != shim.OK || json.Unmarshal(response.Payload, &entryResponse) != nil || entryResponse.TxID != "tx3" {
+		t.Fatalf("create failed: %+v", response)
+	}
+
+	// failed invocations are error responses carrying the JSON error
+	response = stub.MockInvoke("tx4", mockArgs("create", []string{"2017-06-01T11:00:00Z", "sensor-1", "temperature", "22"}))
+	if response.Status != shim.ERROR || response.Message != `{"error":"This entry already exists: 2017-06-01T11:00:00.000000000Z","code":"DUPLICATE_KEY"}` {
+		t.Fatalf("unexpected response to a duplicate entry: %+v", response)
+	}
+	response = stub.MockInvoke("tx5", mockArgs("unknown", []string{}))
+	if response.Status != shim.ERROR || response.Message != `{"error":"Received unknown function invocation: unknown","code":"UNKNOWN_FUNCTION"}` {
+		t.Fatalf("unexpected response to an unknown function: %+v", response)
+	}
+}
+
+func TestArgumentErrorsAreBadArgs(t *testing.T) {
+	stub := newTestStub()
+	_, err := mockInvoke(stub, "tx1", "unknown", []string{})
+	checkErrorCode(t, err, errCodeUnknownFunction)
+
+	for function, args := range map[string][]string{
+		"byTimeRange":       {"", "2017-06-02T00:00:00Z"},
+		"byDeviceAttribute": {"sensor-1", ""},
+		"history":           {""},
+	} {
+		responseAsBytes, _ := mockQueryEnvelope(stub, function, args)
+		var response QueryResponse
+		if err := json.Unmarshal(responseAsBytes, &response); err != nil || response.Status != statusBadRequest || response.Code != errCodeBadArgs {
+			t.Fatalf("unexpected envelope for %s %v: %s", function, args, responseAsBytes)
+		}
+	}
+}
+
+func TestUpdateEntryVersionConflict(t *testing.T) {
+	stub := newTestStub()
+	if _, err := mockInvoke(stub, "tx1", "create", []string{"2017-06-01T10:00:00Z", "sensor-1", "temperature", "21.5"}); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+
+	// two clients read version 1, the first update wins
+	if _, err := mockInvoke(stub, "tx2", "update", []string{"2017-06-01T10:00:00Z", "22", "1"}); err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+	stored := string(stub.State["2017-06-01T10:00:00.000000000Z"])
+
+	_, err := mockInvoke(stub, "tx3", "update", []string{"2017-06-01T10:00:00Z", "23", "1"})
+	checkErrorCode(t, err, errCodeVersionConflict)
+	if string(stub.State["2017-06-01T10:00:00.000000000Z"]) != stored {
+		t.Fatalf("stale update overwrote the stored entry")
+	}
+
+	entry := Entry{}
+	if err := json.Unmarshal([]byte(stored), &entry); err != nil || entry.Version != 2 || string(entry.AttributeValue) != `"22"` {
+		t.Fatalf("unexpected stored entry: %s", stored)
+	}
+
+	// retrying with the current version succeeds
+	if _, err := mockInvoke(stub, "tx4", "update", []string{"2017-06-01T10:00:00Z", "23", "2"}); err != nil {
+		t.Fatalf("update with the current version failed: %v", err)
+	}
+}
+
+func TestListDevices(t *testing.T) {
+	stub := newTestStub()
+	entries := [][]string{
+		{"2017-06-01T10:00:00Z", "sensor-2", "temperature", "21.5"},
+		{"2017-06-01T11:00:00Z", "sensor-1", "humidity", "40"},
+		{"2017-06-01T12:00:00Z", "sensor-2", "temperature", "22"},
+	}
+	for i, args := range entries {
+		if _, err := mockInvoke(stub, "create"+strconv.Itoa(i), "create", args); err != nil {
+			t.Fatalf("create failed: %v", err)
+		}
+	}
+
+	checkDevices := func(expected string) {
+		t.Helper()
+		payload, err := mockQuery(stub, "listDevices", []string{})
+		if err != nil {
+			t.Fatalf("listDevices failed: %v", err)
+		}
+		if string(payload) != expected {
+			t.Fatalf("listDevices returned %s, expected %s", payload, expected)
+		}
+	}
+	checkDevices(`["sensor-1","sensor-2"]`)
+
+	payload, err := mockQuery(stub, "listAttributes", []string{"sensor-1"})
+	if err != nil || string(payload) != `["humidity"]` {
+		t.Fatalf("listAttributes returned %s, %v", payload, err)
+	}
+
+	if _, err := mockInvoke(stub, "delete1", "delete", []string{"2017-06-01T10:00:00Z"}); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	checkDevices(`["sensor-1","sensor-2"]`)
+
+	if _, err := mockInvoke(stub, "delete2", "delete", []string{"2017-06-01T12:00:00Z"}); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	checkDevices(`["sensor-1"]`)
+}
+
+func TestExportCSV(t *testing.T) {
+	stub := &fakeQueryStub{MockStub: newTestStub(), kvs: []*queryresult.KV{
+		{Key: "2017-06-01T10:00:00Z", Value: []byte(`{"timestamp":"2017-06-01T10:00:00Z","deviceName":"sensor-1","attribute":"temperature","attributeValue":"21.5"}`)},
+		{Key: "2017-06-01T11:00:00Z", Value: []byte(`{"timestamp":"2017-06-01T11:00:00Z","deviceName":"sensor-1","attribute":"status","attributeValue":"ok, \"warm\""}`)},
+		{Key: "2017-06-01T12:00:00Z", Value: []byte(`{"timestamp":"2017-06-01T12:00:00Z","deviceName":"sensor-1","attribute":"position","attributeValue":{"lat":1,"lon":2},"valueType":"json"}`)},
+	}}
+
+	result, err := new(SimpleChaincode).exportCSV(stub, []string{"sensor-1", "2017-06-01T00:00:00Z", "2017-06-02T00:00:00Z"})
+	if err != nil {
+		t.Fatalf("exportCSV failed: %v", err)
+	}
+	expected := "timestamp,deviceName,attribute,attributeValue\n" +
+		"2017-06-01T10:00:00Z,sensor-1,temperature,21.5\n" +
+		"2017-06-01T11:00:00Z,sensor-1,status,\"ok, \"\"warm\"\"\"\n" +
+		"2017-06-01T12:00:00Z,sensor-1,position,\"{\"\"lat\"\":1,\"\"lon\"\":2}\"\n"
+	if string(result) != expected {
+		t.Fatalf("unexpected CSV:\n%s\nexpected:\n%s", result, expected)
+	}
+}
+
+func TestRichQueryBuilder(t *testing.T) {
+	query := newRichQuery(map[string]interface{}{
+		"deviceName": "sensor-1",
+		"timestamp":  timeRangeCondition("2017-06-01T00:00:00Z", "2017-06-02T00:00:00Z"),
+	}, false)
+	expected := `{"selector":{"deleted":{"$ne":true},"deviceName":"sensor-1",` +
+		`"timestamp":{"$gte":"2017-06-01T00:00:00Z","$lte":"2017-06-02T00:00:00Z"}}}`
+	if query.String() != expected {
+		t.Fatalf("unexpected query:\n%s\nexpected:\n%s", query.String(), expected)
+	}
+
+	values := []string{
+		`sensor"1`,
+		`sensor\1`,
+		`x"},"$or":[{"deviceName":{"$gt":null}}],"a":{"b":"`,
+		"line\nbreak\ttab",
+		"<html>&amp;",
+		"unicode-ü-\u2028",
+	}
+	for _, value := range values {
+		queryString := newRichQuery(map[string]interface{}{"deviceName": value}, true).String()
+		decoded := struct {
+			Selector map[string]interface{} `json:"selector"`
+		}{}
+		if err := json.Unmarshal([]byte(queryString), &decoded); err != nil {
+			t.Fatalf("query for %q is not valid JSON: %v\n%s", value, err, queryString)
+		}
+		if len(decoded.Selector) != 1 || decoded.Selector["deviceName"] != value {
+			t.Fatalf("query for %q does not match the value only: %s", value, queryString)
+		}
+	}
+}
+
+func TestAdHocQueryValidation(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+	}{
+		{"not JSON", `{"selector":`},
+		{"not an object", `["selector"]`},
+		{"no selector", `{"limit":10}`},
+		{"selector not an object", `{"selector":"deviceName"}`},
+		{"null selector", `{"selector":null}`},
+		{"unsupported field", `{"selector":{},"map":"function(doc){emit(doc)}"}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stub := &fakeQueryStub{MockStub: newTestStub()}
+
+			_, err := new(SimpleChaincode).adHocQuery(stub, []string{test.query})
+			checkErrorCode(t, err, errCodeBadArgs)
+			if stub.query != "" {
+				t.Fatalf("invalid query reached the state database: %s", stub.query)
+			}
+		})
+	}
+
+	defer func(require bool) { requireAdHocQueryLimit = require }(requireAdHocQueryLimit)
+	requireAdHocQueryLimit = true
+	stub := &fakeQueryStub{MockStub: newTestStub()}
+	_, err := new(SimpleChaincode).adHocQuery(stub, []string{`{"selector":{}}`})
+	checkErrorCode(t, err, errCodeBadArgs)
+	if _, err := new(SimpleChaincode).adHocQuery(stub, []string{`{"selector":{},"limit":10}`}); err != nil {
+		t.Fatalf("query with a limit failed: %v", err)
+	}
+}
+
+func TestPurgeExpired(t *testing.T) {
+	stub := newTestStub()
+	entries := [][]string{
+		{"2017-06-01T10:00:00Z", "sensor-1", "temperature", "21.5"},
+		{"2017-06-01T11:00:00Z", "sensor-2", "temperature", "40"},
+		{"2017-06-01T12:00:00Z", "sensor-1", "temperature", "22"},
+		{"2017-06-01T13:00:00Z", "sensor-1", "temperature", "19"},
+	}
+	for i, args := range entries {
+		if _, err := mockInvoke(stub, "create"+strconv.Itoa(i), "create", args); err != nil {
+			t.Fatalf("create failed: %v", err)
+		}
+	}
+
+	defer func(limit int) { maxDeletionsPerCall = limit }(maxDeletionsPerCall)
+	maxDeletionsPerCall = 2
+
+	payload, err := mockInvoke(stub, "purge1", "purgeExpired", []string{"2017-06-01T13:00:00Z"})
+	if err != nil {
+		t.Fatalf("purgeExpired failed: %v", err)
+	}
+	result := DeletionResult{}
+	if err := json.Unmarshal(payload, &result); err != nil || result.Deleted != 2 || result.Bookmark != "2017-06-01T12:00:00.000000000Z" {
+		t.Fatalf("unexpected first purge result: %s", payload)
+	}
+	payload, err = mockInvoke(stub, "purge2", "purgeExpired", []string{"2017-06-01T13:00:00Z", result.Bookmark})
+	if err != nil {
+		t.Fatalf("purgeExpired failed: %v", err)
+	}
+	if err := json.Unmarshal(payload, &result); err != nil || result.Deleted != 1 || result.Bookmark != "" {
+		t.Fatalf("unexpected second purge result: %s", payload)
+	}
+
+	for _, args := range entries[:3] {
+		if stub.State[args[0]] != nil {
+			t.Fatalf("expired entry %s was not purged", args[0])
+		}
+	}
+	if stub.State["2017-06-01T13:00:00.000000000Z"] == nil {
+		t.Fatalf("entry at the cutoff was purged")
+	}
+	devices, err := mockQuery(stub, "listDevices", []string{})
+	if err != nil || string(devices) != `["sensor-1"]` {
+		t.Fatalf("listDevices returned %s, %v", devices, err)
+	}
+}
+
+func TestPatchEntry(t *testing.T) {
+	stub := newStrictTestStub()
+	if _, err := mockInvoke(stub, "tx1", "create", []string{"2017-06-01T10:00:00Z", "sensor-1", "temprature", "21.5"}); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+
+	invalid := []string{
+		`{"timestamp":"2017-06-02T10:00:00Z"}`,
+		`{"version":7}`,
+		`{"deviceName":"sensor 1"}`,
+		`{"attributeValue":"x","valueType":"number"}`,
+		`["attribute"]`,
+	}
+	for _, patch := range invalid {
+		_, err := mockInvoke(stub, "tx2", "patch", []string{"2017-06-01T10:00:00Z", patch, "1"})
+		checkErrorCode(t, err, errCodeBadArgs)
+	}
+
+	if _, err := mockInvoke(stub, "tx3", "patch", []string{"2017-06-01T10:00:00Z", `{"attribute":"temperature"}`, "1"}); err != nil {
+		t.Fatalf("patch failed: %v", err)
+	}
+	entry := Entry{}
+	if err := json.Unmarshal(stub.State["2017-06-01T10:00:00.000000000Z"], &entry); err != nil {
+		t.Fatalf("invalid stored entry: %v", err)
+	}
+	if entry.Attribute != "temperature" || entry.DeviceName != "sensor-1" || string(entry.AttributeValue) != `"21.5"` || entry.Version != 2 {
+		t.Fatalf("unexpected patched entry: %+v", entry)
+	}
+
+	oldIndexKey, _ := stub.CreateCompositeKey(deviceAttrIndexName, []string{"sensor-1", "temprature", "2017-06-01T10:00:00.000000000Z"})
+	newIndexKey, _ := stub.CreateCompositeKey(deviceAttrIndexName, []string{"sensor-1", "temperature", "2017-06-01T10:00:00.000000000Z"})
+	if stub.State[oldIndexKey] != nil || stub.State[newIndexKey] == nil {
+		t.Fatalf("index was not moved to the patched attribute")
+	}
+
+	_, err := mockInvoke(stub, "tx4", "patch", []string{"2017-06-01T10:00:00Z", `{"attributeValue":"22"}`, "1"})
+	checkErrorCode(t, err, errCodeVersionConflict)
+}
+
+func TestInitSeedEntries(t *testing.T) {
+	stub := newTestStub()
+	seed := `[{"timestamp":"2017-06-01T10:00:00Z","deviceName":"sensor-1","attribute":"temperature","attributeValue":"21.5"},` +
+		`{"timestamp":"2017-06-01T11:00:00Z","deviceName":"sensor-2","attribute":"humidity","attributeValue":"40","valueType":"number"}]`
+
+	if _, err := mockInit(stub, "init", []string{seed}); err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+	for _, timestamp := range []string{"2017-06-01T10:00:00Z", "2017-06-01T11:00:00Z"} {
+		if stub.State[keyOf(timestamp)] == nil {
+			t.Fatalf("seed entry %s was not created", timestamp)
+		}
+	}
+
+	invalid := []string{
+		`{"timestamp":"2017-06-01T10:00:00Z"}`,
+		`[{"timestamp":"2017-06-01T10:00:00Z","deviceName":"sensor-1","attribute":"temperature","attributeValue":"21.5"},` +
+			`{"timestamp":"2017-06-01T11:00:00Z","deviceName":"sensor 2","attribute":"humidity","attributeValue":"40"}]`,
+		`[{"timestamp":"2017-06-01T10:00:00Z","deviceName":"sensor-1","attribute":"temperature","attributeValue":"21.5"},` +
+			`{"timestamp":"2017-06-01T10:00:00Z","deviceName":"sensor-2","attribute":"humidity","attributeValue":"40"}]`,
+	}
+	for _, seed := range invalid {
+		stub := newStrictTestStub()
+		stored := len(stub.State)
+		if _, err := mockInit(stub, "init", []string{seed}); err == nil {
+			t.Fatalf("Init accepted the invalid seed %s", seed)
+		}
+		if len(stub.State) != stored {
+			t.Fatalf("invalid seed left %d keys in state", len(stub.State)-stored)
+		}
+	}
+}
+
+func TestInvokeInitSeedEntries(t *testing.T) {
+	seed := `[{"timestamp":"2017-06-01T10:00:00Z","deviceName":"sensor-1","attribute":"temperature","attributeValue":"21.5"}]`
+
+	stub := newTestStub()
+	stub.Creator = newSerializedIdentity("Org2MSP", "gateway-2")
+	_, err := mockInvoke(stub, "tx1", "init", []string{seed})
+	checkErrorCode(t, err, errCodeForbidden)
+	if len(stub.State) != 0 {
+		t.Fatalf("seed of a foreign organization left %d keys in state", len(stub.State))
+	}
+
+	stub.Creator = newSerializedIdentity("Org1MSP", "gateway-1")
+	if _, err := mockInvoke(stub, "tx2", "init", []string{seed}); err != nil {
+		t.Fatalf("invoke of init failed: %v", err)
+	}
+	if stub.State[keyOf("2017-06-01T10:00:00Z")] == nil {
+		t.Fatalf("seed entry was not created")
+	}
+
+	defer func(limit int) { rateLimitEntries = limit }(rateLimitEntries)
+	rateLimitEntries = 1
+	_, err = mockInvoke(stub, "tx3", "init", []string{`[{"timestamp":"2017-06-01T11:00:00Z","deviceName":"sensor-2","attribute":"temperature","attributeValue":"22"},` +
+		`{"timestamp":"2017-06-01T12:00:00Z","deviceName":"sensor-2","attribute":"temperature","attributeValue":"23"}]`})
+	checkErrorCode(t, err, errCodeRateLimit)
+}
+
+func TestMarshalEntryIsCanonical(t *testing.T) {
+	numericValue := 21.5
+	entry := &Entry{
+		Timestamp:      "2017-06-01T10:00:00Z",
+		DeviceName:     "sensor-1",
+		Attribute:      "position",
+		AttributeValue: json.RawMessage(`{"lon":15.98,"lat":45.81}`),
+		ValueType:      valueTypeJSON,
+		NumericValue:   &numericValue,
+		Version:        1,
+	}
+
+	entryJSONasBytes, err := marshalEntry(entry)
+	if err != nil {
+		t.Fatalf("marshalEntry failed: %v", err)
+	}
+	expected := `{"attribute":"position","attributeValue":{"lat":45.81,"lon":15.98},"deleted":false,"deviceName":"sensor-1",` +
+		`"numericValue":21.5,"timestamp":"2017-06-01T10:00:00Z","valueType":"json","version":1}`
+	if string(entryJSONasBytes) != expected {
+		t.Fatalf("unexpected canonical entry:\n%s\nexpected:\n%s", entryJSONasBytes, expected)
+	}
+}
+
+func TestValidateEntry(t *testing.T) {
+	stub := newStrictTestStub()
+	stored := len(stub.State)
+	args := []string{"2017-06-01T10:00:00Z", "sensor-1", "temperature", "21.5"}
+
+	payload, err := mockQuery(stub, "validate", args)
+	if err != nil || string(payload) != `{"valid":true}` {
+		t.Fatalf("validate returned %s, %v", payload, err)
+	}
+	if len(stub.State) != stored {
+		t.Fatalf("validate wrote %d keys to state", len(stub.State)-stored)
+	}
+
+	_, err = mockQuery(stub, "validate", []string{"yesterday", "sensor-1", "temperature", "21.5"})
+	checkErrorCode(t, err, errCodeBadArgs)
+
+	// validate rejects what create rejects before dispatching it
+	invalid := []string{"2017-06-01T10:00:00Z", "sensor-1", "temperature", "21\xff\xfe"}
+	_, err = mockQuery(stub, "validate", invalid)
+	checkErrorCode(t, err, errCodeBadArgs)
+	if !strings.Contains(err.Error(), "argument 4 is not valid UTF-8") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, err = mockInvoke(stub, "tx0", "create", invalid)
+	checkErrorCode(t, err, errCodeBadArgs)
+
+	if _, err := mockInvoke(stub, "tx1", "create", args); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	_, err = mockQuery(stub, "validate", args)
+	checkErrorCode(t, err, errCodeDuplicateKey)
+}
+
+func TestCreateEntriesBatchStrict(t *testing.T) {
+	batch := `[{"timestamp":"2017-06-01T10:00:00Z","deviceName":"sensor-1","attribute":"temperature","attributeValue":"21.5"},` +
+		`{"timestamp":"2017-06-01T11:00:00Z","deviceName":"sensor-1","attribute":"temperature","attributeValue":"hot","valueType":"number"},` +
+		`{"timestamp":"2017-06-01T12:00:00Z","deviceName":"sensor-1","attribute":"temperature","attributeValue":"22"}]`
+
+	stub := newTestStub()
+	_, err := mockInvoke(stub, "tx1", "createBatch", []string{batch, "true"})
+	checkErrorCode(t, err, errCodeBadArgs)
+	if len(stub.State) != 0 {
+		t.Fatalf("failed strict batch wrote %d keys", len(stub.State))
+	}
+
+	// the same batch in the default mode creates the valid entries
+	payload, err := mockInvoke(stub, "tx2", "createBatch", []string{batch})
+	if err != nil {
+		t.Fatalf("createBatch failed: %v", err)
+	}
+	result := BatchResult{}
+	if err := json.Unmarshal(payload, &result); err != nil || result.Succeeded != 2 || len(result.Failed) != 1 {
+		t.Fatalf("unexpected batch result: %s", payload)
+	}
+
+	// a strict batch colliding with a stored entry writes nothing either
+	_, err = mockInvoke(stub, "tx3", "createBatch", []string{`[{"timestamp":"2017-06-01T13:00:00Z","deviceName":"sensor-1","attribute":"temperature","attributeValue":"23"},` +
+		`{"timestamp":"2017-06-01T10:00:00Z","deviceName":"sensor-1","attribute":"temperature","attributeValue":"21.5"}]`, "true"})
+	checkErrorCode(t, err, errCodeDuplicateKey)
+	if stub.State["2017-06-01T13:00:00.000000000Z"] != nil {
+		t.Fatalf("failed strict batch wrote an entry")
+	}
+}
+
+func TestCreateEntryNormalizesTimestamp(t *testing.T) {
+	stub := newTestStub()
+
+	payload, err := mockInvoke(stub, "tx1", "create", []string{"2017-06-01T12:00:00+02:00", "sensor-1", "temperature", "21.5"})
+	if err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	response := EntryResponse{}
+	entry := Entry{}
+	if err := json.Unmarshal(payload, &response); err != nil || json.Unmarshal(response.Entry, &entry) != nil {
+		t.Fatalf("create returned invalid JSON: %s", payload)
+	}
+	if entry.Timestamp != "2017-06-01T10:00:00.000000000Z" {
+		t.Fatalf("timestamp was not normalized to UTC: %s", entry.Timestamp)
+	}
+	if stub.State["2017-06-01T10:00:00.000000000Z"] == nil {
+		t.Fatalf("entry was not stored under the UTC key")
+	}
+
+	// the same instant with another offset lands on the same key
+	_, err = mockInvoke(stub, "tx2", "create", []string{"2017-06-01T10:00:00Z", "sensor-1", "temperature", "21.5"})
+	checkErrorCode(t, err, errCodeDuplicateKey)
+	_, err = mockInvoke(stub, "tx3", "create", []string{"2017-06-01T05:30:00-04:30", "sensor-1", "temperature", "21.5"})
+	checkErrorCode(t, err, errCodeDuplicateKey)
+}
+
+func TestCreateEntrySubSecondTimestamps(t *testing.T) {
+	stub := newTestStub()
+
+	// two readings of a device 100ms apart
+	for i, timestamp := range []string{"2017-06-01T10:00:00.100Z", "2017-06-01T10:00:00.200+00:00"} {
+		if _, err := mockInvoke(stub, "tx"+strconv.Itoa(i), "create", []string{timestamp, "sensor-1", "temperature", "21.5"}); err != nil {
+			t.Fatalf("create of reading %s failed: %v", timestamp, err)
+		}
+	}
+	for _, key := range []string{"2017-06-01T10:00:00.100000000Z", "2017-06-01T10:00:00.200000000Z"} {
+		if stub.State[key] == nil {
+			t.Fatalf("reading was not stored under %s", key)
+		}
+	}
+
+	_, err := mockInvoke(stub, "tx2", "create", []string{"2017-06-01T10:00:00.100000000Z", "sensor-1", "temperature", "21.5"})
+	checkErrorCode(t, err, errCodeDuplicateKey)
+}
+
+func TestDeviceSnapshot(t *testing.T) {
+	stub := &fakeQueryStub{MockStub: newTestStub(), kvs: []*queryresult.KV{
+		{Key: "2017-06-01T12:00:00Z", Value: []byte(`{"timestamp":"2017-06-01T12:00:00Z","deviceName":"sensor-1","attribute":"temperature","attributeValue":"22"}`)},
+		{Key: "2017-06-01T10:00:00Z", Value: []byte(`{"timestamp":"2017-06-01T10:00:00Z","deviceName":"sensor-1","attribute":"temperature","attributeValue":"21.5"}`)},
+		{Key: "2017-06-01T11:00:00Z", Value: []byte(`{"timestamp":"2017-06-01T11:00:00Z","deviceName":"sensor-1","attribute":"humidity","attributeValue":"40"}`)},
+	}}
+
+	result, err := new(SimpleChaincode).deviceSnapshot(stub, []string{"sensor-1"})
+	if err != nil {
+		t.Fatalf("deviceSnapshot failed: %v", err)
+	}
+	snapshot := map[string]Entry{}
+	if err := json.Unmarshal(result, &snapshot); err != nil {
+		t.Fatalf("deviceSnapshot returned invalid JSON: %v\n%s", err, result)
+	}
+	if len(snapshot) != 2 || snapshot["temperature"].Timestamp != "2017-06-01T12:00:00Z" || snapshot["humidity"].Timestamp != "2017-06-01T11:00:00Z" {
+		t.Fatalf("unexpected snapshot: %s", result)
+	}
+}
+
+func TestCreateEntryRateLimit(t *testing.T) {
+	defer func(limit int) { rateLimitEntries = limit }(rateLimitEntries)
+	rateLimitEntries = 2
+
+	stub := newTestStub()
+	for i, timestamp := range []string{"2017-06-01T10:00:00Z", "2017-06-01T11:00:00Z"} {
+		if _, err := mockInvoke(stub, "tx"+strconv.Itoa(i), "create", []string{timestamp, "sensor-1", "temperature", "21.5"}); err != nil {
+			t.Fatalf("create within the rate limit failed: %v", err)
+		}
+	}
+
+	_, err := mockInvoke(stub, "tx2", "create", []string{"2017-06-01T12:00:00Z", "sensor-1", "temperature", "21.5"})
+	checkErrorCode(t, err, errCodeRateLimit)
+	if stub.State["2017-06-01T12:00:00.000000000Z"] != nil {
+		t.Fatalf("entry over the rate limit was stored")
+	}
+	_, err = mockInvoke(stub, "tx3", "createBatch", []string{`[{"timestamp":"2017-06-01T13:00:00Z","deviceName":"sensor-1","attribute":"temperature","attributeValue":"21.5"}]`})
+	checkErrorCode(t, err, errCodeRateLimit)
+	_, err = mockInvoke(stub, "tx5", "upsert", []string{"2017-06-01T10:00:00Z", "sensor-1", "temperature", "22"})
+	checkErrorCode(t, err, errCodeRateLimit)
+
+	// other devices have their own window
+	if _, err := mockInvoke(stub, "tx4", "create", []string{"2017-06-01T12:00:00Z", "sensor-2", "temperature", "21.5"}); err != nil {
+		t.Fatalf("create for another device failed: %v", err)
+	}
+}
+
+func TestQueryCompositeIndex(t *testing.T) {
+	stub := newTestStub()
+	entries := [][]string{
+		{"2017-06-01T10:00:00Z", "sensor-2", "temperature", "21.5"},
+		{"2017-06-01T11:00:00Z", "sensor-1", "humidity", "40"},
+		{"2017-06-01T12:00:00Z", "sensor-2", "temperature", "22"},
+	}
+	for i, args := range entries {
+		if _, err := mockInvoke(stub, "create"+strconv.Itoa(i), "create", args); err != nil {
+			t.Fatalf("create failed: %v", err)
+		}
+	}
+
+	type page struct {
+		Records          []CompositeIndexKey
+		ResponseMetadata struct {
+			FetchedRecordsCount int
+			Bookmark            string
+		}
+	}
+	queryPage := func(bookmark string) page {
+		t.Helper()
+		payload, err := mockQuery(stub, "queryCompositeIndex", []string{deviceAttrIndexName, "1", bookmark, "sensor-2", "temperature"})
+		if err != nil {
+			t.Fatalf("queryCompositeIndex failed: %v", err)
+		}
+		var result page
+		if err := json.Unmarshal(payload, &result); err != nil {
+			t.Fatalf("queryCompositeIndex returned invalid JSON %s: %v", payload, err)
+		}
+		return result
+	}
+
+	first := queryPage("")
+	if len(first.Records) != 1 || first.ResponseMetadata.Bookmark == "" {
+		t.Fatalf("unexpected first page %+v", first)
+	}
+	record := first.Records[0]
+	if record.ObjectType != deviceAttrIndexName || strings.Join(record.Attributes, ",") != "sensor-2,temperature,2017-06-01T10:00:00.000000000Z" {
+		t.Fatalf("index key decoded into %+v", record)
+	}
+
+	second := queryPage(first.ResponseMetadata.Bookmark)
+	if len(second.Records) != 1 || second.Records[0].Attributes[2] != "2017-06-01T12:00:00.000000000Z" || second.ResponseMetadata.Bookmark != "" {
+		t.Fatalf("unexpected second page %+v", second)
+	}
+
+	_, err := mockQuery(stub, "queryCompositeIndex", []string{deviceRegistryName, "1", ""})
+	checkErrorCode(t, err, errCodeBadArgs)
+}
+
+func TestRichQueryError(t *testing.T) {
+	levelDBErr := errors.New("ExecuteQuery not supported for leveldb")
+	err := richQueryError(levelDBErr)
+	checkErrorCode(t, err, errCodeUnsupported)
+	if !strings.Contains(err.Error(), "CouchDB") || !errors.Is(err, levelDBErr) {
+		t.Fatalf("unexpected error for a LevelDB peer: %v", err)
+	}
+
+	otherErr := errors.New("timeout")
+	if richQueryError(otherErr) != otherErr {
+		t.Fatalf("other errors must be returned as is")
+	}
+}
+
+func TestSyncDevice(t *testing.T) {
+	stub := newTestStub()
+	entries := [][]string{
+		{"2017-06-01T10:00:00Z", "sensor-1", "temperature", "21.5"},
+		{"2017-06-01T11:00:00Z", "sensor-1", "humidity", "40"},
+		{"2017-06-01T12:00:00Z", "sensor-2", "temperature", "19"},
+	}
+	for i, args := range entries {
+		if _, err := mockInvoke(stub, "create"+strconv.Itoa(i), "create", args); err != nil {
+			t.Fatalf("create failed: %v", err)
+		}
+	}
+
+	// an invalid payload leaves the device untouched
+	invalid := `[{"timestamp":"2017-06-01T13:00:00Z","deviceName":"sensor-1","attribute":"temperature","attributeValue":"22"},` +
+		`{"timestamp":"2017-06-01T12:00:00Z","deviceName":"sensor-1","attribute":"temperature","attributeValue":"23"}]`
+	_, err := mockInvoke(stub, "sync1", "syncDevice", []string{"sensor-1", invalid})
+	checkErrorCode(t, err, errCodeDuplicateKey)
+	if stub.State["2017-06-01T11:00:00.000000000Z"] == nil || stub.State["2017-06-01T13:00:00.000000000Z"] != nil {
+		t.Fatalf("failed sync changed state")
+	}
+	_, err = mockInvoke(stub, "sync2", "syncDevice", []string{"sensor-1", `[{"timestamp":"2017-06-01T13:00:00Z","deviceName":"sensor-2","attribute":"temperature","attributeValue":"22"}]`})
+	checkErrorCode(t, err, errCodeBadArgs)
+
+	payload, err := mockInvoke(stub, "sync3", "syncDevice", []string{"sensor-1",
+		`[{"timestamp":"2017-06-01T10:00:00Z","deviceName":"sensor-1","attribute":"temperature","attributeValue":"20"},` +
+			`{"timestamp":"2017-06-01T13:00:00Z","deviceName":"sensor-1","attribute":"temperature","attributeValue":"22"}]`})
+	if err != nil {
+		t.Fatalf("syncDevice failed: %v", err)
+	}
+	if string(payload) != `{"deleted":2,"created":2}` {
+		t.Fatalf("syncDevice returned %s", payload)
+	}
+	if stub.State["2017-06-01T11:00:00.000000000Z"] != nil || stub.State["2017-06-01T13:00:00.000000000Z"] == nil || stub.State["2017-06-01T12:00:00.000000000Z"] == nil {
+		t.Fatalf("unexpected state after sync")
+	}
+	entry := Entry{}
+	if err := json.Unmarshal(stub.State["2017-06-01T10:00:00.000000000Z"], &entry); err != nil {
+		t.Fatalf("stored entry is invalid JSON: %v", err)
+	}
+	if string(entry.AttributeValue) != `"20"` || entry.Version != 2 {
+		t.Fatalf("replaced entry stored as %+v", entry)
+	}
+
+	payload, err = mockQuery(stub, "listAttributes", []string{"sensor-1"})
+	if err != nil || string(payload) != `["temperature"]` {
+		t.Fatalf("listAttributes returned %s, %v", payload, err)
+	}
+}
+
+func TestDeviceKeyScheme(t *testing.T) {
+	stub := newTestStub()
+	if _, err := mockInvoke(stub, "tx1", "create", []string{"2017-06-01T10:00:00Z", "sensor-1", "temperature", "21.5"}); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+
+	defer func(scheme string) { entryKeyScheme = scheme }(entryKeyScheme)
+	entryKeyScheme = keySchemeDevice
+
+	// existing entries are moved to the device keyspace
+	payload, err := mockInit(stub, "migrate", []string{"migrate"})
+	if err != nil {
+		t.Fatalf("migrate failed: %v", err)
+	}
+	result := MigrationResult{}
+	if err := json.Unmarshal(payload, &result); err != nil || result.Migrated != 1 {
+		t.Fatalf("migrate returned %s", payload)
+	}
+	if stub.State["2017-06-01T10:00:00.000000000Z"] != nil || stub.State["sensor-1_2017-06-01T10:00:00.000000000Z"] == nil {
+		t.Fatalf("entry was not moved to its device key")
+	}
+
+	// two devices reporting at the same instant no longer collide
+	if _, err := mockInvoke(stub, "tx2", "create", []string{"2017-06-01T10:00:00Z", "sensor-2", "temperature", "19"}); err != nil {
+		t.Fatalf("create for another device failed: %v", err)
+	}
+	_, err = mockInvoke(stub, "tx3", "create", []string{"2017-06-01T10:00:00Z", "sensor-2", "humidity", "40"})
+	checkErrorCode(t, err, errCodeDuplicateKey)
+
+	if _, err := mockInvoke(stub, "tx4", "update", []string{"sensor-2_2017-06-01T10:00:00Z", "20", "1"}); err != nil {
+		t.Fatalf("update by device key failed: %v", err)
+	}
+	_, err = mockInvoke(stub, "tx5", "patch", []string{"sensor-2_2017-06-01T10:00:00Z", `{"deviceName":"sensor-3"}`, "2"})
+	checkErrorCode(t, err, errCodeBadArgs)
+	_, err = mockQuery(stub, "byTimeRange", []string{"2017-06-01T00:00:00Z", "2017-06-02T00:00:00Z"})
+	checkErrorCode(t, err, errCodeUnsupported)
+
+	if _, err := mockInvoke(stub, "tx6", "deleteByDevice", []string{"sensor-1"}); err != nil {
+		t.Fatalf("deleteByDevice failed: %v", err)
+	}
+	if stub.State["sensor-1_2017-06-01T10:00:00.000000000Z"] != nil || stub.State["sensor-2_2017-06-01T10:00:00.000000000Z"] == nil {
+		t.Fatalf("unexpected state after deleteByDevice")
+	}
+}
+
+func TestVerifyIntegrity(t *testing.T) {
+	stub := newTestStub()
+	if _, err := mockInvoke(stub, "tx1", "create", []string{"2017-06-01T10:00:00Z", "sensor-1", "temperature", "21.5"}); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+
+	checkValid := func(expected bool) {
+		t.Helper()
+		payload, err := mockQuery(stub, "verify", []string{"2017-06-01T10:00:00Z"})
+		if err != nil {
+			t.Fatalf("verify failed: %v", err)
+		}
+		result := IntegrityResult{}
+		if err := json.Unmarshal(payload, &result); err != nil {
+			t.Fatalf("verify returned invalid JSON: %s", payload)
+		}
+		if result.Valid != expected || result.StoredHash == "" {
+			t.Fatalf("verify returned %s, expected valid %t", payload, expected)
+		}
+	}
+	checkValid(true)
+
+	// every write keeps the hash up to date
+	if _, err := mockInvoke(stub, "tx2", "update", []string{"2017-06-01T10:00:00Z", "22", "1"}); err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+	checkValid(true)
+
+	stub.State["2017-06-01T10:00:00.000000000Z"] = []byte(strings.Replace(string(stub.State["2017-06-01T10:00:00.000000000Z"]), `"22"`, `"23"`, 1))
+	checkValid(false)
+
+	_, err := mockQuery(stub, "verify", []string{"2017-06-01T11:00:00Z"})
+	checkErrorCode(t, err, errCodeNotFound)
+}
+
+func TestQueryByTxID(t *testing.T) {
+	stub := &fakeQueryStub{MockStub: newTestStub()}
+	if _, err := mockInvoke(stub.MockStub, "tx1", "create", []string{"2017-06-01T10:00:00Z", "sensor-1", "temperature", "21.5"}); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	if _, err := mockInvoke(stub.MockStub, "tx2", "update", []string{"2017-06-01T10:00:00Z", "22", "1"}); err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+	entry := Entry{}
+	if err := json.Unmarshal(stub.State["2017-06-01T10:00:00.000000000Z"], &entry); err != nil || entry.LastTxID != "tx2" {
+		t.Fatalf("entry last written by tx2 stored as %s", stub.State["2017-06-01T10:00:00.000000000Z"])
+	}
+
+	if _, err := new(SimpleChaincode).queryByTxID(stub, []string{"tx2"}); err != nil {
+		t.Fatalf("queryByTxID failed: %v", err)
+	}
+	if stub.query != `{"selector":{"lastTxId":"tx2"}}` {
+		t.Fatalf("unexpected query string: %s", stub.query)
+	}
+}
+
+func TestCreateEntryValuelessAttribute(t *testing.T) {
+	stub := newTestStub()
+	_, err := mockInvoke(stub, "tx1", "create", []string{"2017-06-01T10:00:00Z", "sensor-1", "motion", ""})
+	checkErrorCode(t, err, errCodeBadArgs)
+
+	defer func(attributes map[string]bool) { valuelessAttributes = attributes }(valuelessAttributes)
+	valuelessAttributes = map[string]bool{"motion": true}
+
+	if _, err := mockInvoke(stub, "tx2", "create", []string{"2017-06-01T10:00:00Z", "sensor-1", "motion", ""}); err != nil {
+		t.Fatalf("create of a valueless attribute failed: %v", err)
+	}
+	batch := `[{"timestamp":"2017-06-01T11:00:00Z","deviceName":"sensor-1","attribute":"motion"}]`
+	payload, err := mockInvoke(stub, "tx3", "createBatch", []string{batch, "true"})
+	if err != nil {
+		t.Fatalf("createBatch of a valueless attribute failed: %v, %s", err, payload)
+	}
+	entry := Entry{}
+	if err := json.Unmarshal(stub.State["2017-06-01T11:00:00.000000000Z"], &entry); err != nil || string(entry.AttributeValue) != `""` {
+		t.Fatalf("valueless entry stored as %s", stub.State["2017-06-01T11:00:00.000000000Z"])
+	}
+
+	// other attributes still need a value, as do valueless attributes of another value type
+	_, err = mockInvoke(stub, "tx4", "create", []string{"2017-06-01T12:00:00Z", "sensor-1", "temperature", ""})
+	checkErrorCode(t, err, errCodeBadArgs)
+	_, err = mockInvoke(stub, "tx5", "create", []string{"2017-06-01T12:00:00Z", "sensor-1", "motion", "", valueTypeNumber})
+	checkErrorCode(t, err, errCodeBadArgs)
+}
+
+func TestGetDeviceEntriesByTimeRange(t *testing.T) {
+	stub := newTestStub()
+	_, err := mockQuery(stub, "deviceByTimeRange", []string{"sensor-1", "2017-06-01T00:00:00Z", "2017-06-02T00:00:00Z"})
+	checkErrorCode(t, err, errCodeUnsupported)
+
+	defer func(scheme string) { entryKeyScheme = scheme }(entryKeyScheme)
+	entryKeyScheme = keySchemeDevice
+
+	entries := [][]string{
+		{"2017-06-01T10:00:00Z", "sensor-1", "temperature", "21.5"},
+		{"2017-06-01T10:00:00Z", "sensor-2", "temperature", "19"},
+		{"2017-06-01T11:00:00Z", "sensor-1", "humidity", "40"},
+		{"2017-06-01T12:00:00Z", "sensor-1", "temperature", "22"},
+	}
+	for i, args := range entries {
+		if _, err := mockInvoke(stub, "create"+strconv.Itoa(i), "create", args); err != nil {
+			t.Fatalf("create failed: %v", err)
+		}
+	}
+
+	// the window is given with an offset, it still matches the UTC keys
+	payload, err := mockQuery(stub, "deviceByTimeRange", []string{"sensor-1", "2017-06-01T12:00:00+02:00", "2017-06-01T14:00:00+02:00"})
+	if err != nil {
+		t.Fatalf("deviceByTimeRange failed: %v", err)
+	}
+	var records []QueryRecord
+	if err := json.Unmarshal(payload, &records); err != nil {
+		t.Fatalf("deviceByTimeRange returned invalid JSON: %s", payload)
+	}
+	if len(records) != 2 || records[0].Key != "sensor-1_2017-06-01T10:00:00.000000000Z" || records[1].Key != "sensor-1_2017-06-01T11:00:00.000000000Z" {
+		t.Fatalf("unexpected records: %s", payload)
+	}
+}
+
+func TestDeviceKeySchemeRejectsSeparatorInDeviceName(t *testing.T) {
+	stub := newTestStub()
+	if _, err := mockInvoke(stub, "tx1", "create", []string{"2017-06-01T10:00:00Z", "a_2020-01", "temperature", "21.5"}); err != nil {
+		t.Fatalf("create with an underscore under the timestamp key scheme failed: %v", err)
+	}
+
+	defer func(scheme string) { entryKeyScheme = scheme }(entryKeyScheme)
+	entryKeyScheme = keySchemeDevice
+
+	// the entry cannot be moved to a key that overlaps the keys of device "a"
+	_, err := mockInit(stub, "migrate", []string{"migrate"})
+	checkErrorCode(t, err, errCodeUnsupported)
+	if stub.State[keyOf("2017-06-01T10:00:00Z")] == nil {
+		t.Fatalf("entry was moved despite its device name")
+	}
+
+	_, err = mockInvoke(stub, "tx2", "create", []string{"2017-06-01T11:00:00Z", "a_2020-01", "temperature", "21.5"})
+	checkErrorCode(t, err, errCodeBadArgs)
+	payload, err := mockInvoke(stub, "tx3", "createBatch", []string{`[{"timestamp":"2017-06-01T11:00:00Z","deviceName":"a_2020-01","attribute":"temperature","attributeValue":"21.5"}]`})
+	if err != nil {
+		t.Fatalf("createBatch failed: %v", err)
+	}
+	var batch BatchResult
+	if err := json.Unmarshal(payload, &batch); err != nil || batch.Succeeded != 0 || len(batch.Failed) != 1 || batch.Failed[0].Code != errCodeBadArgs {
+		t.Fatalf("unexpected batch result: %s", payload)
+	}
+	_, err = mockQuery(stub, "deviceByTimeRange", []string{"a_2020-01", "2017-06-01T00:00:00Z", "2017-06-02T00:00:00Z"})
+	checkErrorCode(t, err, errCodeBadArgs)
+	if _, err := mockInvoke(stub, "tx4", "create", []string{"2017-06-01T11:00:00Z", "a", "temperature", "21.5"}); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+}
+
+func TestDeviceKeySchemeDeviceNamesWithReservedPrefixes(t *testing.T) {
+	stub := newTestStub()
+	defer func(scheme string) { entryKeyScheme = scheme }(entryKeyScheme)
+	entryKeyScheme = keySchemeDevice
+
+	// internal keys are composite keys, device names spelling a reserved prefix do not collide
+	for i, deviceName := range []string{"config01", "configurator", "device"} {
+		if _, err := mockInvoke(stub, "tx"+strconv.Itoa(i), "create", []string{"2017-06-01T10:00:00Z", deviceName, "temperature", "21.5"}); err != nil {
+			t.Fatalf("create for device %s failed: %v", deviceName, err)
+		}
+		if stub.State[deviceName+"_"+keyOf("2017-06-01T10:00:00Z")] == nil {
+			t.Fatalf("entry of device %s was not stored under its device key", deviceName)
+		}
+	}
+
+	_, err := mockInvoke(stub, "tx3", "create", []string{"config", "sensor-1", "temperature", "21.5"})
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) || validationErr.Field != "timestamp" {
+		t.Fatalf("expected a ValidationError on timestamp, got %v", err)
+	}
+}
+
+func TestReservedUnderscorePrefix(t *testing.T) {
+	stub := newTestStub()
+	_, err := mockInvoke(stub, "tx1", "create", []string{"_design", "sensor-1", "temperature", "21.5"})
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) || validationErr.Field != "timestamp" {
+		t.Fatalf("expected a ValidationError on timestamp, got %v", err)
+	}
+	// the device name is not part of timestamp scheme keys
+	if _, err := mockInvoke(stub, "tx2", "create", []string{"2017-06-01T10:00:00Z", "_probe", "temperature", "21.5"}); err != nil {
+		t.Fatalf("create for device _probe failed: %v", err)
+	}
+
+	defer func(scheme string) { entryKeyScheme = scheme }(entryKeyScheme)
+	entryKeyScheme = keySchemeDevice
+	_, err = mockInvoke(stub, "tx3", "create", []string{"2017-06-01T11:00:00Z", "_probe", "temperature", "21.5"})
+	if !errors.As(err, &validationErr) || validationErr.Field != "deviceName" {
+		t.Fatalf("expected a ValidationError on deviceName, got %v", err)
+	}
+}
+
+func TestReadEntries(t *testing.T) {
+	stub := newTestStub()
+	for i, timestamp := range []string{"2017-06-01T10:00:00Z", "2017-06-01T11:00:00Z"} {
+		if _, err := mockInvoke(stub, "tx"+strconv.Itoa(i), "create", []string{timestamp, "sensor-1", "temperature", "21.5"}); err != nil {
+			t.Fatalf("create failed: %v", err)
+		}
+	}
+
+	payload, err := mockQuery(stub, "readMany", []string{`["2017-06-01T11:00:00Z","2017-06-01T12:00:00Z","2017-06-01T10:00:00Z"]`})
+	if err != nil {
+		t.Fatalf("readMany failed: %v", err)
+	}
+	var entries []*Entry
+	if err := json.Unmarshal(payload, &entries); err != nil {
+		t.Fatalf("readMany returned invalid JSON: %s", payload)
+	}
+	if len(entries) != 3 || entries[0].Timestamp != "2017-06-01T11:00:00.000000000Z" || entries[1] != nil || entries[2].Timestamp != "2017-06-01T10:00:00.000000000Z" {
+		t.Fatalf("unexpected entries: %s", payload)
+	}
+
+	_, err = mockQuery(stub, "readMany", []string{`[]`})
+	checkErrorCode(t, err, errCodeBadArgs)
+	tooMany, _ := json.Marshal(make([]string, maxEntriesPerRead+1))
+	_, err = mockQuery(stub, "readMany", []string{string(tooMany)})
+	checkErrorCode(t, err, errCodeBadArgs)
+}
+
+// The transaction timestamps assigned to entries follow the order in which the entries were
+// submitted, aggregation and latest style queries rely on that ordering.
+func TestTxTimestampFollowsInvocationOrder(t *testing.T) {
+	stub := newTestStub()
+	// entry timestamps deliberately run backwards, the ledger time must not
+	timestamps := []string{"2017-06-01T13:00:00Z", "2017-06-01T12:00:00Z", "2017-06-01T11:00:00Z", "2017-06-01T10:00:00Z"}
+	var previous time.Time
+	for i, timestamp := range timestamps {
+		if _, err := mockInvoke(stub, "tx"+strconv.Itoa(i), "create", []string{timestamp, "sensor-1", "temperature", "21.5"}); err != nil {
+			t.Fatalf("create failed: %v", err)
+		}
+		entry := Entry{}
+		if err := json.Unmarshal(stub.State[keyOf(timestamp)], &entry); err != nil {
+			t.Fatalf("stored entry is invalid JSON: %v", err)
+		}
+		txTime, err := time.Parse(time.RFC3339Nano, entry.TxTimestamp)
+		if err != nil {
+			t.Fatalf("txTimestamp %q is not a RFC3339Nano timestamp: %v", entry.TxTimestamp, err)
+		}
+		if txTime.Before(previous) {
+			t.Fatalf("txTimestamp of entry %d is %s, before the previous one %s", i, txTime, previous)
+		}
+		previous = txTime
+	}
+}
+
+func TestEntryTags(t *testing.T) {
+	stub := &fakeQueryStub{MockStub: newTestStub()}
+	if _, err := mockInvoke(stub.MockStub, "tx1", "create", []string{"2017-06-01T10:00:00Z", "sensor-1", "temperature", "21.5"}); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+
+	checkTags := func(expected string, version int) {
+		t.Helper()
+		entry := Entry{}
+		if err := json.Unmarshal(stub.State["2017-06-01T10:00:00.000000000Z"], &entry); err != nil {
+			t.Fatalf("stored entry is invalid JSON: %v", err)
+		}
+		if strings.Join(entry.Tags, ",") != expected || entry.Version != version {
+			t.Fatalf("entry has tags %v at version %d, expected %s at version %d", entry.Tags, entry.Version, expected, version)
+		}
+	}
+	tagOps := []struct {
+		function string
+		tag      string
+		expected string
+		version  int
+	}{
+		{"addTag", "calibration", "calibration", 2},
+		{"addTag", "anomaly", "anomaly,calibration", 3},
+		{"addTag", "anomaly", "anomaly,calibration", 3},
+		{"removeTag", "calibration", "anomaly", 4},
+		{"removeTag", "calibration", "anomaly", 4},
+	}
+	for i, op := range tagOps {
+		if _, err := mockInvoke(stub.MockStub, "tag"+strconv.Itoa(i), op.function, []string{"2017-06-01T10:00:00Z", op.tag}); err != nil {
+			t.Fatalf("%s %s failed: %v", op.function, op.tag, err)
+		}
+		checkTags(op.expected, op.version)
+	}
+
+	_, err := mockInvoke(stub.MockStub, "tag5", "addTag", []string{"2017-06-01T10:00:00Z", "not a tag"})
+	checkErrorCode(t, err, errCodeBadArgs)
+	_, err = mockInvoke(stub.MockStub, "tag6", "addTag", []string{"2017-06-01T11:00:00Z", "anomaly"})
+	checkErrorCode(t, err, errCodeNotFound)
+
+	if _, err := new(SimpleChaincode).queryByTag(stub, []string{"anomaly"}); err != nil {
+		t.Fatalf("queryByTag failed: %v", err)
+	}
+	if stub.query != `{"selector":{"deleted":{"$ne":true},"tags":{"$elemMatch":{"$eq":"anomaly"}}}}` {
+		t.Fatalf("unexpected query string: %s", stub.query)
+	}
+}
+
+func TestDeviceMeta(t *testing.T) {
+	stub := newTestStub()
+	_, err := mockQuery(stub, "getDeviceMeta", []string{"sensor-1"})
+	checkErrorCode(t, err, errCodeNotFound)
+
+	meta := `{"displayName":"Greenhouse thermometer","location":"Zagreb"}`
+	if _, err := mockInvoke(stub, "tx1", "setDeviceMeta", []string{"sensor-1", meta}); err != nil {
+		t.Fatalf("setDeviceMeta failed: %v", err)
+	}
+	payload, err := mockQuery(stub, "getDeviceMeta", []string{"sensor-1"})
+	if err != nil || string(payload) != meta {
+		t.Fatalf("getDeviceMeta returned %s, %v", payload, err)
+	}
+
+	_, err = mockInvoke(stub, "tx2", "setDeviceMeta", []string{"sensor-1", `{"location":"Zagreb"}`})
+	checkErrorCode(t, err, errCodeBadArgs)
+	_, err = mockInvoke(stub, "tx3", "setDeviceMeta", []string{"sensor 1", meta})
+	checkErrorCode(t, err, errCodeBadArgs)
+}
+
+func TestDeviceCounts(t *testing.T) {
+	stub := newTestStub()
+	payload, err := mockQuery(stub, "deviceCounts", []string{})
+	if err != nil || string(payload) != `{}` {
+		t.Fatalf("deviceCounts on an empty ledger returned %s, %v", payload, err)
+	}
+
+	entries := [][]string{
+		{"2017-06-01T10:00:00Z", "sensor-1", "temperature", "21.5"},
+		{"2017-06-01T11:00:00Z", "sensor-1", "humidity", "40"},
+		{"2017-06-01T12:00:00Z", "sensor-2", "temperature", "19"},
+	}
+	for i, args := range entries {
+		if _, err := mockInvoke(stub, "create"+strconv.Itoa(i), "create", args); err != nil {
+			t.Fatalf("create failed: %v", err)
+		}
+	}
+	if _, err := mockInvoke(stub, "delete", "delete", []string{"2017-06-01T12:00:00Z"}); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+
+	payload, err = mockQuery(stub, "deviceCounts", []string{})
+	if err != nil || string(payload) != `{"sensor-1":2}` {
+		t.Fatalf("deviceCounts returned %s, %v", payload, err)
+	}
+}
+
+// Queries listing entries answer an empty JSON array, never null or an error, when nothing matches.
+func TestEmptyResults(t *testing.T) {
+	cc := new(SimpleChaincode)
+	tests := []struct {
+		name string
+		fn   chaincodeFunction
+		args []string
+	}{
+		{"queryByDevice", cc.queryByDevice, []string{"sensor-1"}},
+		{"queryByDevices", cc.queryByDevices, []string{`["sensor-1","sensor-2"]`}},
+		{"queryByAttribute", cc.queryByAttribute, []string{"temperature"}},
+		{"queryByDeviceAttributeRange", cc.queryByDeviceAttributeRange, []string{"sensor-1", "temperature", "2017-06-01T00:00:00Z", "2017-06-02T00:00:00Z"}},
+		{"queryByTag", cc.queryByTag, []string{"anomaly"}},
+		{"queryByTxID", cc.queryByTxID, []string{"tx1"}},
+		{"byTimeRange", cc.getEntriesByTimeRange, []string{"2017-06-01T00:00:00Z", "2017-06-02T00:00:00Z"}},
+		{"byTimeRange descending", cc.getEntriesByTimeRange, []string{"2017-06-01T00:00:00Z", "2017-06-02T00:00:00Z", "false", "true"}},
+		{"byDeviceAttribute", cc.getTimestampsByDeviceAttribute, []string{"sensor-1", "temperature"}},
+		{"getAll", cc.getAllEntries, []string{}},
+		{"recent", cc.recentEntries, []string{"10"}},
+		{"listDevices", cc.listDevices, []string{}},
+		{"listAttributes", cc.listAttributesForDevice, []string{"sensor-1"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stub := &fakeQueryStub{MockStub: newTestStub()}
+			payload, err := test.fn(stub, test.args)
+			if err != nil {
+				t.Fatalf("%s failed on an empty ledger: %v", test.name, err)
+			}
+			if string(payload) != "[]" {
+				t.Fatalf("%s returned %q on an empty ledger, expected []", test.name, payload)
+			}
+		})
+	}
+}
+
+func TestGetDeviceEntriesByTimeBucket(t *testing.T) {
+	stub := newTestStub()
+	entries := [][]string{
+		{"2017-06-01T09:59:59Z", "sensor-1", "temperature", "21"},
+		{"2017-06-01T10:15:00Z", "sensor-1", "temperature", "21.5"},
+		{"2017-06-01T10:20:00Z", "sensor-2", "temperature", "19"},
+		{"2017-06-01T10:45:00Z", "sensor-1", "humidity", "40"},
+		{"2017-06-01T11:30:00Z", "sensor-1", "temperature", "22"},
+	}
+	for i, args := range entries {
+		if _, err := mockInvoke(stub, "create"+strconv.Itoa(i), "create", args); err != nil {
+			t.Fatalf("create failed: %v", err)
+		}
+	}
+
+	checkKeys := func(start string, end string, expected string) {
+		t.Helper()
+		payload, err := mockQuery(stub, "byTimeBucket", []string{"sensor-1", start, end})
+		if err != nil {
+			t.Fatalf("byTimeBucket failed: %v", err)
+		}
+		var records []QueryRecord
+		if err := json.Unmarshal(payload, &records); err != nil {
+			t.Fatalf("byTimeBucket returned invalid JSON: %s", payload)
+		}
+		keys := []string{}
+		for _, record := range records {
+			keys = append(keys, record.Key)
+		}
+		if strings.Join(keys, ",") != strings.Join(keysOf(strings.Split(expected, ",")...), ",") {
+			t.Fatalf("byTimeBucket from %s to %s returned %v, expected %s", start, end, keys, expected)
+		}
+	}
+	checkKeys("2017-06-01T10:00:00Z", "2017-06-01T11:00:00Z", "2017-06-01T10:15:00Z,2017-06-01T10:45:00Z")
+	checkKeys("2017-06-01T10:30:00Z", "2017-06-01T11:30:00Z", "2017-06-01T10:45:00Z")
+
+	if _, err := mockInvoke(stub, "delete", "delete", []string{"2017-06-01T10:45:00Z"}); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	checkKeys("2017-06-01T09:00:00Z", "2017-06-01T12:00:00Z", "2017-06-01T09:59:59Z,2017-06-01T10:15:00Z,2017-06-01T11:30:00Z")
+
+	_, err := mockQuery(stub, "byTimeBucket", []string{"sensor-1", "2017-06-01T00:00:00Z", "2017-07-01T00:00:00Z"})
+	checkErrorCode(t, err, errCodeBadArgs)
+}
+
+func TestDeltaSeries(t *testing.T) {
+	reading := func(timestamp string, value string) *queryresult.KV {
+		return &queryresult.KV{Key: timestamp, Value: []byte(`{"timestamp":"` + timestamp + `","deviceName":"sensor-1","attribute":"temperature","attributeValue":"` + value + `"}`)}
+	}
+	// out of order on purpose, the series follows the timestamps
+	stub := &fakeQueryStub{MockStub: newTestStub(), kvs: []*queryresult.KV{
+		reading("2017-06-01T11:00:00Z", "22.5"),
+		reading("2017-06-01T10:00:00Z", "21"),
+		reading("2017-06-01T12:00:00Z", "n/a"),
+		reading("2017-06-01T13:00:00Z", "20"),
+		reading("2017-06-01T14:00:00Z", "20"),
+	}}
+
+	result, err := new(SimpleChaincode).deltaSeries(stub, []string{"sensor-1", "temperature", "2017-06-01T00:00:00Z", "2017-06-02T00:00:00Z"})
+	if err != nil {
+		t.Fatalf("deltaSeries failed: %v", err)
+	}
+	expected := `{"deltas":[{"timestamp":"2017-06-01T11:00:00Z","delta":1.5},` +
+		`{"timestamp":"2017-06-01T13:00:00Z","delta":-2.5,"gap":true},` +
+		`{"timestamp":"2017-06-01T14:00:00Z","delta":0}],"skipped":1}`
+	if string(result) != expected {
+		t.Fatalf("unexpected series:\n%s\nexpected:\n%s", result, expected)
+	}
+	if !strings.Contains(stub.query, `"attribute":"temperature"`) {
+		t.Fatalf("query does not select the attribute: %s", stub.query)
+	}
+
+	stub.kvs = []*queryresult.KV{reading("2017-06-01T10:00:00Z", "21")}
+	result, err = new(SimpleChaincode).deltaSeries(stub, []string{"sensor-1", "temperature", "2017-06-01T00:00:00Z", "2017-06-02T00:00:00Z"})
+	if err != nil {
+		t.Fatalf("deltaSeries failed: %v", err)
+	}
+	if string(result) != `{"deltas":[],"skipped":0}` {
+		t.Fatalf("unexpected series for a single reading: %s", result)
+	}
+
+	_, err = new(SimpleChaincode).deltaSeries(stub, []string{"sensor-1", "temperature", "2017-06-02T00:00:00Z", "2017-06-01T00:00:00Z"})
+	if err == nil {
+		t.Fatalf("deltaSeries accepted an inverted time window")
+	}
+}
+
+func TestResetAll(t *testing.T) {
+	stub := newTestStub()
+	entries := [][]string{
+		{"2017-06-01T10:00:00Z", "sensor-1", "temperature", "21.5"},
+		{"2017-06-01T11:00:00Z", "sensor-2", "temperature", "19"},
+	}
+	for i, args := range entries {
+		if _, err := mockInvoke(stub, "create"+strconv.Itoa(i), "create", args); err != nil {
+			t.Fatalf("create failed: %v", err)
+		}
+	}
+	if _, err := mockInvoke(stub, "meta", "setDeviceMeta", []string{"sensor-1", `{"displayName":"Greenhouse thermometer"}`}); err != nil {
+		t.Fatalf("setDeviceMeta failed: %v", err)
+	}
+	keyCount := len(stub.State)
+
+	_, err := mockInvoke(stub, "reset1", "resetAll", []string{"yes"})
+	checkErrorCode(t, err, errCodeBadArgs)
+	stub.Creator = newSerializedIdentity("Org2MSP", "gateway-2")
+	_, err = mockInvoke(stub, "reset2", "resetAll", []string{"CONFIRM"})
+	checkErrorCode(t, err, errCodeForbidden)
+	if len(stub.State) != keyCount {
+		t.Fatalf("a refused reset changed the state")
+	}
+
+	stub.Creator = newSerializedIdentity("Org1MSP", "admin")
+	payload, err := mockInvoke(stub, "reset3", "resetAll", []string{"CONFIRM"})
+	if err != nil {
+		t.Fatalf("resetAll failed: %v", err)
+	}
+	result := DeletionResult{}
+	if err := json.Unmarshal(payload, &result); err != nil || result.Deleted != keyCount {
+		t.Fatalf("resetAll returned %s, %v, expected %d keys deleted", payload, err, keyCount)
+	}
+	if len(stub.State) != 0 {
+		t.Fatalf("keys left after reset: %d", len(stub.State))
+	}
+}
+
+func TestTypedErrors(t *testing.T) {
+	stub := newStrictTestStub()
+	args := []string{"2017-06-01T10:00:00Z", "sensor-1", "temperature", "21.5"}
+	if _, err := mockInvoke(stub, "tx1", "create", args); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+
+	_, err := mockInvoke(stub, "tx2", "create", args)
+	var duplicateKeyErr *DuplicateKeyError
+	if !errors.As(err, &duplicateKeyErr) || duplicateKeyErr.Key != "2017-06-01T10:00:00.000000000Z" {
+		t.Fatalf("expected a DuplicateKeyError, got %v", err)
+	}
+	if err.Error() != `{"error":"This entry already exists: 2017-06-01T10:00:00.000000000Z","code":"DUPLICATE_KEY"}` {
+		t.Fatalf("wire format changed: %s", err.Error())
+	}
+
+	_, err = mockInvoke(stub, "tx3", "update", []string{"2017-06-01T11:00:00Z", "temperature", "22"})
+	var notFoundErr *NotFoundError
+	if !errors.As(err, &notFoundErr) || notFoundErr.Key != "2017-06-01T11:00:00.000000000Z" {
+		t.Fatalf("expected a NotFoundError, got %v", err)
+	}
+	checkErrorCode(t, err, errCodeNotFound)
+
+	_, err = new(SimpleChaincode).getLatestEntryForDeviceAttribute(&fakeQueryStub{MockStub: stub}, []string{"sensor-2", "temperature"})
+	if !errors.As(err, &notFoundErr) || notFoundErr.Key != "sensor-2" {
+		t.Fatalf("expected a NotFoundError for a device attribute without entries, got %v", err)
+	}
+	checkErrorCode(t, err, errCodeNotFound)
+
+	_, err = mockInvoke(stub, "tx4", "create", []string{"2017-06-01T12:00:00Z", "sensor 1", "temperature", "21.5"})
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) || validationErr.Field != "deviceName" {
+		t.Fatalf("expected a ValidationError on deviceName, got %v", err)
+	}
+	checkErrorCode(t, err, errCodeBadArgs)
+
+	_, err = mockInvoke(stub, "tx5", "create", []string{"2017-06-01T12:00:00Z", "sensor-1", "temperature", "warm", "number"})
+	if !errors.As(err, &validationErr) || validationErr.Field != "attributeValue" {
+		t.Fatalf("expected a ValidationError on attributeValue, got %v", err)
+	}
+
+	// the argument, registry and transaction time checks name their field too
+	future := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	stub.Creator = newSerializedIdentity("Org1MSP", "admin")
+	if _, err := mockInvoke(stub, "tx6", "registerDevice", []string{"sensor-3", `["temperature"]`}); err != nil {
+		t.Fatalf("registerDevice failed: %v", err)
+	}
+	stub.Creator = newSerializedIdentity("Org1MSP", "gateway-1")
+	fields := []struct {
+		field string
+		args  []string
+	}{
+		{"timestamp", []string{"", "sensor-1", "temperature", "21.5"}},
+		{"deviceName", []string{"2017-06-01T12:00:00Z", "", "temperature", "21.5"}},
+		{"attribute", []string{"2017-06-01T12:00:00Z", "sensor-1", "", "21.5"}},
+		{"attributeValue", []string{"2017-06-01T12:00:00Z", "sensor-1", "temperature", ""}},
+		{"timestamp", []string{future, "sensor-1", "temperature", "21.5"}},
+		{"attribute", []string{"2017-06-01T12:00:00Z", "sensor-3", "humidity", "40"}},
+		{"deviceName", []string{`{"timestamp":"2017-06-01T12:00:00Z","deviceName":1,"attribute":"temperature","attributeValue":"21.5"}`}},
+		{"version", []string{`{"timestamp":"2017-06-01T12:00:00Z","deviceName":"sensor-1","attribute":"temperature","attributeValue":"21.5","version":2}`}},
+	}
+	for i, test := range fields {
+		_, err = mockInvoke(stub, "field"+strconv.Itoa(i), "create", test.args)
+		if !errors.As(err, &validationErr) || validationErr.Field != test.field {
+			t.Fatalf("expected a ValidationError on %s for %q, got %v", test.field, test.args, err)
+		}
+		checkErrorCode(t, err, errCodeBadArgs)
+	}
+}
+
+func TestQueryByValuePattern(t *testing.T) {
+	stub := &fakeQueryStub{MockStub: newTestStub()}
+	if _, err := new(SimpleChaincode).queryByValuePattern(stub, []string{"status", "^err(or)?-[0-9]+$"}); err != nil {
+		t.Fatalf("queryByValuePattern failed: %v", err)
+	}
+	expected := `{"selector":{"attribute":"status","attributeValue":{"$regex":"^err(or)?-[0-9]+$"},"deleted":{"$ne":true}}}`
+	if stub.query != expected {
+		t.Fatalf("unexpected query string:\n%s\nexpected:\n%s", stub.query, expected)
+	}
+
+	stub.query = ""
+	_, err := new(SimpleChaincode).queryByValuePattern(stub, []string{"status", "err(or"})
+	checkErrorCode(t, err, errCodeBadArgs)
+	if stub.query != "" {
+		t.Fatalf("an invalid pattern was sent: %s", stub.query)
+	}
+}
+
+func TestDeviceLog(t *testing.T) {
+	defer func(length int) { maxDeviceLogLength = length }(maxDeviceLogLength)
+	maxDeviceLogLength = 2
+
+	stub := newStrictTestStub()
+	payload, err := mockQuery(stub, "deviceLog", []string{"sensor-1"})
+	if err != nil || string(payload) != `[]` {
+		t.Fatalf("deviceLog of a device without a log returned %s, %v", payload, err)
+	}
+
+	readings := []string{"21", "21.5", "22"}
+	for i, value := range readings {
+		args := []string{"2017-06-01T10:00:0" + strconv.Itoa(i) + "Z", "sensor-1", "temperature", value}
+		if _, err := mockInvoke(stub, "append"+strconv.Itoa(i), "appendDeviceLog", args); err != nil {
+			t.Fatalf("appendDeviceLog failed: %v", err)
+		}
+	}
+	payload, err = mockQuery(stub, "deviceLog", []string{"sensor-1"})
+	if err != nil {
+		t.Fatalf("deviceLog failed: %v", err)
+	}
+	var deviceLog []Entry
+	if err := json.Unmarshal(payload, &deviceLog); err != nil {
+		t.Fatalf("invalid log %s: %v", payload, err)
+	}
+	if len(deviceLog) != 2 || deviceLog[0].Timestamp != "2017-06-01T10:00:01.000000000Z" || deviceLog[1].Timestamp != "2017-06-01T10:00:02.000000000Z" {
+		t.Fatalf("unexpected log, expected the two newest readings: %s", payload)
+	}
+	if entryAsBytes, _ := stub.GetState("2017-06-01T10:00:02.000000000Z"); entryAsBytes != nil {
+		t.Fatalf("a log reading was stored as an entry")
+	}
+
+	_, err = mockInvoke(stub, "append3", "appendDeviceLog", []string{"2017-06-01T10:00:03Z", "sensor 1", "temperature", "22"})
+	checkErrorCode(t, err, errCodeBadArgs)
+}
+
+func TestInvokeRejectsInvalidUTF8(t *testing.T) {
+	stub := newStrictTestStub()
+	invalid := []string{"2017-06-01T10:00:00Z", "sensor-1", "temperature", "21\xff\xfe"}
+
+	_, err := mockInvoke(stub, "tx1", "create", invalid)
+	checkErrorCode(t, err, errCodeBadArgs)
+	if !strings.Contains(err.Error(), "argument 4 is not valid UTF-8") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if entryAsBytes, _ := stub.GetState("2017-06-01T10:00:00Z"); entryAsBytes != nil {
+		t.Fatalf("an entry with an invalid value was stored")
+	}
+
+	batch := `[{"timestamp":"2017-06-01T10:00:00Z","deviceName":"sensor-1","attribute":"temperature","attributeValue":"` + "\xc3\x28" + `"}]`
+	_, err = mockInvoke(stub, "tx2", "createBatch", []string{batch})
+	checkErrorCode(t, err, errCodeBadArgs)
+
+	if _, err := mockInvoke(stub, "tx3", "create", []string{"2017-06-01T10:00:00Z", "sensor-1", "location", "Zürich"}); err != nil {
+		t.Fatalf("create rejected a valid UTF-8 value: %v", err)
+	}
+}
+
+func TestFirstEntryForDevice(t *testing.T) {
+	first := `{"timestamp":"2017-06-01T10:00:00Z","deviceName":"sensor-1","attribute":"temperature","attributeValue":"21.5"}`
+	stub := &fakeQueryStub{MockStub: newTestStub(), kvs: []*queryresult.KV{{Key: "2017-06-01T10:00:00Z", Value: []byte(first)}}}
+
+	payload, err := new(SimpleChaincode).firstEntryForDevice(stub, []string{"sensor-1"})
+	if err != nil || string(payload) != first {
+		t.Fatalf("firstEntryForDevice returned %s, %v", payload, err)
+	}
+	expected := `{"selector":{"deleted":{"$ne":true},"deviceName":"sensor-1"},"sort":[{"deviceName":"asc"},{"timestamp":"asc"}],` +
+		`"use_index":["_design/indexDeviceTimestampDoc","indexDeviceTimestamp"],"limit":1}`
+	if stub.query != expected {
+		t.Fatalf("unexpected query string:\n%s\nexpected:\n%s", stub.query, expected)
+	}
+
+	stub.kvs = nil
+	_, err = new(SimpleChaincode).firstEntryForDevice(stub, []string{"sensor-2"})
+	var notFoundErr *NotFoundError
+	if !errors.As(err, &notFoundErr) || notFoundErr.Key != "sensor-2" {
+		t.Fatalf("expected a NotFoundError for a device without entries, got %v", err)
+	}
+}
+
+func TestInvokeIdempotent(t *testing.T) {
+	stub := newTestStub()
+	args := []string{"retry-1", "create", "2017-06-01T10:00:00Z", "sensor-1", "temperature", "21.5"}
+
+	first, err := mockInvoke(stub, "tx1", "idempotent", args)
+	if err != nil {
+		t.Fatalf("idempotent create failed: %v", err)
+	}
+	retried, err := mockInvoke(stub, "tx2", "idempotent", args)
+	if err != nil {
+		t.Fatalf("retried create failed: %v", err)
+	}
+	if string(retried) != string(first) {
+		t.Fatalf("retry returned %s, expected the first result %s", retried, first)
+	}
+	response := EntryResponse{}
+	if err := json.Unmarshal(retried, &response); err != nil || response.TxID != "tx1" {
+		t.Fatalf("retry did not return the result of the first transaction: %s", retried)
+	}
+
+	_, err = mockInvoke(stub, "tx3", "idempotent", []string{"retry-1", "create", "2017-06-01T11:00:00Z", "sensor-1", "temperature", "22"})
+	checkErrorCode(t, err, errCodeDuplicateKey)
+	_, err = mockInvoke(stub, "tx4", "idempotent", []string{"retry-2", "idempotent", "retry-3", "create"})
+	checkErrorCode(t, err, errCodeBadArgs)
+
+	// a failed invocation is not recorded, the key stays usable
+	_, err = mockInvoke(stub, "tx5", "idempotent", []string{"retry-4", "create", "2017-06-01T10:00:00Z", "sensor-1", "temperature", "21.5"})
+	checkErrorCode(t, err, errCodeDuplicateKey)
+	if _, err := mockInvoke(stub, "tx6", "idempotent", []string{"retry-4", "create", "2017-06-01T12:00:00Z", "sensor-1", "temperature", "23"}); err != nil {
+		t.Fatalf("key of a failed invocation could not be reused: %v", err)
+	}
+
+	payload, err := mockInvoke(stub, "prune1", "pruneIdempotencyKeys", []string{"2000-01-01T00:00:00Z"})
+	if err != nil || !strings.Contains(string(payload), `"deleted":0`) {
+		t.Fatalf("pruning with an old cutoff returned %s, %v", payload, err)
+	}
+	cutoff := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	payload, err = mockInvoke(stub, "prune2", "pruneIdempotencyKeys", []string{cutoff})
+	if err != nil || !strings.Contains(string(payload), `"deleted":2`) {
+		t.Fatalf("pruning returned %s, %v", payload, err)
+	}
+	// once pruned the key runs the function again
+	_, err = mockInvoke(stub, "tx7", "idempotent", args)
+	checkErrorCode(t, err, errCodeDuplicateKey)
+}
+
+// transientStub is a MockStub whose transactions carry the given transient data
+type transientStub struct {
+	*shim.MockStub
+	transient map[string][]byte
+}
+
+func (stub *transientStub) GetTransient() (map[string][]byte, error) {
+	return stub.transient, nil
+}
+
+func TestPrivateEntry(t *testing.T) {
+	stub := &transientStub{MockStub: newTestStub(), transient: map[string][]byte{"attributeValue": []byte("120/80")}}
+	args := []string{"collectionVitals", "2017-06-01T10:00:00Z", "patient-1", "bloodPressure"}
+
+	stub.MockTransactionStart("tx1")
+	payload, err := new(SimpleChaincode).createPrivateEntry(stub, args)
+	stub.MockTransactionEnd("tx1")
+	if err != nil {
+		t.Fatalf("createPrivateEntry failed: %v", err)
+	}
+	if strings.Contains(string(payload), "120/80") {
+		t.Fatalf("the response repeats the private value: %s", payload)
+	}
+	if entryAsBytes, _ := stub.GetState("2017-06-01T10:00:00Z"); entryAsBytes != nil {
+		t.Fatalf("the private entry was written to channel state")
+	}
+
+	payload, err = new(SimpleChaincode).readPrivateEntry(stub, []string{"collectionVitals", "2017-06-01T10:00:00Z"})
+	if err != nil {
+		t.Fatalf("readPrivateEntry failed: %v", err)
+	}
+	entry := Entry{}
+	if err := json.Unmarshal(payload, &entry); err != nil || string(entry.AttributeValue) != `"120/80"` || entry.DeviceName != "patient-1" {
+		t.Fatalf("unexpected private entry %s, %v", payload, err)
+	}
+
+	stub.MockTransactionStart("tx2")
+	_, err = new(SimpleChaincode).createPrivateEntry(stub, args)
+	stub.MockTransactionEnd("tx2")
+	checkErrorCode(t, err, errCodeDuplicateKey)
+
+	stub.transient = map[string][]byte{}
+	stub.MockTransactionStart("tx3")
+	_, err = new(SimpleChaincode).createPrivateEntry(stub, []string{"collectionVitals", "2017-06-01T11:00:00Z", "patient-1", "bloodPressure"})
+	stub.MockTransactionEnd("tx3")
+	checkErrorCode(t, err, errCodeBadArgs)
+
+	_, err = new(SimpleChaincode).readPrivateEntry(stub, []string{"collectionVitals", "2017-06-01T11:00:00Z"})
+	checkErrorCode(t, err, errCodeNotFound)
+}
+
+func TestGetEntryProvenance(t *testing.T) {
+	stub := newTestStub()
+	if _, err := mockInvoke(stub, "tx1", "create", []string{"2017-06-01T10:00:00Z", "sensor-1", "temperature", "21.5"}); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+
+	payload, err := mockQuery(stub, "provenance", []string{"2017-06-01T10:00:00Z"})
+	if err != nil {
+		t.Fatalf("provenance failed: %v", err)
+	}
+	provenance := EntryProvenance{}
+	if err := json.Unmarshal(payload, &provenance); err != nil {
+		t.Fatalf("invalid provenance %s: %v", payload, err)
+	}
+	if provenance.Key != "2017-06-01T10:00:00.000000000Z" || provenance.LastTxID != "tx1" || provenance.TxTimestamp == "" {
+		t.Fatalf("unexpected provenance: %s", payload)
+	}
+	if provenance.CreatedBy == nil || provenance.CreatedBy.MSPID != "Org1MSP" || provenance.CreatedBy.CommonName != "gateway-1" {
+		t.Fatalf("unexpected creator: %s", payload)
+	}
+	if !strings.Contains(string(provenance.Entry), `"deviceName":"sensor-1"`) {
+		t.Fatalf("provenance does not carry the entry: %s", payload)
+	}
+
+	_, err = mockQuery(stub, "provenance", []string{"2017-06-01T11:00:00Z"})
+	checkErrorCode(t, err, errCodeNotFound)
+}
+
+func TestStrictMode(t *testing.T) {
+	stub := newStrictTestStub()
+	longName := strings.Repeat("a", maxNameLength+1)
+	future := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+
+	// strict on a new deployment
+	_, err := mockInvoke(stub, "tx1", "create", []string{"2017-06-01T10:00:00Z", "sensor 1", "temperature", "21.5"})
+	checkErrorCode(t, err, errCodeBadArgs)
+	_, err = mockInvoke(stub, "tx2", "create", []string{"2017-06-01T10:00:00Z", "sensor-1", longName, "21.5"})
+	checkErrorCode(t, err, errCodeBadArgs)
+	_, err = mockInvoke(stub, "tx3", "create", []string{future, "sensor-1", "temperature", "21.5"})
+	checkErrorCode(t, err, errCodeBadArgs)
+
+	stub.Creator = newSerializedIdentity("Org2MSP", "gateway-2")
+	_, err = mockInvoke(stub, "tx4", "setStrictMode", []string{"false"})
+	checkErrorCode(t, err, errCodeForbidden)
+	stub.Creator = newSerializedIdentity("Org1MSP", "admin")
+	_, err = mockInvoke(stub, "tx5", "setStrictMode", []string{"maybe"})
+	checkErrorCode(t, err, errCodeBadArgs)
+	if payload, err := mockInvoke(stub, "tx6", "setStrictMode", []string{"false"}); err != nil || string(payload) != "false" {
+		t.Fatalf("setStrictMode returned %s, %v", payload, err)
+	}
+
+	relaxed := [][]string{
+		{"2017-06-01T10:00:00Z", "sensor 1", "temperature", "21.5"},
+		{"2017-06-01T11:00:00Z", "sensor-1", longName, "21.5"},
+		{future, "sensor-1", "temperature", "21.5"},
+		{"2017-06-01T12:00:00Z", "sensor-1", "temperature", "21\xff"},
+	}
+	for i, args := range relaxed {
+		if _, err := mockInvoke(stub, "relaxed"+strconv.Itoa(i), "create", args); err != nil {
+			t.Fatalf("relaxed create %d failed: %v", i, err)
+		}
+	}
+	// updates accept what create accepts
+	longValue := strings.Repeat("1", maxValueLength+1)
+	if _, err := mockInvoke(stub, "relaxed-update", "update", []string{"2017-06-01T10:00:00Z", longValue, "1"}); err != nil {
+		t.Fatalf("relaxed update failed: %v", err)
+	}
+	if _, err := mockInvoke(stub, "relaxed-batch", "updateBatch", []string{`{"2017-06-01T11:00:00Z": "` + longValue + `"}`}); err != nil || !strings.Contains(string(stub.State[keyOf("2017-06-01T11:00:00Z")]), longValue) {
+		t.Fatalf("relaxed updateBatch failed: %v", err)
+	}
+	private := &transientStub{MockStub: stub, transient: map[string][]byte{"attributeValue": []byte("120\xff")}}
+	private.MockTransactionStart("relaxed-private")
+	_, err = new(SimpleChaincode).createPrivateEntry(private, []string{"collectionVitals", "2017-06-01T10:00:00Z", "patient-1", "bloodPressure"})
+	private.MockTransactionEnd("relaxed-private")
+	if err != nil {
+		t.Fatalf("relaxed createPrivate failed: %v", err)
+	}
+	// the essential checks stay
+	_, err = mockInvoke(stub, "tx7", "create", []string{"2017-06-01", "sensor-1", "temperature", "21.5"})
+	checkErrorCode(t, err, errCodeBadArgs)
+
+	if _, err := mockInvoke(stub, "tx8", "setStrictMode", []string{"true"}); err != nil {
+		t.Fatalf("setStrictMode failed: %v", err)
+	}
+	_, err = mockInvoke(stub, "tx9", "create", []string{"2017-06-01T13:00:00Z", "sensor 1", "temperature", "21.5"})
+	checkErrorCode(t, err, errCodeBadArgs)
+	if _, err := mockInvoke(stub, "tx10", "create", []string{"2017-06-01T14:00:00Z", "sensor-1", "temperature", "21.5"}); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	_, err = mockInvoke(stub, "tx11", "update", []string{"2017-06-01T14:00:00Z", longValue, "1"})
+	checkErrorCode(t, err, errCodeBadArgs)
+	payload, err := mockInvoke(stub, "tx12", "updateBatch", []string{`{"2017-06-01T14:00:00Z": "` + longValue + `"}`})
+	var batch BatchUpdateResult
+	if err != nil || json.Unmarshal(payload, &batch) != nil || len(batch.Failed) != 1 || batch.Failed[0].Code != errCodeBadArgs {
+		t.Fatalf("strict updateBatch accepted an oversized value: %s, %v", payload, err)
+	}
+	private.MockTransactionStart("tx13")
+	_, err = new(SimpleChaincode).createPrivateEntry(private, []string{"collectionVitals", "2017-06-01T11:00:00Z", "patient-1", "bloodPressure"})
+	private.MockTransactionEnd("tx13")
+	checkErrorCode(t, err, errCodeBadArgs)
+}
+
+func TestStrictModeOnUpgrade(t *testing.T) {
+	// a ledger holding entries from before strict mode existed stays relaxed on upgrade
+	stub := newTestStub()
+	if _, err := mockInvoke(stub, "tx1", "create", []string{"2017-06-01T10:00:00Z", "sensor 1", "temperature", "21.5"}); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	if _, err := mockInit(stub, "upgrade", nil); err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+	if _, err := mockInvoke(stub, "tx2", "create", []string{"2017-06-01T11:00:00Z", "sensor 1", "temperature", "21.5"}); err != nil {
+		t.Fatalf("upgraded ledger turned strict: %v", err)
+	}
+
+	// an upgrade keeps the setting of an admin
+	stub = newStrictTestStub()
+	stub.Creator = newSerializedIdentity("Org1MSP", "admin")
+	if _, err := mockInvoke(stub, "tx1", "setStrictMode", []string{"false"}); err != nil {
+		t.Fatalf("setStrictMode failed: %v", err)
+	}
+	if _, err := mockInit(stub, "upgrade", nil); err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+	if strict, err := isStrictMode(stub); err != nil || strict {
+		t.Fatalf("upgrade changed the strict mode setting: %v, %v", strict, err)
+	}
+}
+
+func TestReportingGaps(t *testing.T) {
+	reading := func(timestamp string) *queryresult.KV {
+		return &queryresult.KV{Key: timestamp, Value: []byte(`{"timestamp":"` + timestamp + `","deviceName":"sensor-1","attribute":"temperature","attributeValue":"21"}`)}
+	}
+	stub := &fakeQueryStub{MockStub: newTestStub(), kvs: []*queryresult.KV{
+		reading("2017-06-01T10:05:00Z"),
+		reading("2017-06-01T10:00:00Z"),
+		reading("2017-06-01T10:30:00Z"),
+		reading("2017-06-01T10:35:00Z"),
+	}}
+
+	result, err := new(SimpleChaincode).reportingGaps(stub, []string{"sensor-1", "temperature", "10m", "2017-06-01T10:00:00Z", "2017-06-01T11:00:00Z"})
+	if err != nil {
+		t.Fatalf("reportingGaps failed: %v", err)
+	}
+	expected := `[{"start":"2017-06-01T10:05:00.000000000Z","end":"2017-06-01T10:30:00.000000000Z","durationSeconds":1500},` +
+		`{"start":"2017-06-01T10:35:00.000000000Z","end":"2017-06-01T11:00:00.000000000Z","durationSeconds":1500}]`
+	if string(result) != expected {
+		t.Fatalf("unexpected gaps:\n%s\nexpected:\n%s", result, expected)
+	}
+
+	stub.kvs = nil
+	result, err = new(SimpleChaincode).reportingGaps(stub, []string{"sensor-1", "temperature", "10m", "2017-06-01T10:00:00Z", "2017-06-01T11:00:00Z"})
+	if err != nil || string(result) != `[{"start":"2017-06-01T10:00:00.000000000Z","end":"2017-06-01T11:00:00.000000000Z","durationSeconds":3600}]` {
+		t.Fatalf("unexpected gaps without readings: %s, %v", result, err)
+	}
+
+	_, err = new(SimpleChaincode).reportingGaps(stub, []string{"sensor-1", "temperature", "often", "2017-06-01T10:00:00Z", "2017-06-01T11:00:00Z"})
+	checkErrorCode(t, err, errCodeBadArgs)
+}
+
+func TestDownsample(t *testing.T) {
+	reading := func(timestamp string, value string) *queryresult.KV {
+		return &queryresult.KV{Key: timestamp, Value: []byte(`{"timestamp":"` + timestamp + `","deviceName":"sensor-1","attribute":"temperature","attributeValue":"` + value + `"}`)}
+	}
+	stub := &fakeQueryStub{MockStub: newTestStub(), kvs: []*queryresult.KV{
+		reading("2017-06-01T10:00:40Z", "22"),
+		reading("2017-06-01T10:00:10Z", "20"),
+		reading("2017-06-01T10:02:30Z", "n/a"),
+		reading("2017-06-01T10:03:00Z", "25"),
+		reading("2017-06-01T10:03:59Z", "n/a"),
+	}}
+	args := []string{"sensor-1", "temperature", "1m", "2017-06-01T10:00:00Z", "2017-06-01T11:00:00Z"}
+
+	result, err := new(SimpleChaincode).downsample(stub, args)
+	if err != nil {
+		t.Fatalf("downsample failed: %v", err)
+	}
+	expected := `[{"bucket":"2017-06-01T10:00:00.000000000Z","timestamp":"2017-06-01T10:00:40Z","value":22,"count":2},` +
+		`{"bucket":"2017-06-01T10:02:00.000000000Z","timestamp":"2017-06-01T10:02:30Z","value":null,"count":1},` +
+		`{"bucket":"2017-06-01T10:03:00.000000000Z","timestamp":"2017-06-01T10:03:59Z","value":25,"count":2}]`
+	if string(result) != expected {
+		t.Fatalf("unexpected samples:\n%s\nexpected:\n%s", result, expected)
+	}
+
+	result, err = new(SimpleChaincode).downsample(stub, append(args, "avg"))
+	if err != nil {
+		t.Fatalf("downsample failed: %v", err)
+	}
+	if !strings.HasPrefix(string(result), `[{"bucket":"2017-06-01T10:00:00.000000000Z","timestamp":"2017-06-01T10:00:40Z","value":21,"count":2}`) {
+		t.Fatalf("unexpected averaged samples: %s", result)
+	}
+
+	_, err = new(SimpleChaincode).downsample(stub, append(args, "median"))
+	checkErrorCode(t, err, errCodeBadArgs)
+	_, err = new(SimpleChaincode).downsample(stub, []string{"sensor-1", "temperature", "0s", "2017-06-01T10:00:00Z", "2017-06-01T11:00:00Z"})
+	checkErrorCode(t, err, errCodeBadArgs)
+}
+
+func TestUpdateEntrySkipsUnchangedValue(t *testing.T) {
+	stub := newTestStub()
+	if _, err := mockInvoke(stub, "tx1", "create", []string{"2017-06-01T10:00:00Z", "sensor-1", "temperature", "21.5"}); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	storedAsBytes, _ := stub.GetState("2017-06-01T10:00:00Z")
+
+	payload, err := mockInvoke(stub, "tx2", "update", []string{"2017-06-01T10:00:00Z", "21.5", "1"})
+	if err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+	response := EntryResponse{}
+	if err := json.Unmarshal(payload, &response); err != nil || !response.Unchanged {
+		t.Fatalf("update to the stored value was not marked unchanged: %s", payload)
+	}
+	if entryAsBytes, _ := stub.GetState("2017-06-01T10:00:00Z"); string(entryAsBytes) != string(storedAsBytes) {
+		t.Fatalf("update to the stored value rewrote the entry:\n%s", entryAsBytes)
+	}
+
+	payload, err = mockInvoke(stub, "tx3", "update", []string{"2017-06-01T10:00:00Z", "21.5", "1", "true"})
+	if err != nil {
+		t.Fatalf("forced update failed: %v", err)
+	}
+	response = EntryResponse{}
+	if err := json.Unmarshal(payload, &response); err != nil || response.Unchanged || !strings.Contains(string(response.Entry), `"version":2`) {
+		t.Fatalf("forced update did not write a new version: %s", payload)
+	}
+
+	payload, err = mockInvoke(stub, "tx4", "update", []string{"2017-06-01T10:00:00Z", "22", "2"})
+	if err != nil || strings.Contains(string(payload), `"unchanged"`) {
+		t.Fatalf("update to a new value returned %s, %v", payload, err)
+	}
+
+	_, err = mockInvoke(stub, "tx5", "update", []string{"2017-06-01T10:00:00Z", "22", "3", "always"})
+	checkErrorCode(t, err, errCodeBadArgs)
+}
+
+func TestSameJSONValue(t *testing.T) {
+	tests := []struct {
+		a, b string
+		same bool
+	}{
+		{`"21.5"`, `"21.5"`, true},
+		{`"a<b"`, `"a<b"`, true},
+		{`{"lat":1,"lon":2}`, `{ "lon": 2, "lat": 1 }`, true},
+		{`"21.5"`, `"21.50"`, false},
+		{`[1,2]`, `[2,1]`, false},
+		{`not json`, `not json`, false},
+	}
+	for _, test := range tests {
+		if sameJSONValue(json.RawMessage(test.a), json.RawMessage(test.b)) != test.same {
+			t.Fatalf("sameJSONValue(%s, %s) should be %v", test.a, test.b, test.same)
+		}
+	}
+}
+
+func TestExportNDJSON(t *testing.T) {
+	stub := &fakeQueryStub{MockStub: newTestStub(), kvs: []*queryresult.KV{
+		{Key: "2017-06-01T10:00:00Z", Value: []byte(`{"timestamp":"2017-06-01T10:00:00Z","deviceName":"sensor-1","attribute":"temperature","attributeValue":"21.5"}`)},
+		{Key: "2017-06-01T11:00:00Z", Value: []byte(`{"timestamp":"2017-06-01T11:00:00Z","deviceName":"sensor-1","attribute":"status","attributeValue":"a<b"}`)},
+	}}
+	args := []string{"sensor-1", "2017-06-01T00:00:00Z", "2017-06-02T00:00:00Z"}
+
+	result, err := new(SimpleChaincode).exportNDJSON(stub, args)
+	if err != nil {
+		t.Fatalf("exportNDJSON failed: %v", err)
+	}
+	expected := `{"Key":"2017-06-01T10:00:00Z","Record":{"timestamp":"2017-06-01T10:00:00Z","deviceName":"sensor-1","attribute":"temperature","attributeValue":"21.5"}}` + "\n" +
+		`{"Key":"2017-06-01T11:00:00Z","Record":{"timestamp":"2017-06-01T11:00:00Z","deviceName":"sensor-1","attribute":"status","attributeValue":"a<b"}}` + "\n"
+	if string(result) != expected {
+		t.Fatalf("unexpected NDJSON:\n%s\nexpected:\n%s", result, expected)
+	}
+
+	// a single line is valid JSON on its own, the export is still embedded as text
+	stub.kvs = stub.kvs[:1]
+	responseAsBytes := new(SimpleChaincode).query(stub, "exportNDJSON", args)
+	response := QueryResponse{}
+	if err := json.Unmarshal(responseAsBytes, &response); err != nil {
+		t.Fatalf("invalid response %s: %v", responseAsBytes, err)
+	}
+	var text string
+	if err := json.Unmarshal(response.Payload, &text); err != nil || !strings.HasSuffix(text, "}}\n") {
+		t.Fatalf("export was not embedded as a string: %s", response.Payload)
+	}
+}
+
+func TestDecodeIndexKey(t *testing.T) {
+	stub := newTestStub()
+
+	key, _ := stub.CreateCompositeKey(deviceAttrIndexName, []string{"sensor-1", "temperature", "2017-06-01T10:00:00Z"})
+	indexKey, err := decodeIndexKey(stub, key, deviceAttrIndexName)
+	if err != nil {
+		t.Fatalf("decodeIndexKey failed: %v", err)
+	}
+	if *indexKey != (decodedIndexKey{ObjectType: deviceAttrIndexName, DeviceName: "sensor-1", Attribute: "temperature", Timestamp: "2017-06-01T10:00:00Z"}) {
+		t.Fatalf("unexpected decoded key: %+v", indexKey)
+	}
+
+	key, _ = stub.CreateCompositeKey(deviceBucketIndexName, []string{"sensor-1", "2017-06-01T00:00:00Z", "2017-06-01T10:00:00Z"})
+	indexKey, err = decodeIndexKey(stub, key, deviceBucketIndexName)
+	if err != nil {
+		t.Fatalf("decodeIndexKey failed: %v", err)
+	}
+	if indexKey.Bucket != "2017-06-01T00:00:00Z" || indexKey.Timestamp != "2017-06-01T10:00:00Z" || indexKey.Attribute != "" {
+		t.Fatalf("unexpected decoded key: %+v", indexKey)
+	}
+
+	key, _ = stub.CreateCompositeKey(deviceAttributeIndexName, []string{"sensor-1", "temperature"})
+	indexKey, err = decodeIndexKey(stub, key, deviceAttributeIndexName)
+	if err != nil || indexKey.DeviceName != "sensor-1" || indexKey.Attribute != "temperature" || indexKey.Timestamp != "" {
+		t.Fatalf("unexpected decoded key: %+v, %v", indexKey, err)
+	}
+
+	key, _ = stub.CreateCompositeKey(deviceIndexName, []string{"sensor-1"})
+	indexKey, err = decodeIndexKey(stub, key, deviceIndexName)
+	if err != nil || indexKey.DeviceName != "sensor-1" {
+		t.Fatalf("unexpected decoded key: %+v, %v", indexKey, err)
+	}
+
+	// malformed keys
+	tooFewParts, _ := stub.CreateCompositeKey(deviceAttrIndexName, []string{"sensor-1", "temperature"})
+	tooManyParts, _ := stub.CreateCompositeKey(deviceIndexName, []string{"sensor-1", "temperature"})
+	otherIndex, _ := stub.CreateCompositeKey(deviceAttributeIndexName, []string{"sensor-1", "temperature"})
+	for _, malformed := range []struct {
+		key        string
+		objectType string
+	}{
+		{tooFewParts, deviceAttrIndexName},
+		{tooManyParts, deviceIndexName},
+		{otherIndex, deviceAttrIndexName},
+		{"2017-06-01T10:00:00Z", deviceAttrIndexName},
+		{"", deviceIndexName},
+		{key, idempotencyKeyName},
+	} {
+		_, err := decodeIndexKey(stub, malformed.key, malformed.objectType)
+		checkErrorCode(t, err, errCodeInternal)
+	}
+}
+
+func TestListDevicesRejectsMalformedIndexKey(t *testing.T) {
+	stub := newTestStub()
+	if _, err := mockInvoke(stub, "tx1", "create", []string{"2017-06-01T10:00:00Z", "sensor-1", "temperature", "21.5"}); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	malformed, _ := stub.CreateCompositeKey(deviceIndexName, []string{"sensor-2", "extra"})
+	stub.MockTransactionStart("tx2")
+	stub.PutState(malformed, []byte{0x00})
+	stub.MockTransactionEnd("tx2")
+
+	_, err := mockQuery(stub, "listDevices", []string{})
+	checkErrorCode(t, err, errCodeInternal)
+}
+
+func TestUpdateEntriesBatch(t *testing.T) {
+	stub := newTestStub()
+	for i, timestamp := range []string{"2017-06-01T10:00:00Z", "2017-06-01T11:00:00Z", "2017-06-01T12:00:00Z"} {
+		if _, err := mockInvoke(stub, "tx"+strconv.Itoa(i), "create", []string{timestamp, "sensor-1", "temperature", "21.5"}); err != nil {
+			t.Fatalf("create failed: %v", err)
+		}
+	}
+
+	updates := `{"2017-06-01T12:00:00Z": "22.0", "2017-06-01T10:00:00Z": "21.9", "2017-06-01T11:00:00Z": "21.5", "2017-06-01T13:00:00Z": "22.1"}`
+	payload, err := mockInvoke(stub, "tx4", "updateBatch", []string{updates})
+	if err != nil {
+		t.Fatalf("updateBatch failed: %v", err)
+	}
+	var result BatchUpdateResult
+	if err := json.Unmarshal(payload, &result); err != nil {
+		t.Fatalf("cannot decode result %s: %v", payload, err)
+	}
+	if strings.Join(result.Updated, ",") != "2017-06-01T10:00:00Z,2017-06-01T12:00:00Z" {
+		t.Fatalf("unexpected updated entries: %v", result.Updated)
+	}
+	if strings.Join(result.Unchanged, ",") != "2017-06-01T11:00:00Z" {
+		t.Fatalf("unexpected unchanged entries: %v", result.Unchanged)
+	}
+	if len(result.Failed) != 1 || result.Failed[0].Timestamp != "2017-06-01T13:00:00Z" || result.Failed[0].Code != errCodeNotFound {
+		t.Fatalf("unexpected failures: %+v", result.Failed)
+	}
+
+	var entry Entry
+	if err := json.Unmarshal(stub.State["2017-06-01T10:00:00.000000000Z"], &entry); err != nil {
+		t.Fatalf("cannot decode entry: %v", err)
+	}
+	if string(entry.AttributeValue) != `"21.9"` || entry.Version != 2 || entry.LastTxID != "tx4" {
+		t.Fatalf("entry not updated: %+v", entry)
+	}
+	if err := json.Unmarshal(stub.State["2017-06-01T11:00:00.000000000Z"], &entry); err != nil {
+		t.Fatalf("cannot decode entry: %v", err)
+	}
+	if entry.Version != 1 {
+		t.Fatalf("unchanged entry was written: %+v", entry)
+	}
+
+	payload, err = mockInvoke(stub, "tx5", "updateBatch", []string{`{"2017-06-01T10:00:00Z": ""}`})
+	if err != nil {
+		t.Fatalf("updateBatch failed: %v", err)
+	}
+	if err := json.Unmarshal(payload, &result); err != nil {
+		t.Fatalf("cannot decode result %s: %v", payload, err)
+	}
+	if len(result.Failed) != 1 || result.Failed[0].Code != errCodeBadArgs {
+		t.Fatalf("expected an invalid value to fail, got %+v", result.Failed)
+	}
+
+	_, err = mockInvoke(stub, "tx6", "updateBatch", []string{`["2017-06-01T10:00:00Z"]`})
+	checkErrorCode(t, err, errCodeBadArgs)
+
+	// soft-deleted entries and values not matching the type of the entry fail on their own
+	if _, err := mockInvoke(stub, "tx8", "softDelete", []string{"2017-06-01T11:00:00Z"}); err != nil {
+		t.Fatalf("softDelete failed: %v", err)
+	}
+	if _, err := mockInvoke(stub, "tx9", "create", []string{`{"timestamp":"2017-06-01T14:00:00Z","deviceName":"sensor-1","attribute":"temperature","attributeValue":"21.5","valueType":"number"}`}); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	deleted := string(stub.State["2017-06-01T11:00:00.000000000Z"])
+	numeric := string(stub.State["2017-06-01T14:00:00.000000000Z"])
+	payload, err = mockInvoke(stub, "tx10", "updateBatch", []string{`{"2017-06-01T11:00:00Z": "23", "2017-06-01T14:00:00Z": "hot"}`})
+	if err != nil {
+		t.Fatalf("updateBatch failed: %v", err)
+	}
+	result = BatchUpdateResult{}
+	if err := json.Unmarshal(payload, &result); err != nil {
+		t.Fatalf("cannot decode result %s: %v", payload, err)
+	}
+	if len(result.Updated) != 0 || len(result.Failed) != 2 || result.Failed[0].Code != errCodeNotFound || result.Failed[1].Code != errCodeBadArgs {
+		t.Fatalf("unexpected result: %s", payload)
+	}
+	if string(stub.State["2017-06-01T11:00:00.000000000Z"]) != deleted || string(stub.State["2017-06-01T14:00:00.000000000Z"]) != numeric {
+		t.Fatalf("failed entries were written")
+	}
+
+	defer func(size int) { maxUpdateBatchSize = size }(maxUpdateBatchSize)
+	maxUpdateBatchSize = 1
+	_, err = mockInvoke(stub, "tx7", "updateBatch", []string{updates})
+	checkErrorCode(t, err, errCodeBadArgs)
+}
+
+func TestDescribeSchema(t *testing.T) {
+	stub := newTestStub()
+	payload, err := mockQuery(stub, "schema", []string{})
+	if err != nil {
+		t.Fatalf("schema failed: %v", err)
+	}
+	var schema EntrySchema
+	if err := json.Unmarshal(payload, &schema); err != nil {
+		t.Fatalf("cannot decode schema %s: %v", payload, err)
+	}
+	if schema.Type != "Entry" {
+		t.Fatalf("unexpected type: %s", schema.Type)
+	}
+
+	// every JSON field of an entry is described
+	entryAsBytes, _ := json.Marshal(Entry{CreatedBy: &Identity{}, NumericValue: new(float64), AttributeValue: json.RawMessage(`""`), Tags: []string{"a"}, TxTimestamp: "t", DeletedAt: "t", LastTxID: "t", Hash: "h"})
+	var entryFields map[string]json.RawMessage
+	if err := json.Unmarshal(entryAsBytes, &entryFields); err != nil {
+		t.Fatalf("cannot decode entry: %v", err)
+	}
+	if len(schema.Fields) != len(entryFields) {
+		t.Fatalf("expected %d fields, got %d", len(entryFields), len(schema.Fields))
+	}
+	for _, field := range schema.Fields {
+		if _, ok := entryFields[field.JSONName]; !ok {
+			t.Fatalf("field %s is not in the JSON of an entry", field.JSONName)
+		}
+	}
+
+	timestamp, numericValue, createdBy := schema.Fields[0], schema.Fields[5], schema.Fields[6]
+	if timestamp.Name != "Timestamp" || timestamp.JSONName != "timestamp" || timestamp.Type != "string" || timestamp.OmitEmpty {
+		t.Fatalf("unexpected timestamp field: %+v", timestamp)
+	}
+	if numericValue.JSONName != "numericValue" || numericValue.Type != "*float64" || !numericValue.OmitEmpty {
+		t.Fatalf("unexpected numericValue field: %+v", numericValue)
+	}
+	if createdBy.JSONName != "createdBy" || len(createdBy.Fields) != 2 || createdBy.Fields[0].JSONName != "mspId" {
+		t.Fatalf("unexpected createdBy field: %+v", createdBy)
+	}
+}
+
+func TestCreateEntryFromJSONObject(t *testing.T) {
+	stub := newTestStub()
+	object := `{"valueType": "number", "attributeValue": "21.5", "attribute": "temperature", "deviceName": "sensor-1", "timestamp": "2017-06-01T10:00:00Z"}`
+	if _, err := mockInvoke(stub, "tx1", "create", []string{object}); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	var entry Entry
+	if err := json.Unmarshal(stub.State["2017-06-01T10:00:00.000000000Z"], &entry); err != nil {
+		t.Fatalf("cannot decode entry: %v", err)
+	}
+	if entry.DeviceName != "sensor-1" || entry.Attribute != "temperature" || string(entry.AttributeValue) != `"21.5"` || entry.NumericValue == nil || *entry.NumericValue != 21.5 || entry.Version != 1 {
+		t.Fatalf("unexpected entry: %+v", entry)
+	}
+
+	// chaincode maintained fields cannot be set
+	_, err := mockInvoke(stub, "tx2", "create", []string{`{"timestamp": "2017-06-01T11:00:00Z", "deviceName": "sensor-1", "attribute": "temperature", "attributeValue": "22", "version": 7}`})
+	checkErrorCode(t, err, errCodeBadArgs)
+
+	_, err = mockInvoke(stub, "tx3", "create", []string{`{"timestamp": 1496311200, "deviceName": "sensor-1", "attribute": "temperature", "attributeValue": "22"}`})
+	checkErrorCode(t, err, errCodeBadArgs)
+
+	// the object is validated like positional arguments
+	_, err = mockInvoke(stub, "tx4", "create", []string{`{"timestamp": "2017-06-01T12:00:00Z", "deviceName": "sensor-1", "attribute": "temperature", "attributeValue": "warm", "valueType": "number"}`})
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) || validationErr.Field != "attributeValue" {
+		t.Fatalf("expected a ValidationError on attributeValue, got %v", err)
+	}
+
+	// a single argument that is not a JSON object falls back to positional arguments
+	_, err = mockInvoke(stub, "tx5", "create", []string{"2017-06-01T13:00:00Z"})
+	checkErrorCode(t, err, errCodeBadArgs)
+	if _, ok := stub.State["2017-06-01T11:00:00.000000000Z"]; ok {
+		t.Fatalf("rejected entry was written")
+	}
+
+	// validate and upsert take the object form too
+	other := `{"timestamp": "2017-06-01T14:00:00Z", "deviceName": "sensor-1", "attribute": "temperature", "attributeValue": "23"}`
+	payload, err := mockQuery(stub, "validate", []string{other})
+	if err != nil || string(payload) != `{"valid":true}` {
+		t.Fatalf("validate returned %s, %v", payload, err)
+	}
+	_, err = mockQuery(stub, "validate", []string{object})
+	checkErrorCode(t, err, errCodeDuplicateKey)
+	_, err = mockQuery(stub, "validate", []string{`{"timestamp": "2017-06-01T14:00:00Z", "deviceName": "sensor-1", "attribute": "temperature", "attributeValue": "23", "version": 7}`})
+	checkErrorCode(t, err, errCodeBadArgs)
+
+	for i, operation := range []string{upsertInsert, upsertUpdate} {
+		payload, err := mockInvoke(stub, "upsert"+strconv.Itoa(i), "upsert", []string{other})
+		var result UpsertResult
+		if err != nil || json.Unmarshal(payload, &result) != nil || result.Operation != operation {
+			t.Fatalf("upsert returned %s, %v", payload, err)
+		}
+	}
+}
+
+func TestCheckThreshold(t *testing.T) {
+	reading := func(timestamp string, value string) *queryresult.KV {
+		return &queryresult.KV{Key: timestamp, Value: []byte(`{"timestamp":"` + timestamp + `","deviceName":"sensor-1","attribute":"temperature","attributeValue":"` + value + `"}`)}
+	}
+	stub := &fakeQueryStub{MockStub: newTestStub(), kvs: []*queryresult.KV{
+		reading("2017-06-01T10:03:00Z", "31"),
+		reading("2017-06-01T10:00:00Z", "30.5"),
+		reading("2017-06-01T10:01:00Z", "30"),
+		reading("2017-06-01T10:02:00Z", "n/a"),
+	}}
+	args := []string{"sensor-1", "temperature", ">", "30", "2017-06-01T10:00:00Z", "2017-06-01T11:00:00Z"}
+
+	result, err := new(SimpleChaincode).checkThreshold(stub, args)
+	if err != nil {
+		t.Fatalf("checkThreshold failed: %v", err)
+	}
+	var records []QueryRecord
+	if err := json.Unmarshal(result, &records); err != nil {
+		t.Fatalf("cannot decode result %s: %v", result, err)
+	}
+	if len(records) != 2 || records[0].Key != "2017-06-01T10:00:00Z" || records[1].Key != "2017-06-01T10:03:00Z" {
+		t.Fatalf("unexpected breaches: %s", result)
+	}
+	if !strings.Contains(stub.query, `"deviceName":"sensor-1"`) || !strings.Contains(stub.query, `"attribute":"temperature"`) {
+		t.Fatalf("unexpected query: %s", stub.query)
+	}
+
+	args[2] = "<="
+	result, err = new(SimpleChaincode).checkThreshold(stub, args)
+	if err != nil {
+		t.Fatalf("checkThreshold failed: %v", err)
+	}
+	if err := json.Unmarshal(result, &records); err != nil || len(records) != 1 || records[0].Key != "2017-06-01T10:01:00Z" {
+		t.Fatalf("unexpected breaches: %s", result)
+	}
+
+	args[2] = "~"
+	_, err = new(SimpleChaincode).checkThreshold(stub, args)
+	checkErrorCode(t, err, errCodeBadArgs)
+	_, err = new(SimpleChaincode).checkThreshold(stub, []string{"sensor-1", "temperature", ">", "NaN", "2017-06-01T10:00:00Z", "2017-06-01T11:00:00Z"})
+	checkErrorCode(t, err, errCodeBadArgs)
+}
+
+func TestTimeRangeBoundsWithOffset(t *testing.T) {
+	stub := newTestStub()
+	for i, timestamp := range []string{"2017-06-01T09:00:00Z", "2017-06-01T10:00:00Z", "2017-06-01T11:00:00Z"} {
+		if _, err := mockInvoke(stub, "tx"+strconv.Itoa(i), "create", []string{timestamp, "sensor-1", "temperature", "21.5"}); err != nil {
+			t.Fatalf("create failed: %v", err)
+		}
+	}
+
+	// 12:30+02:00 is 10:30Z, the window holds the 10:00 reading only
+	result, err := mockQuery(stub, "byTimeRange", []string{"2017-06-01T11:30:00+02:00", "2017-06-01T12:30:00+02:00"})
+	if err != nil {
+		t.Fatalf("byTimeRange failed: %v", err)
+	}
+	var records []QueryRecord
+	if err := json.Unmarshal(result, &records); err != nil || len(records) != 1 || records[0].Key != "2017-06-01T10:00:00.000000000Z" {
+		t.Fatalf("unexpected records: %s", result)
+	}
+	_, err = mockQuery(stub, "byTimeRange", []string{"yesterday", "2017-06-01T12:30:00+02:00"})
+	checkErrorCode(t, err, errCodeBadArgs)
+
+	// rich query windows are normalized alike
+	queryStub := &fakeQueryStub{MockStub: newTestStub()}
+	if _, err := new(SimpleChaincode).queryByDeviceAttributeRange(queryStub, []string{"sensor-1", "temperature", "2017-06-01T11:30:00+02:00", "2017-06-01T12:30:00+02:00"}); err != nil {
+		t.Fatalf("queryByDeviceAttributeRange failed: %v", err)
+	}
+	if !strings.Contains(queryStub.query, `"timestamp":{"$gte":"2017-06-01T09:30:00.000000000Z","$lte":"2017-06-01T10:30:00.000000000Z"}`) {
+		t.Fatalf("window was not normalized: %s", queryStub.query)
+	}
+
+	// a cutoff of 11:30+02:00 is 09:30Z, only the 09:00 reading is purged
+	payload, err := mockInvoke(stub, "purge", "purgeExpired", []string{"2017-06-01T11:30:00+02:00"})
+	if err != nil {
+		t.Fatalf("purgeExpired failed: %v", err)
+	}
+	var deletion DeletionResult
+	if err := json.Unmarshal(payload, &deletion); err != nil || deletion.Deleted != 1 {
+		t.Fatalf("unexpected purge result: %s", payload)
+	}
+	if stub.State["2017-06-01T09:00:00.000000000Z"] != nil || stub.State["2017-06-01T10:00:00.000000000Z"] == nil {
+		t.Fatalf("purge did not stop at the cutoff")
+	}
+}
+
+func TestTimestampKeysSortChronologically(t *testing.T) {
+	stub := newTestStub()
+	// written out of order and with trailing zeros dropped, as gateways send them
+	for i, timestamp := range []string{"2017-06-01T10:00:00.55Z", "2017-06-01T10:00:01Z", "2017-06-01T10:00:00Z", "2017-06-01T10:00:00.5Z", "2017-06-01T10:00:00.1Z"} {
+		if _, err := mockInvoke(stub, "tx"+strconv.Itoa(i), "create", []string{timestamp, "sensor-1", "temperature", "21.5"}); err != nil {
+			t.Fatalf("create failed: %v", err)
+		}
+	}
+
+	result, err := mockQuery(stub, "byTimeRange", []string{"2017-06-01T10:00:00Z", "2017-06-01T10:00:02Z"})
+	if err != nil {
+		t.Fatalf("byTimeRange failed: %v", err)
+	}
+	var records []QueryRecord
+	if err := json.Unmarshal(result, &records); err != nil {
+		t.Fatalf("byTimeRange returned invalid JSON: %s", result)
+	}
+	keys := []string{}
+	for _, record := range records {
+		keys = append(keys, record.Key)
+	}
+	expected := "2017-06-01T10:00:00.000000000Z,2017-06-01T10:00:00.100000000Z,2017-06-01T10:00:00.500000000Z," +
+		"2017-06-01T10:00:00.550000000Z,2017-06-01T10:00:01.000000000Z"
+	if strings.Join(keys, ",") != expected {
+		t.Fatalf("keys are not in time order: %v", keys)
+	}
+
+	// the readings after the cutoff are kept, whatever the width they were sent with
+	payload, err := mockInvoke(stub, "purge", "purgeExpired", []string{"2017-06-01T10:00:00.5Z"})
+	if err != nil {
+		t.Fatalf("purgeExpired failed: %v", err)
+	}
+	var deletion DeletionResult
+	if err := json.Unmarshal(payload, &deletion); err != nil || deletion.Deleted != 2 {
+		t.Fatalf("unexpected purge result: %s", payload)
+	}
+	for _, timestamp := range []string{"2017-06-01T10:00:00Z", "2017-06-01T10:00:00.1Z"} {
+		if stub.State[keyOf(timestamp)] != nil {
+			t.Fatalf("reading %s before the cutoff was not purged", timestamp)
+		}
+	}
+	for _, timestamp := range []string{"2017-06-01T10:00:00.5Z", "2017-06-01T10:00:00.55Z", "2017-06-01T10:00:01Z"} {
+		if stub.State[keyOf(timestamp)] == nil {
+			t.Fatalf("reading %s at or after the cutoff was purged", timestamp)
+		}
+	}
+
+	// single entry functions find the entry by any form of its timestamp
+	if _, err := mockInvoke(stub, "update", "update", []string{"2017-06-01T10:00:00.55Z", "22", "1"}); err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+}
+
+func TestMigrateEntriesNormalizesTimestampKeys(t *testing.T) {
+	stub := newTestStub()
+	legacyIndexKey, _ := stub.CreateCompositeKey(deviceAttrIndexName, []string{"sensor-1", "temperature", "2017-06-01T10:00:00.5Z"})
+	legacyBucketKey, _ := stub.CreateCompositeKey(deviceBucketIndexName, []string{"sensor-1", "2017-06-01T10:00:00Z", "2017-06-01T10:00:00.5Z"})
+	stub.MockTransactionStart("seed")
+	stub.PutState("2017-06-01T10:00:00.5Z", []byte(`{"timestamp":"2017-06-01T10:00:00.5Z","deviceName":"sensor-1","attribute":"temperature","attributeValue":"21.5","valueType":"string","deleted":false,"version":1}`))
+	stub.PutState(legacyIndexKey, []byte{0x00})
+	stub.PutState(legacyBucketKey, []byte{0x00})
+	stub.MockTransactionEnd("seed")
+
+	if _, err := mockInit(stub, "migrate", []string{"migrate"}); err != nil {
+		t.Fatalf("migrate failed: %v", err)
+	}
+	if stub.State["2017-06-01T10:00:00.5Z"] != nil || stub.State["2017-06-01T10:00:00.500000000Z"] == nil {
+		t.Fatalf("entry was not moved to its normalized key")
+	}
+	indexKey, _ := stub.CreateCompositeKey(deviceAttrIndexName, []string{"sensor-1", "temperature", "2017-06-01T10:00:00.500000000Z"})
+	if stub.State[legacyIndexKey] != nil || stub.State[legacyBucketKey] != nil || stub.State[indexKey] == nil {
+		t.Fatalf("indexes were not moved to the normalized timestamp")
+	}
+}
+
+func TestMigrateEntries(t *testing.T) {
+	stub := newTestStub()
+	// an entry already in the current schema next to one written before value types, hashes and indexes
+	if _, err := mockInvoke(stub, "tx1", "create", []string{"2017-06-01T10:00:00Z", "sensor-1", "temperature", "21.5"}); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	stub.MockTransactionStart("seed")
+	stub.PutState(keyOf("2017-06-01T11:00:00Z"), []byte(`{"timestamp":"2017-06-01T11:00:00.000000000Z","deviceName":"sensor-2","attribute":"humidity","attributeValue":"40","deleted":false,"version":1}`))
+	stub.MockTransactionEnd("seed")
+
+	payload, err := mockInit(stub, "migrate", []string{"migrate"})
+	if err != nil {
+		t.Fatalf("migrate failed: %v", err)
+	}
+	result := MigrationResult{}
+	if err := json.Unmarshal(payload, &result); err != nil || result.Scanned != 2 || result.Migrated != 1 {
+		t.Fatalf("migrate returned %s", payload)
+	}
+	var entry Entry
+	if err := json.Unmarshal(stub.State[keyOf("2017-06-01T11:00:00Z")], &entry); err != nil {
+		t.Fatalf("failed to decode migrated entry: %v", err)
+	}
+	if entry.ValueType != valueTypeString || entry.Hash == "" || entry.Version != 1 {
+		t.Fatalf("entry was not migrated to the current schema: %+v", entry)
+	}
+	indexKey, _ := stub.CreateCompositeKey(deviceAttrIndexName, []string{"sensor-2", "humidity", keyOf("2017-06-01T11:00:00Z")})
+	deviceKey, _ := stub.CreateCompositeKey(deviceIndexName, []string{"sensor-2"})
+	if stub.State[indexKey] == nil || stub.State[deviceKey] == nil {
+		t.Fatalf("indexes of the migrated entry were not written")
+	}
+	payload, err = mockQuery(stub, "byDeviceAttribute", []string{"sensor-2", "humidity"})
+	if err != nil || !strings.Contains(string(payload), keyOf("2017-06-01T11:00:00Z")) {
+		t.Fatalf("migrated entry is not found by its index: %s, %v", payload, err)
+	}
+
+	// a second run finds nothing to do and leaves state as it is
+	before := make(map[string]string, len(stub.State))
+	for key, value := range stub.State {
+		before[key] = string(value)
+	}
+	payload, err = mockInit(stub, "migrate-again", []string{"migrate"})
+	if err != nil {
+		t.Fatalf("second migrate failed: %v", err)
+	}
+	if err := json.Unmarshal(payload, &result); err != nil || result.Scanned != 2 || result.Migrated != 0 {
+		t.Fatalf("second migrate returned %s", payload)
+	}
+	if len(stub.State) != len(before) {
+		t.Fatalf("second migrate changed the number of keys from %d to %d", len(before), len(stub.State))
+	}
+	for key, value := range stub.State {
+		if before[key] != string(value) {
+			t.Fatalf("second migrate changed %q", key)
+		}
+	}
+}
+
+func TestInvokeInitMigrateRequiresAdmin(t *testing.T) {
+	stub := newTestStub()
+	stub.MockTransactionStart("seed")
+	stub.PutState("2017-06-01T10:00:00.5Z", []byte(`{"timestamp":"2017-06-01T10:00:00.5Z","deviceName":"sensor-1","attribute":"temperature","attributeValue":"21.5","deleted":false,"version":1}`))
+	stub.MockTransactionEnd("seed")
+
+	// writing entries is not enough to migrate the whole ledger
+	defer func(mspIDs []string) { authorizedAdminMSPs = mspIDs }(authorizedAdminMSPs)
+	authorizedAdminMSPs = []string{"AdminMSP"}
+	_, err := mockInvoke(stub, "tx1", "init", []string{"migrate"})
+	checkErrorCode(t, err, errCodeForbidden)
+	if stub.State["2017-06-01T10:00:00.5Z"] == nil {
+		t.Fatalf("entry was migrated by a client without the admin permission")
+	}
+
+	stub.Creator = newSerializedIdentity("AdminMSP", "admin")
+	if _, err := mockInvoke(stub, "tx2", "init", []string{"migrate"}); err != nil {
+		t.Fatalf("invoke of migrate by an admin failed: %v", err)
+	}
+	if stub.State["2017-06-01T10:00:00.5Z"] != nil || stub.State[keyOf("2017-06-01T10:00:00.5Z")] == nil {
+		t.Fatalf("entry was not migrated")
+	}
+}
+
+func TestMigrateEntriesRebuildsIndexes(t *testing.T) {
+	stub := newTestStub()
+	if _, err := mockInvoke(stub, "tx1", "create", []string{"2017-06-01T10:00:00Z", "sensor-1", "temperature", "21.5"}); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	indexKey, _ := stub.CreateCompositeKey(deviceAttrIndexName, []string{"sensor-1", "temperature", keyOf("2017-06-01T10:00:00Z")})
+	attributeKey, _ := stub.CreateCompositeKey(deviceAttributeIndexName, []string{"sensor-1", "temperature"})
+	stub.MockTransactionStart("drop")
+	stub.DelState(indexKey)
+	stub.DelState(attributeKey)
+	stub.MockTransactionEnd("drop")
+
+	payload, err := mockInit(stub, "migrate", []string{"migrate"})
+	if err != nil {
+		t.Fatalf("migrate failed: %v", err)
+	}
+	result := MigrationResult{}
+	if err := json.Unmarshal(payload, &result); err != nil || result.Migrated != 0 {
+		t.Fatalf("migrate returned %s", payload)
+	}
+	if stub.State[indexKey] == nil || stub.State[attributeKey] == nil {
+		t.Fatalf("indexes of an unchanged entry were not rebuilt")
+	}
+}
+
+func TestMigrateEntriesKeySchemeMove(t *testing.T) {
+	stub := newTestStub()
+	for i, args := range [][]string{
+		{"2017-06-01T10:00:00Z", "sensor-1", "temperature", "21.5"},
+		{"2017-06-01T10:00:01Z", "sensor-2", "temperature", "19"},
+	} {
+		if _, err := mockInvoke(stub, "tx"+strconv.Itoa(i), "create", args); err != nil {
+			t.Fatalf("create failed: %v", err)
+		}
+	}
+
+	defer func(scheme string) { entryKeyScheme = scheme }(entryKeyScheme)
+	entryKeyScheme = keySchemeDevice
+
+	// a partially migrated ledger, one entry was already moved to its device key
+	stub.MockTransactionStart("partial")
+	value := stub.State[keyOf("2017-06-01T10:00:00Z")]
+	stub.DelState(keyOf("2017-06-01T10:00:00Z"))
+	stub.PutState("sensor-1_"+keyOf("2017-06-01T10:00:00Z"), value)
+	stub.MockTransactionEnd("partial")
+
+	payload, err := mockInit(stub, "migrate", []string{"migrate"})
+	if err != nil {
+		t.Fatalf("migrate failed: %v", err)
+	}
+	result := MigrationResult{}
+	if err := json.Unmarshal(payload, &result); err != nil || result.Scanned != 2 || result.Migrated != 1 {
+		t.Fatalf("migrate returned %s", payload)
+	}
+	for _, key := range []string{"sensor-1_" + keyOf("2017-06-01T10:00:00Z"), "sensor-2_" + keyOf("2017-06-01T10:00:01Z")} {
+		if stub.State[key] == nil {
+			t.Fatalf("entry is missing under its device key %s", key)
+		}
+	}
+	if stub.State[keyOf("2017-06-01T10:00:01Z")] != nil {
+		t.Fatalf("entry was left under its timestamp key")
+	}
+
+	payload, err = mockInit(stub, "migrate-again", []string{"migrate"})
+	if err != nil {
+		t.Fatalf("second migrate failed: %v", err)
+	}
+	if err := json.Unmarshal(payload, &result); err != nil || result.Migrated != 0 {
+		t.Fatalf("second migrate returned %s", payload)
+	}
+
+	// an entry that would be moved onto an existing entry is reported instead of overwritten
+	stub.MockTransactionStart("conflict")
+	stub.PutState(keyOf("2017-06-01T10:00:01Z"), stub.State["sensor-2_"+keyOf("2017-06-01T10:00:01Z")])
+	stub.MockTransactionEnd("conflict")
+	_, err = mockInit(stub, "migrate-conflict", []string{"migrate"})
+	checkErrorCode(t, err, errCodeDuplicateKey)
+}
+
+func TestQueryByAttribute(t *testing.T) {
+	stub := &fakeQueryStub{MockStub: newTestStub()}
+	if _, err := new(SimpleChaincode).queryByAttribute(stub, []string{"temperature"}); err != nil {
+		t.Fatalf("queryByAttribute failed: %v", err)
+	}
+	if stub.query != `{"selector":{"attribute":"temperature","deleted":{"$ne":true}}}` {
+		t.Fatalf("unexpected query string: %s", stub.query)
+	}
+	if _, err := new(SimpleChaincode).queryByAttribute(stub, []string{"temperature", "true"}); err != nil {
+		t.Fatalf("queryByAttribute including deleted entries failed: %v", err)
+	}
+	if stub.query != `{"selector":{"attribute":"temperature"}}` {
+		t.Fatalf("unexpected query string including deleted entries: %s", stub.query)
+	}
+
+	_, err := new(SimpleChaincode).queryByAttribute(stub, []string{""})
+	checkErrorCode(t, err, errCodeBadArgs)
+	_, err = new(SimpleChaincode).queryByAttribute(stub, []string{"temperature", "maybe"})
+	checkErrorCode(t, err, errCodeBadArgs)
+}
+
+func TestQueryByDeviceAttributeRange(t *testing.T) {
+	stub := &fakeQueryStub{MockStub: newTestStub()}
+	if _, err := new(SimpleChaincode).queryByDeviceAttributeRange(stub, []string{"sensor-1", "temperature", "2017-06-01T12:00:00+02:00", "2017-06-01T11:00:00Z"}); err != nil {
+		t.Fatalf("queryByDeviceAttributeRange failed: %v", err)
+	}
+	if stub.query != `{"selector":{"attribute":"temperature","deleted":{"$ne":true},"deviceName":"sensor-1","timestamp":{"$gte":"2017-06-01T10:00:00.000000000Z","$lte":"2017-06-01T11:00:00.000000000Z"}}}` {
+		t.Fatalf("unexpected query string: %s", stub.query)
+	}
+
+	for _, args := range [][]string{
+		{"", "temperature", "2017-06-01T10:00:00Z", "2017-06-01T11:00:00Z"},
+		{"sensor-1", "", "2017-06-01T10:00:00Z", "2017-06-01T11:00:00Z"},
+		{"sensor-1", "temperature", "yesterday", "2017-06-01T11:00:00Z"},
+		{"sensor-1", "temperature", "2017-06-01T11:00:00Z", "2017-06-01T10:00:00Z"},
+	} {
+		_, err := new(SimpleChaincode).queryByDeviceAttributeRange(stub, args)
+		checkErrorCode(t, err, errCodeBadArgs)
+	}
+}
+
+func TestGetInfo(t *testing.T) {
+	stub := newTestStub()
+	payload, err := mockQuery(stub, "info", []string{})
+	if err != nil {
+		t.Fatalf("info failed: %v", err)
+	}
+	info := ChaincodeInfo{}
+	if err := json.Unmarshal(payload, &info); err != nil {
+		t.Fatalf("info returned invalid JSON: %s", payload)
+	}
+	if info.Version != chaincodeVersion || info.BuildTimestamp != buildTimestamp {
+		t.Fatalf("unexpected version in %s", payload)
+	}
+	if !sort.StringsAreSorted(info.InvokeFunctions) || !sort.StringsAreSorted(info.QueryFunctions) {
+		t.Fatalf("functions are not sorted: %s", payload)
+	}
+	cc := new(SimpleChaincode)
+	cc.registerFunctions()
+	if len(info.InvokeFunctions) != len(cc.invokeFunctions)+1 || len(info.QueryFunctions) != len(cc.queryFunctions) {
+		t.Fatalf("info does not list every function: %s", payload)
+	}
+	for _, function := range []string{"init", "create", "update"} {
+		if sort.SearchStrings(info.InvokeFunctions, function) == len(info.InvokeFunctions) {
+			t.Fatalf("invoke function %s is missing from %s", function, payload)
+		}
+	}
+}
+
+func TestAggregateAttribute(t *testing.T) {
+	reading := func(timestamp string, value string) *queryresult.KV {
+		return &queryresult.KV{Key: timestamp, Value: []byte(`{"timestamp":"` + timestamp + `","deviceName":"sensor-1","attribute":"temperature","attributeValue":"` + value + `"}`)}
+	}
+	args := []string{"sensor-1", "temperature", "2017-06-01T10:00:00Z", "2017-06-01T11:00:00Z"}
+	indexKey, _ := newTestStub().CreateCompositeKey(deviceAttrIndexName, []string{"sensor-1", "temperature", "2017-06-01T10:00:00Z"})
+
+	stub := &fakeQueryStub{MockStub: newTestStub(), kvs: []*queryresult.KV{
+		reading("2017-06-01T10:00:00Z", "20"),
+		reading("2017-06-01T10:10:00Z", "n/a"),
+		reading("2017-06-01T10:20:00Z", "23.5"),
+		reading("2017-06-01T10:30:00Z", "-1.5"),
+		{Key: "2017-06-01T10:40:00Z", Value: []byte(`not an entry`)},
+		{Key: indexKey, Value: []byte{0x00}},
+	}}
+	result, err := new(SimpleChaincode).aggregateAttribute(stub, args)
+	if err != nil {
+		t.Fatalf("aggregate failed: %v", err)
+	}
+	if string(result) != `{"count":3,"min":-1.5,"max":23.5,"sum":42,"avg":14,"skipped":2}` {
+		t.Fatalf("unexpected aggregate: %s", result)
+	}
+	if stub.query != `{"selector":{"attribute":"temperature","deleted":{"$ne":true},"deviceName":"sensor-1","timestamp":{"$gte":"2017-06-01T10:00:00.000000000Z","$lte":"2017-06-01T11:00:00.000000000Z"}}}` {
+		t.Fatalf("unexpected query string: %s", stub.query)
+	}
+
+	// an empty window has no statistics, and neither has a window of non-numeric values
+	for name, kvs := range map[string][]*queryresult.KV{
+		"empty":       {},
+		"non-numeric": {reading("2017-06-01T10:00:00Z", "n/a"), reading("2017-06-01T10:10:00Z", "true")},
+	} {
+		stub := &fakeQueryStub{MockStub: newTestStub(), kvs: kvs}
+		result, err := new(SimpleChaincode).aggregateAttribute(stub, args)
+		if err != nil {
+			t.Fatalf("aggregate of a %s window failed: %v", name, err)
+		}
+		expected := `{"count":0,"min":null,"max":null,"sum":0,"avg":null,"skipped":` + strconv.Itoa(len(kvs)) + `}`
+		if string(result) != expected {
+			t.Fatalf("unexpected aggregate of a %s window: %s", name, result)
+		}
+	}
+
+	// a window is aggregated up to the query limit, not beyond
+	var kvs []*queryresult.KV
+	for i := 0; i <= maxQueryResults; i++ {
+		kvs = append(kvs, reading("2017-06-01T10:00:00Z", "20"))
+	}
+	_, err = new(SimpleChaincode).aggregateAttribute(&fakeQueryStub{MockStub: newTestStub(), kvs: kvs}, args)
+	checkErrorCode(t, err, errCodeResultLimit)
+	_, err = new(SimpleChaincode).aggregateAttribute(&fakeQueryStub{MockStub: newTestStub(), kvs: kvs[1:]}, args)
+	if err != nil {
+		t.Fatalf("aggregate at the query limit failed: %v", err)
+	}
+
+	// the statistics are fixed, an aggregation function cannot be chosen
+	_, err = new(SimpleChaincode).aggregateAttribute(stub, append(args, "median"))
+	checkErrorCode(t, err, errCodeBadArgs)
+	_, err = new(SimpleChaincode).aggregateAttribute(stub, []string{"sensor-1", "temperature", "2017-06-01T11:00:00Z", "2017-06-01T10:00:00Z"})
+	checkErrorCode(t, err, errCodeBadArgs)
+	_, err = new(SimpleChaincode).aggregateAttribute(stub, []string{"", "temperature", "2017-06-01T10:00:00Z", "2017-06-01T11:00:00Z"})
+	checkErrorCode(t, err, errCodeBadArgs)
+}
+
+func TestLoggerLevel(t *testing.T) {
+	defer logger.SetLevel(shim.LogInfo)
+
+	logger.SetLevel(shim.LogInfo)
+	if logger.IsEnabledFor(shim.LogDebug) || !logger.IsEnabledFor(shim.LogInfo) {
+		t.Fatalf("debug output is not silenced at the INFO level")
+	}
+	logger.SetLevel(shim.LogDebug)
+	if !logger.IsEnabledFor(shim.LogDebug) {
+		t.Fatalf("debug output is not enabled at the DEBUG level")
+	}
+}
+
+func TestExistsEntry(t *testing.T) {
+	stub := newTestStub()
+	exists := func(key string) string {
+		t.Helper()
+		payload, err := mockQuery(stub, "exists", []string{key})
+		if err != nil {
+			t.Fatalf("exists failed: %v", err)
+		}
+		return string(payload)
+	}
+
+	if exists("2017-06-01T10:00:00Z") != `{"exists":false}` {
+		t.Fatalf("a missing entry is reported as existing")
+	}
+	if _, err := mockInvoke(stub, "tx1", "create", []string{"2017-06-01T10:00:00Z", "sensor-1", "temperature", "21.5"}); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	// any form of the timestamp finds the entry
+	for _, key := range []string{"2017-06-01T10:00:00Z", "2017-06-01T12:00:00+02:00", keyOf("2017-06-01T10:00:00Z")} {
+		if exists(key) != `{"exists":true}` {
+			t.Fatalf("entry is not found by %s", key)
+		}
+	}
+	if _, err := mockInvoke(stub, "tx2", "softDelete", []string{"2017-06-01T10:00:00Z"}); err != nil {
+		t.Fatalf("softDelete failed: %v", err)
+	}
+	if exists("2017-06-01T10:00:00Z") != `{"exists":true}` {
+		t.Fatalf("a soft-deleted entry is reported as missing")
+	}
+
+	_, err := mockQuery(stub, "exists", []string{""})
+	checkErrorCode(t, err, errCodeBadArgs)
+}
+
+func TestGetAllEntriesPaged(t *testing.T) {
+	stub := newTestStub()
+	for i, timestamp := range []string{"2017-06-01T10:00:00Z", "2017-06-01T11:00:00Z", "2017-06-01T12:00:00Z"} {
+		if _, err := mockInvoke(stub, "tx"+strconv.Itoa(i), "create", []string{timestamp, "sensor-1", "temperature", "21.5"}); err != nil {
+			t.Fatalf("create failed: %v", err)
+		}
+	}
+	if _, err := mockInvoke(stub, "tx3", "softDelete", []string{"2017-06-01T11:00:00Z"}); err != nil {
+		t.Fatalf("softDelete failed: %v", err)
+	}
+
+	type page struct {
+		Records          []QueryRecord
+		ResponseMetadata struct {
+			FetchedRecordsCount int
+			Bookmark            string
+		}
+	}
+	readAll := func(includeDeleted string) []string {
+		t.Helper()
+		keys := []string{}
+		bookmark := ""
+		for i := 0; ; i++ {
+			payload, err := mockQuery(stub, "getAllPaged", []string{"2", bookmark, includeDeleted})
+			if err != nil {
+				t.Fatalf("getAllPaged failed: %v", err)
+			}
+			result := page{}
+			if err := json.Unmarshal(payload, &result); err != nil {
+				t.Fatalf("getAllPaged returned invalid JSON: %s", payload)
+			}
+			for _, record := range result.Records {
+				if isCompositeKey(record.Key) {
+					t.Fatalf("index entry %q returned as a record", record.Key)
+				}
+				keys = append(keys, record.Key)
+			}
+			if result.ResponseMetadata.Bookmark == "" {
+				return keys
+			}
+			if i > len(stub.State) {
+				t.Fatalf("paging does not end")
+			}
+			bookmark = result.ResponseMetadata.Bookmark
+		}
+	}
+
+	if keys := readAll("false"); strings.Join(keys, ",") != strings.Join(keysOf("2017-06-01T10:00:00Z", "2017-06-01T12:00:00Z"), ",") {
+		t.Fatalf("unexpected entries %v", keys)
+	}
+	if keys := readAll("true"); strings.Join(keys, ",") != strings.Join(keysOf("2017-06-01T10:00:00Z", "2017-06-01T11:00:00Z", "2017-06-01T12:00:00Z"), ",") {
+		t.Fatalf("unexpected entries including deleted ones %v", keys)
+	}
+
+	for _, pageSize := range []string{"0", "-1", "ten"} {
+		_, err := mockQuery(stub, "getAllPaged", []string{pageSize})
+		checkErrorCode(t, err, errCodeBadArgs)
+	}
+}
+
+// fakeHistoryStub is a MockStub that answers every history query with a fixed list of
+// modifications, MockStub itself does not implement GetHistoryForKey
+type fakeHistoryStub struct {
+	*shim.MockStub
+	modifications []*queryresult.KeyModification
+}
+
+func (stub *fakeHistoryStub) GetHistoryForKey(key string) (shim.HistoryQueryIteratorInterface, error) {
+	return &fakeHistoryIterator{modifications: stub.modifications}, nil
+}
+
+// fakeHistoryIterator iterates over a fixed list of key modifications
+type fakeHistoryIterator struct {
+	modifications []*queryresult.KeyModification
+	next          int
+}
+
+func (it *fakeHistoryIterator) HasNext() bool {
+	return it.next < len(it.modifications)
+}
+
+func (it *fakeHistoryIterator) Close() error {
+	return nil
+}
+
+func (it *fakeHistoryIterator) Next() (*queryresult.KeyModification, error) {
+	if !it.HasNext() {
+		return nil, errors.New("no more results")
+	}
+	it.next++
+	return it.modifications[it.next-1], nil
+}
+
+func TestGetEntryWithMeta(t *testing.T) {
+	stub := &fakeHistoryStub{MockStub: newTestStub(), modifications: []*queryresult.KeyModification{{TxId: "tx1"}, {TxId: "tx2"}}}
+	if _, err := mockInvoke(stub.MockStub, "tx1", "create", []string{"2017-06-01T10:00:00Z", "sensor-1", "temperature", "21.5"}); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	stored := string(stub.State[keyOf("2017-06-01T10:00:00Z")])
+
+	result, err := new(SimpleChaincode).getEntryWithMeta(stub, []string{"2017-06-01T10:00:00Z"})
+	if err != nil {
+		t.Fatalf("getWithMeta failed: %v", err)
+	}
+	if string(result) != `{"entry":`+stored+`}` {
+		t.Fatalf("unexpected result without history count: %s", result)
+	}
+	result, err = new(SimpleChaincode).getEntryWithMeta(stub, []string{"2017-06-01T10:00:00Z", "true"})
+	if err != nil {
+		t.Fatalf("getWithMeta with history count failed: %v", err)
+	}
+	if string(result) != `{"entry":`+stored+`,"historyCount":2}` {
+		t.Fatalf("unexpected result with history count: %s", result)
+	}
+
+	_, err = new(SimpleChaincode).getEntryWithMeta(stub, []string{"2017-06-01T10:00:00Z", "yes"})
+	checkErrorCode(t, err, errCodeBadArgs)
+	_, err = new(SimpleChaincode).getEntryWithMeta(stub, []string{"2017-06-01T11:00:00Z"})
+	checkErrorCode(t, err, errCodeNotFound)
+}
+
+func TestRecentEntries(t *testing.T) {
+	stub := &fakeQueryStub{MockStub: newTestStub()}
+	if _, err := new(SimpleChaincode).recentEntries(stub, []string{"5"}); err != nil {
+		t.Fatalf("recent failed: %v", err)
+	}
+	query := richQuery{}
+	if err := json.Unmarshal([]byte(stub.query), &query); err != nil {
+		t.Fatalf("invalid query string %s: %v", stub.query, err)
+	}
+	if query.Limit != 5 || len(query.Sort) != 1 || query.Sort[0]["timestamp"] != "desc" || !strings.Contains(stub.query, `"deleted":{"$ne":true}`) {
+		t.Fatalf("unexpected query string: %s", stub.query)
+	}
+
+	for _, count := range []string{"0", "-1", strconv.Itoa(maxRecentEntries + 1), "many"} {
+		_, err := new(SimpleChaincode).recentEntries(stub, []string{count})
+		checkErrorCode(t, err, errCodeBadArgs)
+	}
+}
+
+func TestQueryByDevices(t *testing.T) {
+	stub := &fakeQueryStub{MockStub: newTestStub()}
+	if _, err := new(SimpleChaincode).queryByDevices(stub, []string{`["sensor-1","sensor-2"]`}); err != nil {
+		t.Fatalf("queryByDevices failed: %v", err)
+	}
+	if stub.query != `{"selector":{"deleted":{"$ne":true},"deviceName":{"$in":["sensor-1","sensor-2"]}}}` {
+		t.Fatalf("unexpected query string: %s", stub.query)
+	}
+
+	tooMany := make([]string, maxDevicesPerQuery+1)
+	for i := range tooMany {
+		tooMany[i] = "sensor-" + strconv.Itoa(i)
+	}
+	tooManyJSON, _ := json.Marshal(tooMany)
+	for _, devices := range []string{`[]`, `"sensor-1"`, `["sensor 1"]`, `["sensor-1",""]`, string(tooManyJSON)} {
+		_, err := new(SimpleChaincode).queryByDevices(stub, []string{devices})
+		checkErrorCode(t, err, errCodeBadArgs)
+	}
+}
+
+func TestBulkWritesUnauthorizedOrganization(t *testing.T) {
+	stub := newTestStub()
+	if _, err := mockInvoke(stub, "tx1", "create", []string{"2017-06-01T10:00:00Z", "sensor-1", "temperature", "21.5"}); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	stub.Creator = newSerializedIdentity("Org2MSP", "gateway-2")
+
+	for function, args := range map[string][]string{
+		"deleteByDevice": {"sensor-1"},
+		"purgeExpired":   {"2017-06-02T00:00:00Z"},
+		"updateBatch":    {`{"2017-06-01T10:00:00Z": "22"}`},
+	} {
+		_, err := mockInvoke(stub, "tx2", function, args)
+		checkErrorCode(t, err, errCodeForbidden)
+	}
+	var entry Entry
+	if err := json.Unmarshal(stub.State[keyOf("2017-06-01T10:00:00Z")], &entry); err != nil || entry.Version != 1 {
+		t.Fatalf("entry was changed by a foreign organization: %+v, %v", entry, err)
+	}
+}
+
+func TestEntryWritesUnauthorizedOrganization(t *testing.T) {
+	stub := newTestStub()
+	if _, err := mockInvoke(stub, "tx1", "create", []string{"2017-06-01T10:00:00Z", "sensor-1", "temperature", "21.5"}); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	stored := string(stub.State[keyOf("2017-06-01T10:00:00Z")])
+	stub.Creator = newSerializedIdentity("Org2MSP", "gateway-2")
+
+	for function, args := range map[string][]string{
+		"update":     {"2017-06-01T10:00:00Z", "22", "1"},
+		"patch":      {"2017-06-01T10:00:00Z", `{"attributeValue":"22"}`, "1"},
+		"delete":     {"2017-06-01T10:00:00Z"},
+		"softDelete": {"2017-06-01T10:00:00Z"},
+		"addTag":     {"2017-06-01T10:00:00Z", "calibration"},
+		"removeTag":  {"2017-06-01T10:00:00Z", "calibration"},
+	} {
+		_, err := mockInvoke(stub, "tx2", function, args)
+		checkErrorCode(t, err, errCodeForbidden)
+	}
+	if string(stub.State[keyOf("2017-06-01T10:00:00Z")]) != stored {
+		t.Fatalf("entry was changed by a foreign organization")
+	}
+}